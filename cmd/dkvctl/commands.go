@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tomkaith13/dist-kv-store/pkg/client"
+)
+
+// dispatch runs the command name with its args.
+func (c *cli) dispatch(ctx context.Context, name string, args []string) error {
+	if name == "watch" {
+		// a watch runs until interrupted, not for -timeout.
+		return c.watch(ctx, args)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	switch name {
+	case "get":
+		return c.get(ctx, args)
+	case "put":
+		return c.put(ctx, args)
+	case "del":
+		return c.del(ctx, args)
+	case "list":
+		return c.list(ctx, args)
+	case "cluster":
+		return c.cluster(ctx, args)
+	case "snapshot":
+		return c.snapshot(ctx, args)
+	case "backup":
+		return c.backup(ctx, args)
+	case "restore":
+		return c.restore(ctx, args)
+	case "status":
+		return c.status(ctx, args)
+	}
+	return usagef("unknown command %q, run dkvctl -h for the list", name)
+}
+
+// flags returns the flag set of a command. synopsis is shown by -h.
+func (c *cli) flags(name, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(c.stderr, "Usage: dkvctl %s %s\n", name, synopsis)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses args into fs and checks the number of positional arguments.
+func parse(fs *flag.FlagSet, args []string, minArgs, maxArgs int) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return usageError{msg: err.Error()}
+	}
+	if fs.NArg() < minArgs || fs.NArg() > maxArgs {
+		fs.Usage()
+		return usagef("%s: wrong number of arguments", fs.Name())
+	}
+	return nil
+}
+
+func (c *cli) get(ctx context.Context, args []string) error {
+	fs := c.flags("get", "[-consistency stale|leader-lease|linearizable] [-value] <key>")
+	consistency := fs.String("consistency", "", "read consistency, the node's default when empty")
+	valueOnly := fs.Bool("value", false, "print only the value, as is")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+
+	entry, err := c.client.GetWithConsistency(ctx, fs.Arg(0), client.Consistency(*consistency))
+	if err != nil {
+		return err
+	}
+	if *valueOnly {
+		_, err := fmt.Fprintln(c.stdout, entry.Value)
+		return err
+	}
+	return c.out.print(entry, []string{"KEY", "REVISION", "VALUE"},
+		[][]string{{entry.Key, strconv.FormatUint(entry.Revision, 10), entry.Value}})
+}
+
+func (c *cli) put(ctx context.Context, args []string) error {
+	fs := c.flags("put", "[-ttl duration] [-create | -update | -rev revision] <key> <value|->")
+	var opts client.PutOptions
+	fs.DurationVar(&opts.TTL, "ttl", 0, "expire the key after this long")
+	fs.BoolVar(&opts.CreateOnly, "create", false, "fail if the key exists")
+	fs.BoolVar(&opts.UpdateOnly, "update", false, "fail unless the key exists")
+	fs.Uint64Var(&opts.Revision, "rev", 0, "fail unless the key is still at this revision")
+	if err := parse(fs, args, 2, 2); err != nil {
+		return err
+	}
+	if opts.CreateOnly && (opts.UpdateOnly || opts.Revision != 0) {
+		return usagef("put: -create excludes -update and -rev")
+	}
+
+	key, val := fs.Arg(0), fs.Arg(1)
+	if val == "-" {
+		b, err := io.ReadAll(c.stdin)
+		if err != nil {
+			return err
+		}
+		val = string(b)
+	}
+	revision, err := c.client.Put(ctx, key, val, opts)
+	if err != nil {
+		return err
+	}
+	return c.out.print(struct {
+		Key      string `json:"key"`
+		Revision uint64 `json:"revision"`
+	}{key, revision}, []string{"KEY", "REVISION"}, [][]string{{key, strconv.FormatUint(revision, 10)}})
+}
+
+func (c *cli) del(ctx context.Context, args []string) error {
+	fs := c.flags("del", "[-rev revision] <key>")
+	revision := fs.Uint64("rev", 0, "fail unless the key is still at this revision")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+
+	key := fs.Arg(0)
+	var err error
+	if *revision != 0 {
+		err = c.client.CompareAndDelete(ctx, key, *revision)
+	} else {
+		err = c.client.Delete(ctx, key)
+	}
+	if err != nil {
+		return err
+	}
+	return c.out.print(struct {
+		Key     string `json:"key"`
+		Deleted bool   `json:"deleted"`
+	}{key, true}, nil, [][]string{{"deleted " + key}})
+}
+
+func (c *cli) list(ctx context.Context, args []string) error {
+	fs := c.flags("list", "[-prefix p] [-start k] [-end k] [-values] [-limit n [-continue token]]")
+	var opts client.ListOptions
+	fs.StringVar(&opts.Prefix, "prefix", "", "only keys starting with this")
+	fs.StringVar(&opts.Start, "start", "", "first key, inclusive")
+	fs.StringVar(&opts.End, "end", "", "last key, exclusive")
+	fs.BoolVar(&opts.Values, "values", false, "include the values")
+	fs.IntVar(&opts.Limit, "limit", 0, "return one page of at most this many keys, all keys when 0")
+	fs.StringVar(&opts.Continue, "continue", "", "next token of the previous page")
+	consistency := fs.String("consistency", "", "read consistency, the node's default when empty")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	opts.Consistency = client.Consistency(*consistency)
+
+	var result client.ListResult
+	for {
+		page, err := c.client.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		result.Keys = append(result.Keys, page.Keys...)
+		result.Next = page.Next
+		if opts.Limit != 0 || page.Next == "" {
+			break
+		}
+		opts.Continue = page.Next
+	}
+	if result.Keys == nil {
+		result.Keys = []client.ListedKey{}
+	}
+
+	header := []string{"KEY", "REVISION"}
+	if opts.Values {
+		header = append(header, "VALUE")
+	}
+	var rows [][]string
+	for _, k := range result.Keys {
+		row := []string{k.Key, strconv.FormatUint(k.Revision, 10)}
+		if opts.Values {
+			row = append(row, k.Value)
+		}
+		rows = append(rows, row)
+	}
+	if err := c.out.print(result, header, rows); err != nil {
+		return err
+	}
+	if result.Next != "" && !c.out.json {
+		fmt.Fprintf(c.stderr, "more keys, continue with -continue %q\n", result.Next)
+	}
+	return nil
+}
+
+func (c *cli) watch(ctx context.Context, args []string) error {
+	fs := c.flags("watch", "[-key k | -prefix p] [-index n] [-count n]")
+	var opts client.WatchOptions
+	fs.StringVar(&opts.Key, "key", "", "watch this key only")
+	fs.StringVar(&opts.Prefix, "prefix", "", "watch the keys starting with this")
+	fs.Uint64Var(&opts.AfterIndex, "index", 0, "resume after this index, from now when 0")
+	count := fs.Int("count", 0, "stop after this many events, never when 0")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	if opts.Key != "" && opts.Prefix != "" {
+		return usagef("watch: -key and -prefix are exclusive")
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	watcher := c.client.Watch(ctx, opts)
+	seen := 0
+	for event := range watcher.Events {
+		row := []string{strconv.FormatUint(event.Index, 10), event.Type, event.Key, event.Value}
+		if err := c.out.print(event, nil, [][]string{row}); err != nil {
+			return err
+		}
+		if seen++; seen == *count {
+			cancel()
+			break
+		}
+	}
+	for range watcher.Events {
+	}
+	if err := watcher.Err(); !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("watch ended after index %d: %w", watcher.Index(), err)
+	}
+	return nil
+}
+
+func (c *cli) cluster(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usagef("cluster: expected members, remove or transfer-leader")
+	}
+	switch args[0] {
+	case "members":
+		return c.members(ctx, args[1:])
+	case "remove":
+		return c.removeMember(ctx, args[1:])
+	case "transfer-leader":
+		return c.transferLeader(ctx, args[1:])
+	}
+	return usagef("cluster: unknown command %q, expected members, remove or transfer-leader", args[0])
+}
+
+func (c *cli) members(ctx context.Context, args []string) error {
+	fs := c.flags("cluster members", "")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	members, err := c.client.Members(ctx)
+	if err != nil {
+		return err
+	}
+	var rows [][]string
+	for _, m := range members {
+		lastContact := ""
+		if m.LastContact != nil {
+			lastContact = m.LastContact.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{m.ID, m.Role, strconv.FormatBool(m.Leader), strconv.FormatBool(m.Healthy),
+			m.RaftAddr, m.HTTPAddr, lastContact})
+	}
+	return c.out.print(members, []string{"ID", "ROLE", "LEADER", "HEALTHY", "RAFT ADDR", "HTTP ADDR", "LAST CONTACT"}, rows)
+}
+
+func (c *cli) removeMember(ctx context.Context, args []string) error {
+	fs := c.flags("cluster remove", "<id>")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+
+	id := fs.Arg(0)
+	if err := c.client.RemoveMember(ctx, id); err != nil {
+		return err
+	}
+	return c.out.print(struct {
+		ID      string `json:"id"`
+		Removed bool   `json:"removed"`
+	}{id, true}, nil, [][]string{{"removed " + id}})
+}
+
+func (c *cli) transferLeader(ctx context.Context, args []string) error {
+	fs := c.flags("cluster transfer-leader", "[id]")
+	if err := parse(fs, args, 0, 1); err != nil {
+		return err
+	}
+
+	leaderID, err := c.client.TransferLeadership(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return c.out.print(struct {
+		LeaderID string `json:"leader_id"`
+	}{leaderID}, nil, [][]string{{fmt.Sprintf("leadership transferred to %q", leaderID)}})
+}
+
+func (c *cli) snapshot(ctx context.Context, args []string) error {
+	fs := c.flags("snapshot", "")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	snapshot, err := c.client.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	return c.out.print(snapshot, []string{"ID", "INDEX", "TERM", "SIZE"}, [][]string{{snapshot.ID,
+		strconv.FormatUint(snapshot.Index, 10), strconv.FormatUint(snapshot.Term, 10), strconv.FormatInt(snapshot.Size, 10)}})
+}
+
+func (c *cli) backup(ctx context.Context, args []string) error {
+	fs := c.flags("backup", "[-f file]")
+	file := fs.String("f", "dkv.backup", "file to write the archive to, - for stdout")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	if *file == "-" {
+		_, err := c.client.Backup(ctx, c.stdout)
+		return err
+	}
+	// the archive only replaces an older file once it is complete.
+	f, err := os.CreateTemp(filepath.Dir(*file), ".dkv-backup-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	n, err := c.client.Backup(ctx, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), *file); err != nil {
+		return err
+	}
+	return c.out.print(struct {
+		File  string `json:"file"`
+		Bytes int64  `json:"bytes"`
+	}{*file, n}, nil, [][]string{{fmt.Sprintf("wrote %d bytes to %s", n, *file)}})
+}
+
+func (c *cli) restore(ctx context.Context, args []string) error {
+	fs := c.flags("restore", "<file|->")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+
+	var archive io.Reader = c.stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		archive = f
+	}
+	meta, err := c.client.Restore(ctx, archive)
+	if err != nil {
+		return err
+	}
+	return c.out.print(meta, []string{"NODE", "INDEX", "TERM", "SIZE", "CREATED AT"}, [][]string{{meta.NodeID,
+		strconv.FormatUint(meta.Index, 10), strconv.FormatUint(meta.Term, 10), strconv.FormatInt(meta.Size, 10),
+		meta.CreatedAt.Format(time.RFC3339)}})
+}
+
+// endpointStatus is the status of one endpoint, or why it has none.
+type endpointStatus struct {
+	Endpoint string         `json:"endpoint"`
+	Status   *client.Status `json:"status,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// status asks every endpoint for its status, all at once so a node that is
+// down does not hold up the others. An endpoint that does not answer is shown
+// with its error and fails the command as unavailable.
+func (c *cli) status(ctx context.Context, args []string) error {
+	fs := c.flags("status", "")
+	if err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	statuses := make([]endpointStatus, len(c.endpoints))
+	errs := make([]error, len(c.endpoints))
+	var wg sync.WaitGroup
+	for i, endpoint := range c.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i].Endpoint = endpoint
+			st, err := c.client.Status(ctx, endpoint)
+			if err != nil {
+				statuses[i].Error = err.Error()
+				errs[i] = fmt.Errorf("%s: %w", endpoint, err)
+				return
+			}
+			statuses[i].Status = &st
+		}()
+	}
+	wg.Wait()
+
+	var rows [][]string
+	for _, es := range statuses {
+		if st := es.Status; st != nil {
+			rows = append(rows, []string{es.Endpoint, st.ID, st.State, st.LeaderID, strconv.FormatUint(st.Term, 10),
+				strconv.FormatUint(st.CommitIndex, 10), strconv.FormatUint(st.FSMAppliedIndex, 10), ""})
+		} else {
+			rows = append(rows, []string{es.Endpoint, "", "", "", "", "", "", es.Error})
+		}
+	}
+	if err := c.out.print(statuses, []string{"ENDPOINT", "ID", "STATE", "LEADER", "TERM", "COMMIT", "APPLIED", "ERROR"}, rows); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
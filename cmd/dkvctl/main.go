@@ -0,0 +1,225 @@
+// Command dkvctl talks to a dkv cluster over its HTTP API.
+//
+//	dkvctl [global flags] <command> [flags] [args]
+//
+// Endpoints come from -endpoints or DKV_ENDPOINTS, the API token from -token
+// or DKV_TOKEN. Results are printed as a table, or as JSON with -o json. The
+// exit code tells scripts what went wrong, see the exit* constants.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tomkaith13/dist-kv-store/pkg/client"
+)
+
+// exit codes.
+const (
+	exitOK = iota
+	exitError
+	exitUsage
+	exitNotFound
+	// exitPrecondition is a failed conditional write, or a create of a key
+	// that exists.
+	exitPrecondition
+	// exitUnavailable is a cluster without a leader, or nodes that could not
+	// be reached before the timeout.
+	exitUnavailable
+	exitAuth
+)
+
+const defaultEndpoint = "http://localhost:8888"
+
+const usage = `Usage: dkvctl [global flags] <command> [flags] [args]
+
+Commands:
+  get <key>                       read a key
+  put <key> <value|->             write a key, - reads the value from stdin
+  del <key>                       delete a key
+  list                            list keys in order
+  watch                           print changes to keys until interrupted
+  cluster members                 list the raft members
+  cluster remove <id>             remove a member
+  cluster transfer-leader [id]    hand leadership to a voter
+  snapshot                        snapshot the store of the first endpoint
+  backup [-f file]                download a backup archive
+  restore <file|->                restore a backup archive on every node
+  status                          show the status of every endpoint
+
+Run dkvctl <command> -h for the flags of a command.
+
+Exit codes: 0 ok, 1 error, 2 usage, 3 not found, 4 precondition failed,
+5 cluster unavailable, 6 unauthenticated or forbidden.
+
+Global flags:
+`
+
+// usageError is a bad command line. It exits with exitUsage.
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+func usagef(format string, args ...any) error {
+	return usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// cli is the state the commands share.
+type cli struct {
+	client    *client.Client
+	endpoints []string
+	timeout   time.Duration
+	out       *printer
+	stdin     io.Reader
+	stdout    io.Writer
+	stderr    io.Writer
+}
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run parses args, runs the command and returns the exit code.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	global := flag.NewFlagSet("dkvctl", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	global.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		global.PrintDefaults()
+	}
+	endpoints := global.String("endpoints", envOr("DKV_ENDPOINTS", defaultEndpoint),
+		"comma separated base URLs of cluster nodes (env DKV_ENDPOINTS)")
+	token := global.String("token", os.Getenv("DKV_TOKEN"), "API token (env DKV_TOKEN)")
+	output := global.String("o", envOr("DKV_OUTPUT", "table"), "output format, table or json (env DKV_OUTPUT)")
+	timeout := global.Duration("timeout", 15*time.Second, "how long a command may take, retries included")
+	caFile := global.String("cacert", os.Getenv("DKV_CACERT"), "CA file to verify https endpoints with (env DKV_CACERT)")
+	certFile := global.String("cert", os.Getenv("DKV_CERT"), "client certificate file (env DKV_CERT)")
+	keyFile := global.String("key", os.Getenv("DKV_KEY"), "client key file (env DKV_KEY)")
+	if err := global.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if global.NArg() == 0 {
+		global.Usage()
+		return exitUsage
+	}
+
+	out, err := newPrinter(*output, stdout)
+	if err != nil {
+		fmt.Fprintf(stderr, "dkvctl: %s\n", err)
+		return exitUsage
+	}
+	httpClient, err := newHTTPClient(*caFile, *certFile, *keyFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "dkvctl: %s\n", err)
+		return exitError
+	}
+	c := &cli{
+		endpoints: splitEndpoints(*endpoints),
+		timeout:   *timeout,
+		out:       out,
+		stdin:     stdin,
+		stdout:    stdout,
+		stderr:    stderr,
+	}
+	c.client, err = client.New(client.Config{
+		Endpoints:    c.endpoints,
+		Token:        *token,
+		HTTPClient:   httpClient,
+		RetryTimeout: *timeout,
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "dkvctl: %s\n", err)
+		return exitUsage
+	}
+
+	err = c.dispatch(ctx, global.Arg(0), global.Args()[1:])
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintf(stderr, "dkvctl: %s\n", err)
+	}
+	return exitCode(err)
+}
+
+// exitCode maps the error of a command to the exit code of dkvctl.
+func exitCode(err error) int {
+	var usageErr usageError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &usageErr), errors.Is(err, client.InvalidKey), errors.Is(err, client.InvalidEndpoint):
+		return exitUsage
+	case errors.Is(err, client.KeyNotFound):
+		return exitNotFound
+	case errors.Is(err, client.PreconditionFailed), errors.Is(err, client.KeyAlreadyExists):
+		return exitPrecondition
+	case errors.Is(err, client.Unavailable), errors.Is(err, context.DeadlineExceeded):
+		return exitUnavailable
+	case errors.Is(err, client.Unauthenticated), errors.Is(err, client.PermissionDenied):
+		return exitAuth
+	}
+	return exitError
+}
+
+func envOr(name, fallback string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return fallback
+}
+
+func splitEndpoints(endpoints string) []string {
+	var list []string
+	for _, endpoint := range strings.Split(endpoints, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			list = append(list, strings.TrimSuffix(endpoint, "/"))
+		}
+	}
+	return list
+}
+
+// newHTTPClient returns the client for https endpoints, or nil for the
+// default one when no TLS file is set.
+func newHTTPClient(caFile, certFile, keyFile string) (*http.Client, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s holds no PEM certificate", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("-cert and -key go together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tomkaith13/dist-kv-store/internal/clustertest"
+	"github.com/tomkaith13/dist-kv-store/internal/service"
+)
+
+func TestDkvctl(t *testing.T) {
+	ts := clustertest.NewServer(t, service.Config{
+		KeyMaxLen:          100,
+		ValMaxLen:          200,
+		MaxMapSize:         1000,
+		WatchHistory:       16,
+		RaftNodeID:         "1",
+		Debug:              true,
+		AuthEnabled:        true,
+		AuthBootstrapToken: "secret",
+	})
+	t.Setenv("DKV_ENDPOINTS", ts.URL)
+	t.Setenv("DKV_TOKEN", "secret")
+
+	dkvctl := func(stdin string, args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := run(context.Background(), args, strings.NewReader(stdin), &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	tests := []struct {
+		name   string
+		stdin  string
+		args   []string
+		code   int
+		stdout string
+	}{
+		{name: "put", args: []string{"put", "user-1", "a b"}, code: exitOK, stdout: "KEY     REVISION\nuser-1  1\n"},
+		{name: "put from stdin", stdin: "line\n", args: []string{"-o", "json", "put", "-ttl", "1h", "user-2", "-"},
+			code: exitOK, stdout: `{"key":"user-2","revision":2}` + "\n"},
+		{name: "get value", args: []string{"get", "-value", "user-1"}, code: exitOK, stdout: "a b\n"},
+		{name: "get json", args: []string{"-o", "json", "get", "user-2"}, code: exitOK,
+			stdout: `{"key":"user-2","value":"line\n","revision":2}` + "\n"},
+		{name: "create of an existing key", args: []string{"put", "-create", "user-1", "x"}, code: exitPrecondition},
+		{name: "write at a stale revision", args: []string{"put", "-rev", "2", "user-1", "x"}, code: exitPrecondition},
+		{name: "list", args: []string{"list", "-prefix", "user-", "-values"}, code: exitOK,
+			stdout: "KEY     REVISION  VALUE\nuser-1  1         a b\nuser-2  2         line\\n\n"},
+		{name: "list pages", args: []string{"-o", "json", "list", "-limit", "1"}, code: exitOK,
+			stdout: `{"keys":[{"key":"user-1","revision":1}],"next":"dXNlci0x"}` + "\n"},
+		{name: "del", args: []string{"del", "user-1"}, code: exitOK, stdout: "deleted user-1\n"},
+		{name: "get deleted", args: []string{"get", "user-1"}, code: exitNotFound},
+		{name: "del deleted", args: []string{"del", "user-1"}, code: exitNotFound},
+		{name: "watch", args: []string{"-o", "json", "watch", "-prefix", "user-", "-index", "1", "-count", "1"}, code: exitOK,
+			stdout: `{"type":"set","key":"user-2","value":"line\n","index":2}` + "\n"},
+		{name: "snapshot without raft", args: []string{"-timeout", "300ms", "snapshot"}, code: exitUnavailable},
+		{name: "bad token", args: []string{"-token", "wrong", "get", "user-2"}, code: exitAuth},
+		{name: "unknown command", args: []string{"frobnicate"}, code: exitUsage},
+		{name: "missing argument", args: []string{"put", "user-3"}, code: exitUsage},
+		{name: "key with a slash", args: []string{"get", "a/b"}, code: exitUsage},
+		{name: "unknown output", args: []string{"-o", "yaml", "get", "user-2"}, code: exitUsage},
+		{name: "help", args: []string{"get", "-h"}, code: exitOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code, stdout, stderr := dkvctl(tc.stdin, tc.args...)
+			if code != tc.code {
+				t.Fatalf("exit code. Expected: %d, got: %d stderr: %s", tc.code, code, stderr)
+			}
+			if tc.stdout != "" && stdout != tc.stdout {
+				t.Fatalf("output. Expected: %q, got: %q", tc.stdout, stdout)
+			}
+		})
+	}
+
+	// status reports every endpoint, and fails if one does not answer.
+	down := httptest.NewServer(nil)
+	down.Close()
+	code, stdout, _ := dkvctl("", "-endpoints", ts.URL+","+down.URL, "-timeout", "300ms", "-o", "json", "status")
+	if code != exitUnavailable {
+		t.Fatalf("status with a node down. Expected exit code: %d, got: %d", exitUnavailable, code)
+	}
+	var statuses []endpointStatus
+	if err := json.Unmarshal([]byte(stdout), &statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 || statuses[0].Status == nil || statuses[0].Status.ID != "1" ||
+		statuses[0].Status.Keys != 1 || statuses[1].Error == "" {
+		t.Fatalf("unexpected status: %s", stdout)
+	}
+
+	// a backup needs raft, so nothing is left behind when it fails.
+	file := filepath.Join(t.TempDir(), "dkv.backup")
+	if code, _, _ := dkvctl("", "-timeout", "300ms", "backup", "-f", file); code != exitUnavailable {
+		t.Fatalf("backup without raft. Expected exit code: %d, got: %d", exitUnavailable, code)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(file)); len(entries) != 0 {
+		t.Fatalf("failed backup left %d files behind", len(entries))
+	}
+}
@@ -5,9 +5,11 @@ import (
 
 	"github.com/rs/zerolog"
 	"github.com/tomkaith13/dist-kv-store/internal/config"
+	"github.com/tomkaith13/dist-kv-store/internal/metrics"
 	"github.com/tomkaith13/dist-kv-store/internal/router"
 	"github.com/tomkaith13/dist-kv-store/internal/server"
 	"github.com/tomkaith13/dist-kv-store/internal/service"
+	"github.com/tomkaith13/dist-kv-store/internal/tlsconfig"
 )
 
 func main() {
@@ -25,22 +27,37 @@ func main() {
 		zlogger.Fatal().Err(err).Msgf("failed to load env vars. Error:%q", err)
 	}
 
+	// metrics come first so raft reports into the registry from the start.
+	dkvMetrics := metrics.New(zlogger)
+
+	// nodes call each other with the certificates and trust the API is served with.
+	var tlsReloader *tlsconfig.Reloader
+	if config.Server.TLS.Enabled() {
+		tlsReloader, err = tlsconfig.New(zlogger, config.Server.TLS)
+		if err != nil {
+			zlogger.Fatal().Msgf("failed to load TLS files. Error:%q", err)
+		}
+		config.Service.PeerTLS = tlsReloader.ClientConfig("")
+		// the dialer checks each node against the host it is called on.
+		config.Service.PeerDialTLS = tlsReloader.DialTLSContext
+	}
+
 	// init service, router and finally init the server itself.
 	kv_service := service.New(zlogger, config.Service)
+	if err := kv_service.RegisterMetrics(dkvMetrics.Registerer()); err != nil {
+		zlogger.Fatal().Msgf("failed to register store metrics. Error:%q", err)
+	}
 	r := router.New(config.Router, zlogger)
+	r.GetRouter().Use(dkvMetrics.Middleware)
+	r.GetRouter().Use(service.AuthMiddleware(kv_service))
+	r.GetRouter().Method("GET", "/metrics", dkvMetrics.Handler())
 	httpServer := server.New(zlogger, r.GetRouter(), config.Server, kv_service)
+	if tlsReloader != nil {
+		httpServer.UseTLS(tlsReloader)
+	}
 
 	// handler registration to the service
-	// test handler
-	httpServer.AddHandler(server.GET, "/hello", service.HelloHandler)
-
-	// key handlers
-	httpServer.AddHandler(server.GET, "/key/{id}", service.GetHandler)
-	httpServer.AddHandler(server.POST, "/key", service.SetHandler)
-	httpServer.AddHandler(server.DELETE, "/key/{id}", service.DelHandler)
-
-	// handler for followers to register via the leader
-	httpServer.AddHandler(server.POST, "/register-follower", service.RegisterFollowerHandler)
+	service.RegisterHandlers(httpServer)
 
 	httpServer.Run()
 
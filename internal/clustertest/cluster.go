@@ -0,0 +1,417 @@
+// Package clustertest runs clusters of DKVService nodes in one process for
+// tests. Nodes talk over raft's in-memory transport and keep their log and
+// snapshots in memory, so tests can cut the network between them, crash them
+// and bring them back without ports or files. NewServer serves the HTTP API
+// of a single node, for tests of API clients.
+//
+//	c := clustertest.New(t, clustertest.Config{Nodes: 3})
+//	leader := c.WaitForLeader()
+//	c.Partition(leader.ID)
+//	newLeader := c.WaitForLeader(leader.ID)
+//	c.Heal()
+//	c.WaitForConvergence()
+package clustertest
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/service"
+)
+
+// Config configures a Cluster.
+type Config struct {
+	// Nodes is the number of voters, 3 when 0.
+	Nodes int
+	// Service is the config every node starts with. Node IDs, raft addresses,
+	// peers and stores are set by the cluster, and zero limits get the
+	// defaults of the env config.
+	Service service.Config
+	// Timeout bounds the waits of the cluster. 0 uses 10s.
+	Timeout time.Duration
+	// Logger receives the logs of the nodes. They are dropped by default.
+	Logger *zerolog.Logger
+}
+
+// Node is a member of a Cluster. Its stores outlive restarts.
+type Node struct {
+	ID   string
+	Addr raft.ServerAddress
+
+	cluster   *Cluster
+	config    service.Config
+	store     *raft.InmemStore
+	snapshots *raft.InmemSnapshotStore
+
+	// the fields below are guarded by the mutex of the cluster. service and
+	// transport are nil while the node is down.
+	service   *service.DKVService
+	transport *raft.InmemTransport
+	// side is the side of the last Partition the node is on.
+	side int
+}
+
+// Service returns the service of the node, nil while it is down.
+func (n *Node) Service() *service.DKVService {
+	n.cluster.mu.Lock()
+	defer n.cluster.mu.Unlock()
+	return n.service
+}
+
+// Cluster is a set of nodes started with the same static peers. Its methods
+// fail the test with t.Fatalf, so they have to be called from the test
+// goroutine.
+type Cluster struct {
+	t       testing.TB
+	timeout time.Duration
+	logger  zerolog.Logger
+
+	mu    sync.Mutex
+	nodes []*Node
+}
+
+// New starts a cluster, waits for it to elect a leader and shuts it down at
+// the end of the test.
+func New(t testing.TB, config Config) *Cluster {
+	t.Helper()
+	if config.Nodes == 0 {
+		config.Nodes = 3
+	}
+	c := &Cluster{t: t, timeout: config.Timeout, logger: zerolog.New(io.Discard)}
+	if c.timeout == 0 {
+		c.timeout = 10 * time.Second
+	}
+	if config.Logger != nil {
+		c.logger = *config.Logger
+	}
+
+	var peers []string
+	for i := 1; i <= config.Nodes; i++ {
+		node := &Node{
+			ID:        fmt.Sprint(i),
+			Addr:      raft.ServerAddress(fmt.Sprintf("node-%d", i)),
+			cluster:   c,
+			store:     raft.NewInmemStore(),
+			snapshots: raft.NewInmemSnapshotStore(),
+		}
+		peers = append(peers, fmt.Sprintf("%s=%s", node.ID, node.Addr))
+		c.nodes = append(c.nodes, node)
+	}
+	for _, node := range c.nodes {
+		node.config = withDefaults(config.Service)
+		node.config.RaftNodeID = node.ID
+		node.config.RaftAddr = string(node.Addr)
+		node.config.RaftPeers = peers
+		node.config.RaftLeader = false
+		node.config.RaftTimeout = c.timeout
+		node.config.RaftStore = node.store
+		node.config.RaftSnapshotStore = node.snapshots
+		_, node.transport = raft.NewInmemTransport(node.Addr)
+		node.config.RaftTransport = node.transport
+	}
+	c.connect()
+
+	// every node waits for a leader while starting, which takes a quorum.
+	var wg sync.WaitGroup
+	for _, node := range c.nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			svc := service.New(c.logger.With().Str("node", node.ID).Logger(), node.config)
+			c.mu.Lock()
+			node.service = svc
+			c.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	t.Cleanup(c.Shutdown)
+
+	c.WaitForLeader()
+	return c
+}
+
+// withDefaults fills in the limits config left at zero with the defaults of
+// the env config.
+func withDefaults(config service.Config) service.Config {
+	if config.KeyMaxLen == 0 {
+		config.KeyMaxLen = 100
+	}
+	if config.ValMaxLen == 0 {
+		config.ValMaxLen = 200
+	}
+	if config.MaxMapSize == 0 {
+		config.MaxMapSize = 1000
+	}
+	if config.TxnMaxOps == 0 {
+		config.TxnMaxOps = 64
+	}
+	if config.ExpiryInterval == 0 {
+		config.ExpiryInterval = time.Second
+	}
+	if config.RaftPromoteMaxLag == 0 {
+		config.RaftPromoteMaxLag = 64
+	}
+	if config.ReadyMaxLag == 0 {
+		config.ReadyMaxLag = 64
+	}
+	if config.WatchHistory == 0 {
+		config.WatchHistory = 1024
+	}
+	return config
+}
+
+// Nodes returns the nodes of the cluster, in ID order.
+func (c *Cluster) Nodes() []*Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.nodes)
+}
+
+// Node returns the node with the given ID.
+func (c *Cluster) Node(id string) *Node {
+	c.t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, node := range c.nodes {
+		if node.ID == id {
+			return node
+		}
+	}
+	c.t.Fatalf("clustertest: no node %q", id)
+	return nil
+}
+
+// connect wires the transports of the running nodes that are on the same
+// side of the last partition, and cuts all other links.
+func (c *Cluster) connect() {
+	for _, from := range c.nodes {
+		if from.transport == nil {
+			continue
+		}
+		for _, to := range c.nodes {
+			if to == from {
+				continue
+			}
+			if to.transport != nil && to.side == from.side {
+				from.transport.Connect(to.Addr, to.transport)
+			} else {
+				from.transport.Disconnect(to.Addr)
+			}
+		}
+	}
+}
+
+// Partition cuts the nodes ids off from the rest of the cluster. They can
+// still reach each other. A new partition replaces the previous one.
+func (c *Cluster) Partition(ids ...string) {
+	c.t.Helper()
+	for _, id := range ids {
+		c.Node(id)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, node := range c.nodes {
+		node.side = 0
+		if slices.Contains(ids, node.ID) {
+			node.side = 1
+		}
+	}
+	c.connect()
+}
+
+// Heal reconnects every running node to every other.
+func (c *Cluster) Heal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, node := range c.nodes {
+		node.side = 0
+	}
+	c.connect()
+}
+
+// Kill stops the node id the way a crash would: without handing over its
+// leadership and with nothing but its raft log and snapshots kept.
+func (c *Cluster) Kill(id string) {
+	c.t.Helper()
+	node := c.Node(id)
+	c.mu.Lock()
+	svc := node.service
+	node.service = nil
+	if node.transport != nil {
+		node.transport = nil
+		c.connect()
+	}
+	c.mu.Unlock()
+	if svc == nil {
+		c.t.Fatalf("clustertest: node %s is already down", id)
+	}
+	if err := svc.Close(); err != nil {
+		c.t.Fatalf("clustertest: killing node %s: %s", id, err)
+	}
+}
+
+// Restart starts the killed node id again from its raft log and snapshots.
+// It rejoins on its own, on its side of the current partition.
+func (c *Cluster) Restart(id string) {
+	c.t.Helper()
+	node := c.Node(id)
+	c.mu.Lock()
+	if node.service != nil {
+		c.mu.Unlock()
+		c.t.Fatalf("clustertest: node %s is still running", id)
+	}
+	_, node.transport = raft.NewInmemTransport(node.Addr)
+	node.config.RaftTransport = node.transport
+	c.connect()
+	config := node.config
+	c.mu.Unlock()
+
+	svc := service.New(c.logger.With().Str("node", node.ID).Logger(), config)
+	c.mu.Lock()
+	node.service = svc
+	c.mu.Unlock()
+}
+
+// Shutdown stops every running node. It is registered as a cleanup by New.
+func (c *Cluster) Shutdown() {
+	for _, node := range c.Nodes() {
+		c.mu.Lock()
+		svc := node.service
+		node.service = nil
+		c.mu.Unlock()
+		if svc != nil {
+			svc.Close()
+		}
+	}
+}
+
+// Leader returns the node that is leader, nil if there is none. Nodes of an
+// old term that still think they lead are not counted.
+func (c *Cluster) Leader() *Node {
+	var leader *Node
+	var leaderTerm uint64
+	for _, node := range c.Nodes() {
+		svc := node.Service()
+		if svc == nil {
+			continue
+		}
+		st := svc.Status()
+		if st.State == raft.Leader.String() && st.Term >= leaderTerm {
+			leader, leaderTerm = node, st.Term
+		}
+	}
+	return leader
+}
+
+// WaitForLeader waits until a node other than the excluded ones leads a
+// term that a majority of the cluster agrees on, and returns it.
+func (c *Cluster) WaitForLeader(exclude ...string) *Node {
+	c.t.Helper()
+	var leader *Node
+	err := c.waitFor(func() error {
+		leader = c.Leader()
+		if leader == nil {
+			return fmt.Errorf("no leader")
+		}
+		if slices.Contains(exclude, leader.ID) {
+			return fmt.Errorf("node %s still leads", leader.ID)
+		}
+		leaderTerm := leader.Service().Status().Term
+		agree := 0
+		for _, node := range c.Nodes() {
+			if svc := node.Service(); svc != nil {
+				st := svc.Status()
+				if st.Term == leaderTerm && st.LeaderID == leader.ID {
+					agree++
+				}
+			}
+		}
+		if agree <= len(c.Nodes())/2 {
+			return fmt.Errorf("only %d nodes follow node %s", agree, leader.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		c.t.Fatalf("clustertest: no leader elected: %s", err)
+	}
+	return leader
+}
+
+// Data returns the keys, values and revisions held by the FSM of a running
+// node.
+func Data(svc *service.DKVService) (map[string]service.Entry, error) {
+	data := make(map[string]service.Entry)
+	opts := service.ListOptions{Values: true}
+	for {
+		page, err := svc.List(opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range page.Keys {
+			data[key.Key] = service.Entry{Val: key.Val, Revision: key.Revision}
+		}
+		if page.Next == "" {
+			return data, nil
+		}
+		opts.Continue = page.Next
+	}
+}
+
+// WaitForConvergence waits until every running node has applied the same
+// log and holds the same data, and returns that data.
+func (c *Cluster) WaitForConvergence() map[string]service.Entry {
+	c.t.Helper()
+	var data map[string]service.Entry
+	err := c.waitFor(func() error {
+		data = nil
+		var first *Node
+		var applied uint64
+		for _, node := range c.Nodes() {
+			svc := node.Service()
+			if svc == nil {
+				continue
+			}
+			nodeData, err := Data(svc)
+			if err != nil {
+				return err
+			}
+			nodeApplied := svc.LastAppliedIndex()
+			if first == nil {
+				first, data, applied = node, nodeData, nodeApplied
+				continue
+			}
+			if nodeApplied != applied {
+				return fmt.Errorf("node %s applied index %d, node %s %d", first.ID, applied, node.ID, nodeApplied)
+			}
+			if !maps.Equal(nodeData, data) {
+				return fmt.Errorf("nodes %s and %s applied index %d but hold different data:\n%v\n%v",
+					first.ID, node.ID, applied, data, nodeData)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.t.Fatalf("clustertest: nodes did not converge: %s", err)
+	}
+	return data
+}
+
+// waitFor polls check until it passes or the cluster timeout runs out, and
+// returns its last error.
+func (c *Cluster) waitFor(check func() error) error {
+	deadline := time.Now().Add(c.timeout)
+	for {
+		err := check()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
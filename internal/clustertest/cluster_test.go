@@ -0,0 +1,79 @@
+package clustertest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tomkaith13/dist-kv-store/internal/service"
+)
+
+func TestPartitionedLeaderIsReplaced(t *testing.T) {
+	c := New(t, Config{Nodes: 3})
+	leader := c.WaitForLeader()
+	if _, err := leader.Service().Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitForConvergence()
+
+	// the old leader is cut off, the majority elects another one.
+	c.Partition(leader.ID)
+	newLeader := c.WaitForLeader(leader.ID)
+	if _, err := newLeader.Service().Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leader.Service().Get("b"); !errors.Is(err, service.KeyNotFound) {
+		t.Fatalf("write reached the partitioned node. Expected KeyNotFound, got: %v", err)
+	}
+	if _, err := newLeader.Service().GetWithConsistency("a", service.ConsistencyLinearizable); err != nil {
+		t.Fatalf("linearizable read on the majority: %v", err)
+	}
+
+	// once healed, the old leader steps down and catches up.
+	c.Heal()
+	if got := c.WaitForLeader(leader.ID); got.ID != newLeader.ID {
+		t.Fatalf("leadership moved again after healing. Expected node %s, got node %s", newLeader.ID, got.ID)
+	}
+	data := c.WaitForConvergence()
+	if data["a"].Val != "1" || data["b"].Val != "2" {
+		t.Fatalf("unexpected data after healing: %v", data)
+	}
+}
+
+func TestKilledNodesRestartFromTheirLog(t *testing.T) {
+	c := New(t, Config{Nodes: 3})
+	leader := c.WaitForLeader()
+
+	var follower *Node
+	for _, node := range c.Nodes() {
+		if node != leader {
+			follower = node
+			break
+		}
+	}
+	c.Kill(follower.ID)
+	if _, err := leader.Service().Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leader.Service().TakeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leader.Service().Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the follower gets the snapshot and the entries after it.
+	c.Restart(follower.ID)
+	c.WaitForConvergence()
+
+	// a crashed leader does not hand over, the others elect a new one.
+	c.Kill(leader.ID)
+	newLeader := c.WaitForLeader(leader.ID)
+	if _, err := newLeader.Service().Set("c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	c.Restart(leader.ID)
+	data := c.WaitForConvergence()
+	if len(data) != 3 || data["a"].Val != "1" || data["b"].Val != "2" || data["c"].Val != "3" {
+		t.Fatalf("unexpected data after restarts: %v", data)
+	}
+}
@@ -0,0 +1,372 @@
+package clustertest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anishathalye/porcupine"
+	"github.com/hashicorp/raft"
+	"github.com/tomkaith13/dist-kv-store/internal/service"
+)
+
+// The histories are checked against a register per key: gets return the last
+// value put, deletes remove it.
+
+type kvOp int
+
+const (
+	opGet kvOp = iota
+	opPut
+	opDel
+)
+
+type kvInput struct {
+	Op    kvOp
+	Key   string
+	Value string
+}
+
+type kvOutput struct {
+	Value string
+	Found bool
+	// Unknown marks a write that may or may not have been committed, e.g. one
+	// that was in flight when its leader crashed.
+	Unknown bool
+}
+
+type register struct {
+	Value  string
+	Exists bool
+}
+
+var kvModel = porcupine.Model{
+	Partition: func(history []porcupine.Operation) [][]porcupine.Operation {
+		byKey := make(map[string][]porcupine.Operation)
+		var keys []string
+		for _, op := range history {
+			key := op.Input.(kvInput).Key
+			if _, ok := byKey[key]; !ok {
+				keys = append(keys, key)
+			}
+			byKey[key] = append(byKey[key], op)
+		}
+		partitions := make([][]porcupine.Operation, 0, len(keys))
+		for _, key := range keys {
+			partitions = append(partitions, byKey[key])
+		}
+		return partitions
+	},
+	Init: func() interface{} {
+		return register{}
+	},
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		st, in, out := state.(register), input.(kvInput), output.(kvOutput)
+		switch in.Op {
+		case opGet:
+			return out.Found == st.Exists && out.Value == st.Value, st
+		case opPut:
+			return true, register{Value: in.Value, Exists: true}
+		default:
+			// a delete of a missing key fails, but leaves the key missing too.
+			return out.Unknown || out.Found == st.Exists, register{}
+		}
+	},
+	DescribeOperation: func(input, output interface{}) string {
+		in, out := input.(kvInput), output.(kvOutput)
+		result := "missing"
+		switch {
+		case out.Unknown:
+			result = "unknown"
+		case in.Op == opPut:
+			result = "ok"
+		case in.Op == opDel && out.Found:
+			result = "ok"
+		case out.Found:
+			result = fmt.Sprintf("%q", out.Value)
+		}
+		switch in.Op {
+		case opGet:
+			return fmt.Sprintf("get(%s) -> %s", in.Key, result)
+		case opPut:
+			return fmt.Sprintf("put(%s, %q) -> %s", in.Key, in.Value, result)
+		default:
+			return fmt.Sprintf("del(%s) -> %s", in.Key, result)
+		}
+	},
+	DescribeState: func(state interface{}) string {
+		if st := state.(register); st.Exists {
+			return fmt.Sprintf("%q", st.Value)
+		}
+		return "<missing>"
+	},
+}
+
+// history records the operations of concurrent clients.
+type history struct {
+	start time.Time
+
+	mu  sync.Mutex
+	ops []porcupine.Operation
+	// unknown are the indexes of ops whose outcome is not known.
+	unknown []int
+}
+
+func (h *history) now() int64 {
+	return time.Since(h.start).Nanoseconds()
+}
+
+func (h *history) add(op porcupine.Operation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if op.Output.(kvOutput).Unknown {
+		h.unknown = append(h.unknown, len(h.ops))
+	}
+	h.ops = append(h.ops, op)
+}
+
+// close returns the history, with the writes of unknown outcome open until
+// its end: they may have taken effect at any time after they were called.
+func (h *history) close() []porcupine.Operation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	end := h.now()
+	for _, i := range h.unknown {
+		h.ops[i].Return = end
+	}
+	return h.ops
+}
+
+// notApplied tells whether err proves a write was never proposed, as
+// opposed to errors raised after it may have been committed.
+func notApplied(err error) bool {
+	return errors.Is(err, service.NotLeader) || errors.Is(err, service.LeaderNotReady) ||
+		errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrEnqueueTimeout)
+}
+
+// runClient sends random operations on keys to the cluster until stop is
+// closed. Reads are linearizable, which is what the history is checked for.
+func runClient(c *Cluster, h *history, id int, keys []string, stop <-chan struct{}) {
+	rnd := rand.New(rand.NewSource(int64(id)))
+	for seq := 0; ; seq++ {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		time.Sleep(time.Duration(rnd.Intn(5)) * time.Millisecond)
+
+		// most operations go to the leader, the others find out they cannot
+		// be served where they landed.
+		node := c.Leader()
+		if nodes := c.Nodes(); node == nil || rnd.Intn(5) == 0 {
+			node = nodes[rnd.Intn(len(nodes))]
+		}
+		svc := node.Service()
+		if svc == nil {
+			continue
+		}
+
+		in := kvInput{Key: keys[rnd.Intn(len(keys))]}
+		switch r := rnd.Intn(10); {
+		case r < 5:
+			in.Op = opGet
+		case r < 9:
+			in.Op, in.Value = opPut, fmt.Sprintf("%d-%d", id, seq)
+		default:
+			in.Op = opDel
+		}
+
+		call := h.now()
+		var out kvOutput
+		var err error
+		switch in.Op {
+		case opGet:
+			var entry service.Entry
+			entry, err = svc.GetWithConsistency(in.Key, service.ConsistencyLinearizable)
+			out = kvOutput{Value: entry.Val, Found: err == nil}
+		case opPut:
+			_, _, err = svc.Put(in.Key, in.Value, service.WriteUpsert, 0)
+			out = kvOutput{Found: true}
+		case opDel:
+			_, err = svc.Delete(in.Key)
+			out = kvOutput{Found: err == nil}
+		}
+		ret := h.now()
+
+		switch {
+		case err == nil, errors.Is(err, service.KeyNotFound):
+		case in.Op == opGet, notApplied(err):
+			// failed reads change nothing, and neither do writes that were
+			// never proposed.
+			continue
+		default:
+			out = kvOutput{Unknown: true}
+		}
+		h.add(porcupine.Operation{ClientId: id, Input: in, Call: call, Output: out, Return: ret})
+	}
+}
+
+// checkLinearizable fails the test if ops are not linearizable, and writes a
+// visualization of the longest linearizable prefixes it found.
+func checkLinearizable(t *testing.T, ops []porcupine.Operation) {
+	t.Helper()
+	result, info := porcupine.CheckOperationsVerbose(kvModel, ops, time.Minute)
+	switch result {
+	case porcupine.Ok:
+		return
+	case porcupine.Unknown:
+		t.Logf("linearizability check of %d operations timed out, the history is neither proven right nor wrong", len(ops))
+		return
+	}
+
+	dir := os.Getenv("DKV_LINEARIZABILITY_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	f, err := os.CreateTemp(dir, "dkv-linearizability-*.html")
+	if err != nil {
+		t.Fatalf("history of %d operations is not linearizable, and its visualization could not be written: %s", len(ops), err)
+	}
+	defer f.Close()
+	if err := porcupine.Visualize(kvModel, info, f); err != nil {
+		t.Fatalf("history of %d operations is not linearizable, and its visualization could not be written: %s", len(ops), err)
+	}
+	t.Fatalf("history of %d operations is not linearizable. Open %s to see where it goes wrong", len(ops), f.Name())
+}
+
+// TestLinearizability runs concurrent clients against a cluster while its
+// leaders crash and get partitioned away, and checks that the history they
+// saw is linearizable.
+func TestLinearizability(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a cluster through crashes and partitions")
+	}
+	c := New(t, Config{Nodes: 3})
+	h := &history{start: time.Now()}
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for id := 0; id < 4; id++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runClient(c, h, id, keys, stop)
+		}()
+	}
+
+	// the nemesis runs on the test goroutine, as the cluster methods fail the
+	// test from there.
+	faults := 0
+	for round := 0; round < 4; round++ {
+		time.Sleep(500 * time.Millisecond)
+		leader := c.WaitForLeader()
+		if round%2 == 0 {
+			c.Kill(leader.ID)
+			c.WaitForLeader(leader.ID)
+			time.Sleep(500 * time.Millisecond)
+			c.Restart(leader.ID)
+		} else {
+			c.Partition(leader.ID)
+			c.WaitForLeader(leader.ID)
+			time.Sleep(500 * time.Millisecond)
+			c.Heal()
+		}
+		faults++
+	}
+	c.WaitForLeader()
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	ops := h.close()
+	t.Logf("checking %d operations, %d of unknown outcome, across %d faults", len(ops), len(h.unknown), faults)
+	if len(ops) < 100 {
+		t.Fatalf("only %d operations completed, the cluster hardly served the clients", len(ops))
+	}
+	checkLinearizable(t, ops)
+	c.WaitForConvergence()
+}
+
+// TestKVModel makes sure the model rejects what a broken store would do, so
+// a passing TestLinearizability means something.
+func TestKVModel(t *testing.T) {
+	op := func(client int, call, ret int64, in kvInput, out kvOutput) porcupine.Operation {
+		return porcupine.Operation{ClientId: client, Input: in, Call: call, Output: out, Return: ret}
+	}
+	put := kvInput{Op: opPut, Key: "a", Value: "1"}
+	get := kvInput{Op: opGet, Key: "a"}
+
+	tests := []struct {
+		name    string
+		history []porcupine.Operation
+		ok      bool
+	}{
+		{
+			name: "read after write",
+			history: []porcupine.Operation{
+				op(0, 0, 10, put, kvOutput{Found: true}),
+				op(1, 20, 30, get, kvOutput{Value: "1", Found: true}),
+			},
+			ok: true,
+		},
+		{
+			name: "stale read after write",
+			history: []porcupine.Operation{
+				op(0, 0, 10, put, kvOutput{Found: true}),
+				op(1, 20, 30, get, kvOutput{}),
+			},
+		},
+		{
+			name: "concurrent read sees either",
+			history: []porcupine.Operation{
+				op(0, 0, 10, put, kvOutput{Found: true}),
+				op(1, 5, 15, get, kvOutput{}),
+			},
+			ok: true,
+		},
+		{
+			name: "write of unknown outcome may not have happened",
+			history: []porcupine.Operation{
+				op(0, 0, 100, put, kvOutput{Unknown: true}),
+				op(1, 20, 30, get, kvOutput{}),
+				op(1, 40, 50, get, kvOutput{Value: "1", Found: true}),
+			},
+			ok: true,
+		},
+		{
+			name: "value read back after it was deleted",
+			history: []porcupine.Operation{
+				op(0, 0, 10, put, kvOutput{Found: true}),
+				op(0, 20, 30, kvInput{Op: opDel, Key: "a"}, kvOutput{Found: true}),
+				op(1, 40, 50, get, kvOutput{Value: "1", Found: true}),
+			},
+		},
+		{
+			name: "delete of a missing key",
+			history: []porcupine.Operation{
+				op(0, 0, 10, kvInput{Op: opDel, Key: "a"}, kvOutput{Found: true}),
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := porcupine.CheckOperations(kvModel, tc.history); got != tc.ok {
+				t.Fatalf("expected linearizable: %t, got: %t", tc.ok, got)
+			}
+		})
+	}
+
+	// a failing check can be visualized.
+	_, info := porcupine.CheckOperationsVerbose(kvModel, tests[1].history, 0)
+	path := filepath.Join(t.TempDir(), "history.html")
+	if err := porcupine.VisualizePath(kvModel, info, path); err != nil {
+		t.Fatal(err)
+	}
+}
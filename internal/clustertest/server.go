@@ -0,0 +1,32 @@
+package clustertest
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/router"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+	"github.com/tomkaith13/dist-kv-store/internal/service"
+)
+
+// NewServer serves the API of a single node started from config, routed and
+// authenticated the way cmd does it, until the test ends. Unlike the nodes of
+// a Cluster, a node with raft enabled uses the real transport and store set
+// in config.
+func NewServer(t testing.TB, config service.Config) *httptest.Server {
+	t.Helper()
+	zlogger := zerolog.New(io.Discard)
+	kv_service := service.New(zlogger, config)
+	t.Cleanup(func() { kv_service.Close() })
+	r := router.New(router.Config{RequestTimeout: 60 * time.Second}, zlogger)
+	r.GetRouter().Use(service.AuthMiddleware(kv_service))
+	httpServer := server.New(zlogger, r.GetRouter(), server.Config{Address: "localhost:9999"}, kv_service)
+	service.RegisterHandlers(httpServer)
+
+	ts := httptest.NewServer(r.GetRouter())
+	t.Cleanup(ts.Close)
+	return ts
+}
@@ -20,5 +20,13 @@ type Config struct {
 func LoadFromEnv() (*Config, error) {
 	cfg := &Config{}
 	err := envconfig.Process("", cfg)
-	return cfg, err
+	if err != nil {
+		return cfg, err
+	}
+
+	// Unless told otherwise, peers reach this node's HTTP API on the address it listens on.
+	if cfg.Service.HTTPAddr == "" {
+		cfg.Service.HTTPAddr = cfg.Server.Address
+	}
+	return cfg, nil
 }
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	gometrics "github.com/armon/go-metrics"
+	gometricsprom "github.com/armon/go-metrics/prometheus"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+)
+
+// raftMetricsExpiration drops raft metrics that were not updated for a while,
+// e.g. the leader-only ones after losing leadership.
+const raftMetricsExpiration = time.Minute
+
+// Metrics owns the Prometheus registry served on /metrics along with the
+// per-route HTTP request metrics.
+type Metrics struct {
+	logger   zerolog.Logger
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+// New creates the registry and bridges the go-metrics data hashicorp/raft
+// emits (apply, commit, snapshot timings...) into it. There is a single
+// go-metrics global, so raft metrics always land in the registry of the last
+// Metrics created.
+func New(logger zerolog.Logger) *Metrics {
+	m := &Metrics{
+		logger:   logger,
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dkv_http_requests_total",
+			Help: "HTTP requests handled, by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dkv_http_request_duration_seconds",
+			Help:    "HTTP request latency, by route and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.latency,
+	)
+
+	sink, err := gometricsprom.NewPrometheusSinkFrom(gometricsprom.PrometheusOpts{
+		Expiration: raftMetricsExpiration,
+		Registerer: m.registry,
+	})
+	if err != nil {
+		logger.Error().Msgf("Unable to bridge raft metrics to prometheus. Error: %s", err)
+		return m
+	}
+	conf := gometrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	if _, err := gometrics.NewGlobal(conf, sink); err != nil {
+		logger.Error().Msgf("Unable to install the raft metrics sink. Error: %s", err)
+	}
+	return m
+}
+
+// Registerer is where other components register their collectors.
+func (m *Metrics) Registerer() prometheus.Registerer {
+	return m.registry
+}
+
+// Handler serves the registry in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware records the count and latency of every request under its chi
+// route pattern, so /key/{id} is one series no matter the key.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		m.requests.WithLabelValues(route, r.Method, strconv.Itoa(code)).Inc()
+		m.latency.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
@@ -2,6 +2,7 @@ package router
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"time"
 
@@ -69,6 +70,12 @@ func globalTimeoutMiddleware(timeout time.Duration, logger zerolog.Logger) func(
 			case <-finished:
 				// Request finished normally
 			case <-ctx.Done():
+				if errors.Is(ctx.Err(), context.Canceled) {
+					// The client went away. There is nobody to answer, so let
+					// the handler wind down instead of racing its writes.
+					<-finished
+					return
+				}
 				// Timeout exceeded
 				logger.Info().Msg("Request timed out! Check .env file for the value")
 				http.Error(w, ctx.Err().Error(), http.StatusGatewayTimeout)
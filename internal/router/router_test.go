@@ -0,0 +1,67 @@
+package router
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	r := New(Config{RequestTimeout: 100 * time.Millisecond}, zerolog.New(io.Discard))
+	r.GetRouter().Get("/slow", func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	})
+	r.GetRouter().Get("/fast", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	req, err := http.NewRequest("GET", "/slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	r.GetRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Fatalf("slow handler. Expected: %d, got: %d", http.StatusGatewayTimeout, rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/fast", nil)
+	rr = httptest.NewRecorder()
+	r.GetRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "ok" {
+		t.Fatalf("fast handler. Expected: %d ok, got: %d %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+}
+
+func TestRequestCancelledByClient(t *testing.T) {
+	r := New(Config{RequestTimeout: time.Minute}, zerolog.New(io.Discard))
+	var finished atomic.Bool
+	r.GetRouter().Get("/slow", func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+		// the handler winds down on its own, nothing answers in its place.
+		time.Sleep(50 * time.Millisecond)
+		finished.Store(true)
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", "/slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	rr := httptest.NewRecorder()
+	r.GetRouter().ServeHTTP(rr, req)
+	if !finished.Load() {
+		t.Fatal("request returned before its handler finished")
+	}
+	if rr.Code != http.StatusTeapot {
+		t.Fatalf("cancelled request. Expected the handler's %d, got: %d", http.StatusTeapot, rr.Code)
+	}
+}
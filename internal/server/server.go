@@ -11,11 +11,13 @@ import (
 
 	"github.com/go-chi/chi"
 	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/tlsconfig"
 )
 
 const (
 	GET    = "GET"
 	POST   = "POST"
+	PUT    = "PUT"
 	DELETE = "DEL"
 )
 
@@ -23,6 +25,7 @@ type Server struct {
 	logger zerolog.Logger
 	router *chi.Mux
 	config Config
+	tls    *tlsconfig.Reloader
 
 	store DKVStore
 }
@@ -30,11 +33,17 @@ type DKVStore interface {
 	Get(key string) (string, error)
 	Set(key string, val string) (string, error)
 	Delete(key string) (string, error)
-	RegisterFollower(followerId, followerAddr string) error
+	CompareAndSwap(key string, val string, revision uint64) (uint64, error)
+	CompareAndDelete(key string, revision uint64) error
+	RegisterFollower(followerId, followerAddr, followerHTTPAddr, role string) error
+	// Shutdown hands off leadership if needed and stops the store.
+	Shutdown() error
 }
 type Config struct {
 	Address         string        `envconfig:"ADDRESS"`
 	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"5s"`
+	// TLS serves the API over HTTPS when a certificate is configured.
+	TLS tlsconfig.Config `envconfig:"TLS"`
 }
 
 func New(logger zerolog.Logger, router *chi.Mux, config Config, store DKVStore) *Server {
@@ -48,6 +57,12 @@ func New(logger zerolog.Logger, router *chi.Mux, config Config, store DKVStore)
 	return s
 }
 
+// UseTLS makes Run serve HTTPS with the certificates of reloader, picking up
+// rotated files while running.
+func (s *Server) UseTLS(reloader *tlsconfig.Reloader) {
+	s.tls = reloader
+}
+
 func (s *Server) AddHandler(method string, route string, handlerFunc func(s *Server, w http.ResponseWriter, r *http.Request)) {
 	s.logger.Info().Msgf("Registering Method: %s Route: %s", method, route)
 
@@ -59,10 +74,12 @@ func (s *Server) AddHandler(method string, route string, handlerFunc func(s *Ser
 		s.router.Get(route, wrappedHandler)
 	case POST:
 		s.router.Post(route, wrappedHandler)
+	case PUT:
+		s.router.Put(route, wrappedHandler)
 	case DELETE:
 		s.router.Delete(route, wrappedHandler)
 	default:
-		s.logger.Fatal().Msg("Any other methods than GET, POST and DELETE are not allowed")
+		s.logger.Fatal().Msg("Any other methods than GET, POST, PUT and DELETE are not allowed")
 		return
 	}
 }
@@ -84,6 +101,16 @@ func (s *Server) Run() error {
 	}
 
 	go func() {
+		if s.tls != nil {
+			watchCtx, stopWatch := context.WithCancel(context.Background())
+			defer stopWatch()
+			go s.tls.Watch(watchCtx)
+
+			api.TLSConfig = s.tls.ServerConfig()
+			s.logger.Info().Msg("server listening with TLS on " + s.config.Address)
+			serverErrors <- api.ListenAndServeTLS("", "")
+			return
+		}
 		s.logger.Info().Msg("server listening on " + s.config.Address)
 		serverErrors <- api.ListenAndServe()
 	}()
@@ -96,8 +123,14 @@ func (s *Server) Run() error {
 		ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
 		defer cancel()
 
-		if err := api.Shutdown(ctx); err != nil {
+		err := api.Shutdown(ctx)
+		if err != nil {
 			_ = api.Close()
+		}
+		if storeErr := s.store.Shutdown(); storeErr != nil {
+			s.logger.Error().Msgf("store failed to shutdown cleanly: %s", storeErr)
+		}
+		if err != nil {
 			return fmt.Errorf("server failed to shutdown gracefully: %w", err)
 		}
 	}
@@ -0,0 +1,471 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+// Authentication and authorization.
+//
+// With AuthEnabled every request but the probes and /metrics carries an API
+// token as "Authorization: Bearer <token>". A token holds roles, and a role
+// grants read and write on key prefixes, or admin rights on the whole node.
+// Roles and tokens are replicated through raft like the kv entries, so every
+// node enforces the same policy. Only the SHA-256 of a token is stored.
+//
+// The bootstrap token from AUTH_BOOTSTRAP_TOKEN is an admin token every node
+// accepts without it being stored. Nodes also present it to each other, to
+// register followers and to read each other's status.
+
+const (
+	// tokenPrefix starts every generated token, which makes them easy to spot.
+	tokenPrefix = "dkv_"
+	// bootstrapPrincipal is the name the bootstrap token authenticates as.
+	bootstrapPrincipal = "bootstrap"
+)
+
+var (
+	Unauthenticated     error = errors.New("missing or unknown API token")
+	PermissionDenied    error = errors.New("token is not allowed to do this")
+	InvalidAuthRole     error = errors.New("invalid auth role")
+	InvalidTokenRequest error = errors.New("invalid token request")
+	AuthRoleNotFound    error = errors.New("auth role not found")
+	TokenNotFound       error = errors.New("token not found")
+)
+
+// Access is what a request does with a key.
+type Access int
+
+const (
+	AccessRead Access = iota
+	AccessWrite
+)
+
+// ACLRule grants read and/or write on every key starting with Prefix. An
+// empty Prefix covers all keys.
+type ACLRule struct {
+	Prefix string `json:"prefix"`
+	Read   bool   `json:"read"`
+	Write  bool   `json:"write"`
+}
+
+// AuthRole is a named set of ACL rules. An admin role may do everything,
+// including calling the /cluster, /admin, /auth and /register-follower routes.
+type AuthRole struct {
+	Name  string    `json:"name"`
+	Admin bool      `json:"admin"`
+	Rules []ACLRule `json:"rules"`
+}
+
+func (role AuthRole) validate() error {
+	if role.Name == "" {
+		return fmt.Errorf("%w: name is required", InvalidAuthRole)
+	}
+	for _, rule := range role.Rules {
+		if !rule.Read && !rule.Write {
+			return fmt.Errorf("%w: rule for prefix %q grants nothing", InvalidAuthRole, rule.Prefix)
+		}
+	}
+	return nil
+}
+
+// APIToken is the stored form of a token. The secret itself is only known to
+// whoever created it.
+type APIToken struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// principal is who a request authenticated as.
+type principal struct {
+	name  string
+	admin bool
+	rules []ACLRule
+}
+
+// allows reports whether p may access every key starting with target. For a
+// single key the key itself is the target.
+func (p *principal) allows(target string, access Access) bool {
+	if p.admin {
+		return true
+	}
+	for _, rule := range p.rules {
+		if !strings.HasPrefix(target, rule.Prefix) {
+			continue
+		}
+		if (access == AccessRead && rule.Read) || (access == AccessWrite && rule.Write) {
+			return true
+		}
+	}
+	return false
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate resolves secret to the principal it stands for.
+func (s *DKVService) authenticate(secret string) (*principal, bool) {
+	bootstrap := s.ServiceConfig.AuthBootstrapToken
+	if bootstrap != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(bootstrap)) == 1 {
+		return &principal{name: bootstrapPrincipal, admin: true}, true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[hashToken(secret)]
+	if !ok {
+		return nil, false
+	}
+	p := &principal{name: token.Name}
+	// roles deleted since the token was created simply grant nothing.
+	for _, name := range token.Roles {
+		role, ok := s.roles[name]
+		if !ok {
+			continue
+		}
+		p.admin = p.admin || role.Admin
+		p.rules = append(p.rules, role.Rules...)
+	}
+	return p, true
+}
+
+type principalKey struct{}
+
+func principalFrom(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// routeScope tells whether path is open to everyone, or only to admins.
+func routeScope(path string) (public bool, admin bool) {
+	switch path {
+	case "/healthz", "/readyz", "/metrics":
+		return true, false
+	case "/register-follower":
+		return false, true
+	}
+	for _, prefix := range []string{"/cluster/", "/admin/", "/auth/"} {
+		if strings.HasPrefix(path, prefix) {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// AuthMiddleware authenticates every request and keeps non-admin tokens out
+// of the admin routes. Per-key checks are left to the handlers, which know
+// the keys a request touches. It does nothing unless AuthEnabled is set.
+func AuthMiddleware(s *DKVService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.ServiceConfig.AuthEnabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			public, admin := routeScope(r.URL.Path)
+			if public {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			secret, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			p, ok := s.authenticate(secret)
+			if !found || !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="dkv"`)
+				http.Error(w, Unauthenticated.Error(), http.StatusUnauthorized)
+				return
+			}
+			if admin && !p.admin {
+				s.logger.Info().Msgf("Token %s refused on admin route %s %s", p.name, r.Method, r.URL.Path)
+				http.Error(w, PermissionDenied.Error(), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+		})
+	}
+}
+
+// Authorize checks that the token of r may access every one of targets. A
+// target is a key, or a prefix when a request reads a range of keys. It
+// always passes unless AuthEnabled is set.
+func (s *DKVService) Authorize(r *http.Request, access Access, targets ...string) error {
+	if !s.ServiceConfig.AuthEnabled {
+		return nil
+	}
+	p := principalFrom(r.Context())
+	if p == nil {
+		return PermissionDenied
+	}
+	for _, target := range targets {
+		if !p.allows(target, access) {
+			verb := "read"
+			if access == AccessWrite {
+				verb = "write"
+			}
+			return fmt.Errorf("%w. Token %s cannot %s %q", PermissionDenied, p.name, verb, target)
+		}
+	}
+	return nil
+}
+
+// SetAuthRole creates or replaces a role.
+func (s *DKVService) SetAuthRole(role AuthRole) error {
+	if err := role.validate(); err != nil {
+		return err
+	}
+	val, err := json.Marshal(role)
+	if err != nil {
+		return err
+	}
+	_, err = s.propose(command{Op: opSetRole, Key: role.Name, Val: string(val)})
+	return err
+}
+
+// DeleteAuthRole removes a role. Tokens holding it lose its grants.
+func (s *DKVService) DeleteAuthRole(name string) error {
+	_, err := s.propose(command{Op: opDelRole, Key: name})
+	return err
+}
+
+// CreateToken issues a new token named name with roles and returns its
+// secret. A token of the same name is replaced, which is how tokens are
+// rotated.
+func (s *DKVService) CreateToken(name string, roles []string) (string, error) {
+	if name == "" || len(roles) == 0 {
+		return "", fmt.Errorf("%w: name and roles are required", InvalidTokenRequest)
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	val, err := json.Marshal(APIToken{Name: name, Roles: roles})
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.propose(command{Op: opSetToken, Key: hashToken(secret), Val: string(val)}); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// DeleteToken revokes the token named name.
+func (s *DKVService) DeleteToken(name string) error {
+	_, err := s.propose(command{Op: opDelToken, Key: name})
+	return err
+}
+
+// AuthRoles lists the roles sorted by name.
+func (s *DKVService) AuthRoles() []AuthRole {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	roles := make([]AuthRole, 0, len(s.roles))
+	for _, name := range slices.Sorted(maps.Keys(s.roles)) {
+		roles = append(roles, s.roles[name])
+	}
+	return roles
+}
+
+// Tokens lists the tokens sorted by name.
+func (s *DKVService) Tokens() []APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := slices.Collect(maps.Values(s.tokens))
+	slices.SortFunc(tokens, func(a, b APIToken) int { return strings.Compare(a.Name, b.Name) })
+	return tokens
+}
+
+// applyAuthLocked applies the role and token commands. s.mu is held.
+func (s *DKVService) applyAuthLocked(cmd command) any {
+	switch cmd.Op {
+	case opSetRole:
+		var role AuthRole
+		if err := json.Unmarshal([]byte(cmd.Val), &role); err != nil {
+			return fmt.Errorf("%w: %s", InvalidAuthRole, err)
+		}
+		s.roles[cmd.Key] = role
+	case opDelRole:
+		if _, ok := s.roles[cmd.Key]; !ok {
+			return AuthRoleNotFound
+		}
+		delete(s.roles, cmd.Key)
+	case opSetToken:
+		var token APIToken
+		if err := json.Unmarshal([]byte(cmd.Val), &token); err != nil {
+			return fmt.Errorf("%w: %s", InvalidTokenRequest, err)
+		}
+		for _, role := range token.Roles {
+			if _, ok := s.roles[role]; !ok {
+				return fmt.Errorf("%w: unknown role %q", InvalidTokenRequest, role)
+			}
+		}
+		maps.DeleteFunc(s.tokens, func(_ string, t APIToken) bool { return t.Name == token.Name })
+		s.tokens[cmd.Key] = token
+	case opDelToken:
+		n := len(s.tokens)
+		maps.DeleteFunc(s.tokens, func(_ string, t APIToken) bool { return t.Name == cmd.Key })
+		if len(s.tokens) == n {
+			return TokenNotFound
+		}
+	}
+	return nil
+}
+
+// writeAuthError answers a failed role or token write.
+func writeAuthError(dkvService *DKVService, w http.ResponseWriter, r *http.Request, body []byte, err error) {
+	switch {
+	case errors.Is(err, NotLeader):
+		forwardToLeader(dkvService, w, r, body)
+	case errors.Is(err, LeaderNotReady):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, InvalidAuthRole), errors.Is(err, InvalidTokenRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, AuthRoleNotFound), errors.Is(err, TokenNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// ListAuthRolesHandler answers GET /auth/roles.
+func ListAuthRolesHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	dkvService, ok := s.GetStore().(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, dkvService.AuthRoles())
+}
+
+// PutAuthRoleHandler creates or replaces the role in the path:
+//
+//	PUT /auth/roles/app {"rules": [{"prefix": "app/", "read": true, "write": true}]}
+func PutAuthRoleHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return
+	}
+	var role AuthRole
+	if err := json.Unmarshal(body, &role); err != nil {
+		http.Error(w, "Unable to decode body", http.StatusBadRequest)
+		return
+	}
+	dkvService, ok := s.GetStore().(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	role.Name = chi.URLParam(r, "name")
+	if err := dkvService.SetAuthRole(role); err != nil {
+		writeAuthError(dkvService, w, r, body, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, role)
+}
+
+// DeleteAuthRoleHandler answers DELETE /auth/roles/{name}.
+func DeleteAuthRoleHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	dkvService, ok := s.GetStore().(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+	if err := dkvService.DeleteAuthRole(chi.URLParam(r, "name")); err != nil {
+		writeAuthError(dkvService, w, r, nil, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListTokensHandler answers GET /auth/tokens with the names and roles of the
+// tokens, never their secrets.
+func ListTokensHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	dkvService, ok := s.GetStore().(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, dkvService.Tokens())
+}
+
+// CreateTokenResponse carries the secret of a new token. It is shown once.
+type CreateTokenResponse struct {
+	APIToken
+	Token string `json:"token"`
+}
+
+// CreateTokenHandler issues a token:
+//
+//	POST /auth/tokens {"name": "ci", "roles": ["app"]}
+func CreateTokenHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return
+	}
+	var req APIToken
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Unable to decode body", http.StatusBadRequest)
+		return
+	}
+	dkvService, ok := s.GetStore().(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := dkvService.CreateToken(req.Name, req.Roles)
+	if err != nil {
+		writeAuthError(dkvService, w, r, body, err)
+		return
+	}
+	dkvService.logger.Info().Msgf("Created token %s with roles %v", req.Name, req.Roles)
+	writeJSON(w, http.StatusCreated, CreateTokenResponse{APIToken: req, Token: secret})
+}
+
+// DeleteTokenHandler answers DELETE /auth/tokens/{name}.
+func DeleteTokenHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	dkvService, ok := s.GetStore().(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+	if err := dkvService.DeleteToken(chi.URLParam(r, "name")); err != nil {
+		writeAuthError(dkvService, w, r, nil, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
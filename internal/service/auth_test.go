@@ -0,0 +1,139 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/router"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+func TestAuth(t *testing.T) {
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+	serviceConfig := Config{
+		KeyMaxLen:          100,
+		ValMaxLen:          200,
+		MaxMapSize:         1000,
+		TxnMaxOps:          64,
+		RaftNodeID:         "1",
+		Debug:              true,
+		AuthEnabled:        true,
+		AuthBootstrapToken: "bootstrap-secret",
+	}
+	router := router.New(router.Config{RequestTimeout: 60 * time.Second}, zlogger)
+	kv_service := New(zlogger, serviceConfig)
+	router.GetRouter().Use(AuthMiddleware(kv_service))
+	httpServer := server.New(zlogger, router.GetRouter(), server.Config{Address: "localhost:9999"}, kv_service)
+
+	httpServer.AddHandler(server.GET, "/healthz", HealthzHandler)
+	httpServer.AddHandler(server.GET, "/key/{id}", GetHandler)
+	httpServer.AddHandler(server.POST, "/key", SetHandler)
+	httpServer.AddHandler(server.PUT, "/key/{id}", PutHandler)
+	httpServer.AddHandler(server.DELETE, "/key/{id}", DelHandler)
+	httpServer.AddHandler(server.GET, "/keys", KeysHandler)
+	httpServer.AddHandler(server.POST, "/txn", TxnHandler)
+	httpServer.AddHandler(server.POST, "/register-follower", RegisterFollowerHandler)
+	httpServer.AddHandler(server.PUT, "/auth/roles/{name}", PutAuthRoleHandler)
+	httpServer.AddHandler(server.DELETE, "/auth/roles/{name}", DeleteAuthRoleHandler)
+	httpServer.AddHandler(server.GET, "/auth/tokens", ListTokensHandler)
+	httpServer.AddHandler(server.POST, "/auth/tokens", CreateTokenHandler)
+	httpServer.AddHandler(server.DELETE, "/auth/tokens/{name}", DeleteTokenHandler)
+
+	do := func(token, method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		httpServer.GetRouter().ServeHTTP(rr, req)
+		return rr
+	}
+	expect := func(rr *httptest.ResponseRecorder, status int, what string) {
+		t.Helper()
+		if rr.Code != status {
+			t.Fatalf("%s. Expected: %d, got: %d %s", what, status, rr.Code, rr.Body.String())
+		}
+	}
+	const admin = "bootstrap-secret"
+
+	expect(do("", "GET", "/healthz", ""), http.StatusOK, "probe without a token")
+	rr := do("", "GET", "/key/app-a", "")
+	expect(rr, http.StatusUnauthorized, "read without a token")
+	if rr.Header().Get("WWW-Authenticate") == "" {
+		t.Fatal("401 without a WWW-Authenticate header")
+	}
+	expect(do("dkv_guess", "GET", "/key/app-a", ""), http.StatusUnauthorized, "read with an unknown token")
+
+	expect(do(admin, "PUT", "/auth/roles/app", `{"rules":[{"prefix":"app-","read":true,"write":true}]}`),
+		http.StatusOK, "create role app")
+	expect(do(admin, "PUT", "/auth/roles/reader", `{"rules":[{"prefix":"shared-","read":true}]}`),
+		http.StatusOK, "create role reader")
+	expect(do(admin, "PUT", "/auth/roles/empty", `{"rules":[{"prefix":"x/"}]}`),
+		http.StatusBadRequest, "role with a rule granting nothing")
+	expect(do(admin, "POST", "/auth/tokens", `{"name":"ci","roles":["missing"]}`),
+		http.StatusBadRequest, "token with an unknown role")
+
+	rr = do(admin, "POST", "/auth/tokens", `{"name":"ci","roles":["app","reader"]}`)
+	expect(rr, http.StatusCreated, "create token")
+	var created CreateTokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Token, tokenPrefix) {
+		t.Fatalf("unexpected token %q", created.Token)
+	}
+	ci := created.Token
+	if strings.Contains(do(admin, "GET", "/auth/tokens", "").Body.String(), ci) {
+		t.Fatal("token list leaks the secret")
+	}
+
+	expect(do(ci, "POST", "/key", `{"key":"app-a","value":"1"}`), http.StatusCreated, "write inside the prefix")
+	expect(do(ci, "PUT", "/key/other", `{"value":"1"}`), http.StatusForbidden, "write outside the prefix")
+	expect(do(ci, "POST", "/key", `{"key":"other","value":"`+strings.Repeat("x", 300)+`"}`),
+		http.StatusForbidden, "oversized write outside the prefix")
+	expect(do(ci, "GET", "/key/app-a", ""), http.StatusOK, "read inside the prefix")
+	expect(do(ci, "GET", "/key/shared-x", ""), http.StatusNotFound, "read on a read-only prefix")
+	expect(do(ci, "DELETE", "/key/shared-x", ""), http.StatusForbidden, "delete on a read-only prefix")
+	expect(do(ci, "GET", "/keys?prefix=app-", ""), http.StatusOK, "list inside the prefix")
+	expect(do(ci, "GET", "/keys", ""), http.StatusForbidden, "list of every key")
+	expect(do(ci, "POST", "/txn", `{"compare":[{"key":"shared-x","target":"exists","op":"=","exists":false}],
+		"success":[{"op":"set","key":"app-b","value":"2"}]}`), http.StatusOK, "txn reading shared and writing app")
+	expect(do(ci, "POST", "/txn", `{"success":[{"op":"get","key":"app-a"}],
+		"failure":[{"op":"delete","key":"shared-x"}]}`), http.StatusForbidden, "txn deleting a read-only key")
+
+	// admin routes are closed to non-admin tokens.
+	expect(do(ci, "POST", "/register-follower", `{"follower_id":"evil","follower_addr":"localhost:1"}`),
+		http.StatusForbidden, "register-follower with a non-admin token")
+	expect(do(ci, "GET", "/auth/tokens", ""), http.StatusForbidden, "token list with a non-admin token")
+
+	// role changes apply to existing tokens right away.
+	expect(do(admin, "DELETE", "/auth/roles/app", ""), http.StatusNoContent, "delete role app")
+	expect(do(ci, "GET", "/key/app-a", ""), http.StatusForbidden, "read after the role was deleted")
+	expect(do(admin, "DELETE", "/auth/roles/app", ""), http.StatusNotFound, "delete a missing role")
+
+	// creating a token under the same name rotates it.
+	rr = do(admin, "POST", "/auth/tokens", `{"name":"ci","roles":["reader"]}`)
+	expect(rr, http.StatusCreated, "rotate token")
+	expect(do(ci, "GET", "/key/shared-x", ""), http.StatusUnauthorized, "read with the rotated out token")
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	expect(do(created.Token, "GET", "/key/shared-x", ""), http.StatusNotFound, "read with the new token")
+
+	expect(do(admin, "DELETE", "/auth/tokens/ci", ""), http.StatusNoContent, "revoke token")
+	expect(do(created.Token, "GET", "/key/shared-x", ""), http.StatusUnauthorized, "read with a revoked token")
+	expect(do(admin, "DELETE", "/auth/tokens/ci", ""), http.StatusNotFound, "revoke a missing token")
+}
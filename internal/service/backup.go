@@ -0,0 +1,382 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+// A backup archive is laid out as:
+//
+//	magic | format version(1) | metadata length(4, big endian) | metadata JSON | snapshot | sha256(32)
+//
+// The checksum covers everything before it.
+const (
+	backupMagic                = "DKVBACKUP"
+	backupFormatVersion   byte = 1
+	backupMaxMetaLen           = 1 << 16
+	BackupChecksumTrailer      = "X-DKV-Backup-SHA256"
+)
+
+var (
+	InvalidBackup      error = errors.New("backup is corrupt or not a dkv backup")
+	IncompatibleBackup error = errors.New("backup was written in a format this version does not support")
+)
+
+// BackupMeta describes the snapshot held by a backup archive.
+type BackupMeta struct {
+	FormatVersion   int       `json:"format_version"`
+	SnapshotVersion int       `json:"snapshot_version"`
+	NodeID          string    `json:"node_id"`
+	Index           uint64    `json:"index"`
+	Term            uint64    `json:"term"`
+	Size            int64     `json:"size"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// openBackup forces a raft snapshot of the local FSM and opens it. When
+// nothing was written since the last snapshot, that one is used instead.
+func (s *DKVService) openBackup() (BackupMeta, io.ReadCloser, error) {
+	if s.ServiceConfig.Debug {
+		return BackupMeta{}, nil, RaftDisabled
+	}
+
+	var snapMeta *raft.SnapshotMeta
+	var snapshot io.ReadCloser
+	future := s.raft.Snapshot()
+	err := future.Error()
+	switch {
+	case err == nil:
+		snapMeta, snapshot, err = future.Open()
+	case errors.Is(err, raft.ErrNothingNewToSnapshot):
+		var snapshots []*raft.SnapshotMeta
+		snapshots, err = s.snapshots.List()
+		if err == nil && len(snapshots) == 0 {
+			err = errors.New("no snapshot available")
+		}
+		if err == nil {
+			snapMeta, snapshot, err = s.snapshots.Open(snapshots[0].ID)
+		}
+	}
+	if err != nil {
+		return BackupMeta{}, nil, fmt.Errorf("unable to snapshot the store: %w", err)
+	}
+	version, snapshot, err := peekSnapshotVersion(snapshot)
+	if err != nil {
+		return BackupMeta{}, nil, fmt.Errorf("unable to read snapshot %s: %w", snapMeta.ID, err)
+	}
+
+	meta := BackupMeta{
+		FormatVersion:   int(backupFormatVersion),
+		SnapshotVersion: version,
+		NodeID:          s.ServiceConfig.RaftNodeID,
+		Index:           snapMeta.Index,
+		Term:            snapMeta.Term,
+		Size:            snapMeta.Size,
+		CreatedAt:       time.Now().UTC(),
+	}
+	return meta, snapshot, nil
+}
+
+// peekSnapshotVersion returns the layout version of snapshot, which may be
+// older than snapshotVersion when nothing was written since an upgrade, and a
+// reader that still yields the whole snapshot. Streamed snapshots carry it in
+// their header, the JSON ones of older versions are read whole.
+func peekSnapshotVersion(snapshot io.ReadCloser) (int, io.ReadCloser, error) {
+	br := bufio.NewReader(snapshot)
+	rc := struct {
+		io.Reader
+		io.Closer
+	}{br, snapshot}
+	if header, err := br.Peek(len(snapshotMagic) + 1); err == nil && string(header[:len(snapshotMagic)]) == snapshotMagic {
+		return int(header[len(snapshotMagic)]), rc, nil
+	}
+
+	b, err := io.ReadAll(br)
+	if err != nil {
+		snapshot.Close()
+		return 0, nil, err
+	}
+	data, err := readJSONSnapshot(bytes.NewReader(b))
+	if err != nil {
+		snapshot.Close()
+		return 0, nil, err
+	}
+	rc.Reader = bytes.NewReader(b)
+	return data.version, rc, nil
+}
+
+// SnapshotInfo describes a snapshot in the local snapshot store.
+type SnapshotInfo struct {
+	ID    string `json:"id"`
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Size  int64  `json:"size"`
+}
+
+// TakeSnapshot forces a raft snapshot of the local FSM, which also lets raft
+// compact its log, and describes it. When nothing was written since the last
+// snapshot, that one is described instead.
+func (s *DKVService) TakeSnapshot() (SnapshotInfo, error) {
+	if s.ServiceConfig.Debug {
+		return SnapshotInfo{}, RaftDisabled
+	}
+
+	err := s.raft.Snapshot().Error()
+	if err != nil && !errors.Is(err, raft.ErrNothingNewToSnapshot) {
+		return SnapshotInfo{}, fmt.Errorf("unable to snapshot the store: %w", err)
+	}
+	snapshots, err := s.snapshots.List()
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("unable to list snapshots: %w", err)
+	}
+	if len(snapshots) == 0 {
+		return SnapshotInfo{}, errors.New("no snapshot available")
+	}
+	latest := snapshots[0]
+	s.logger.Info().Msgf("Snapshot %s taken at index %d", latest.ID, latest.Index)
+	return SnapshotInfo{ID: latest.ID, Index: latest.Index, Term: latest.Term, Size: latest.Size}, nil
+}
+
+// writeBackup streams the archive of snapshot to w and returns its checksum.
+func writeBackup(w io.Writer, meta BackupMeta, snapshot io.Reader) (string, error) {
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	mw := io.MultiWriter(w, h)
+	header := make([]byte, 0, len(backupMagic)+5)
+	header = append(header, backupMagic...)
+	header = append(header, backupFormatVersion)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(metaJSON)))
+	if _, err := mw.Write(append(header, metaJSON...)); err != nil {
+		return "", err
+	}
+	n, err := io.Copy(mw, snapshot)
+	if err != nil {
+		return "", err
+	}
+	if n != meta.Size {
+		return "", fmt.Errorf("snapshot size changed while streaming. Expected: %d, got: %d", meta.Size, n)
+	}
+
+	sum := h.Sum(nil)
+	if _, err := w.Write(sum); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// readBackup verifies an archive and returns its metadata and the state its
+// snapshot holds. The snapshot is read the same way Restore does, so a backup
+// that passes cannot fail to install for format reasons. Archives holding the
+// JSON snapshots of older versions are still accepted.
+func readBackup(archive []byte) (BackupMeta, snapshotData, error) {
+	headerLen := len(backupMagic) + 5
+	if len(archive) < headerLen+sha256.Size || string(archive[:len(backupMagic)]) != backupMagic {
+		return BackupMeta{}, snapshotData{}, InvalidBackup
+	}
+	if version := archive[len(backupMagic)]; version != backupFormatVersion {
+		return BackupMeta{}, snapshotData{}, fmt.Errorf("%w. Archive format version: %d", IncompatibleBackup, version)
+	}
+
+	body, sum := archive[:len(archive)-sha256.Size], archive[len(archive)-sha256.Size:]
+	if want := sha256.Sum256(body); !bytes.Equal(sum, want[:]) {
+		return BackupMeta{}, snapshotData{}, fmt.Errorf("%w. Checksum mismatch", InvalidBackup)
+	}
+
+	metaLen := int(binary.BigEndian.Uint32(archive[len(backupMagic)+1:]))
+	if metaLen > backupMaxMetaLen || headerLen+metaLen > len(body) {
+		return BackupMeta{}, snapshotData{}, fmt.Errorf("%w. Bad metadata length", InvalidBackup)
+	}
+	var meta BackupMeta
+	if err := json.Unmarshal(body[headerLen:headerLen+metaLen], &meta); err != nil {
+		return BackupMeta{}, snapshotData{}, fmt.Errorf("%w. Bad metadata: %s", InvalidBackup, err)
+	}
+	snapshot := body[headerLen+metaLen:]
+	if int64(len(snapshot)) != meta.Size {
+		return BackupMeta{}, snapshotData{}, fmt.Errorf("%w. Snapshot size mismatch", InvalidBackup)
+	}
+
+	// the version in the metadata is only informative, what decides is the
+	// version the snapshot itself was written in.
+	data, err := readSnapshot(bytes.NewReader(snapshot))
+	if err != nil {
+		if errors.Is(err, UnsupportedSnapshot) {
+			return BackupMeta{}, snapshotData{}, fmt.Errorf("%w. %s", IncompatibleBackup, err)
+		}
+		return BackupMeta{}, snapshotData{}, fmt.Errorf("%w. %s", InvalidBackup, err)
+	}
+	meta.SnapshotVersion = data.version
+	return meta, data, nil
+}
+
+// RestoreBackup validates archive and installs its snapshot through raft, so
+// every node of the cluster ends up with the backed up state. Must run on the
+// leader.
+func (s *DKVService) RestoreBackup(archive []byte) (BackupMeta, error) {
+	meta, data, err := readBackup(archive)
+	if err != nil {
+		return BackupMeta{}, err
+	}
+	if s.ServiceConfig.Debug {
+		return BackupMeta{}, RaftDisabled
+	}
+	if err := s.checkLeader(); err != nil {
+		return BackupMeta{}, err
+	}
+
+	// raft installs the snapshot right after the last index of the log, or of
+	// the snapshot when that is further. The snapshot is rewritten to carry
+	// that index, so the leader, the followers it is sent to and any node
+	// restarting from it agree on the applied index. Should a write slip in
+	// before raft takes the snapshot, it is installed a bit further than the
+	// index it carries, which all nodes still agree on.
+	compression, _ := ParseSnapshotCompression(s.ServiceConfig.SnapshotCompression)
+	index := max(meta.Index, s.raft.LastIndex())
+	snap := &snapshot{
+		index:       index + 1,
+		kvtree:      data.kvtree,
+		nodes:       data.nodes,
+		roles:       data.roles,
+		tokens:      data.tokens,
+		compression: compression,
+	}
+	var buf bytes.Buffer
+	if err := snap.write(&buf); err != nil {
+		return BackupMeta{}, fmt.Errorf("unable to rewrite the snapshot: %w", err)
+	}
+
+	snapMeta := &raft.SnapshotMeta{
+		Version: raft.SnapshotVersionMax,
+		Index:   index,
+		Term:    meta.Term,
+		Size:    int64(buf.Len()),
+	}
+	if err := s.raft.Restore(snapMeta, &buf, s.ServiceConfig.RaftTimeout); err != nil {
+		s.logger.Error().Msgf("Unable to restore backup of NodeID %s at index %d. Error: %s", meta.NodeID, meta.Index, err)
+		return BackupMeta{}, err
+	}
+	s.logger.Info().Msgf("Restored backup of NodeID %s taken at index %d", meta.NodeID, meta.Index)
+	return meta, nil
+}
+
+// BackupHandler answers GET /admin/backup with a backup archive of the local
+// FSM. The checksum is also sent as the X-DKV-Backup-SHA256 trailer.
+func BackupHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	meta, snapshot, err := dkvService.openBackup()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer snapshot.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"dkv-%s-%d.backup\"", meta.NodeID, meta.Index))
+	w.Header().Set("Trailer", BackupChecksumTrailer)
+	w.WriteHeader(http.StatusOK)
+
+	sum, err := writeBackup(w, meta, snapshot)
+	if err != nil {
+		// the status is already out, all we can do is cut the archive short.
+		dkvService.logger.Error().Msgf("Streaming backup failed. Error: %s", err)
+		return
+	}
+	w.Header().Set(BackupChecksumTrailer, sum)
+}
+
+// RestoreHandler answers POST /admin/restore. The body is a backup archive as
+// returned by GET /admin/backup.
+func RestoreHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	var body io.Reader = r.Body
+	if limit := dkvService.ServiceConfig.BackupMaxBytes; limit > 0 {
+		body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	archive, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, "Unable to read backup: "+err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	meta, err := dkvService.RestoreBackup(archive)
+	if err != nil {
+		switch {
+		case errors.Is(err, InvalidBackup), errors.Is(err, IncompatibleBackup):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, NotLeader):
+			forwardToLeader(dkvService, w, r, archive)
+		case errors.Is(err, RaftDisabled), errors.Is(err, LeaderNotReady):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	b, err := json.Marshal(meta)
+	if err != nil {
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// SnapshotHandler answers POST /admin/snapshot by snapshotting this node.
+func SnapshotHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	info, err := dkvService.TakeSnapshot()
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, RaftDisabled) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/router"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	config := router.Config{
+		RequestTimeout: 60 * time.Second,
+	}
+	sConfig := server.Config{
+		Address:         "localhost:9999",
+		ShutdownTimeout: time.Second * 5,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+
+	kv_service := New(zlogger, Config{
+		KeyMaxLen:      100,
+		ValMaxLen:      200,
+		MaxMapSize:     1000,
+		RaftNodeID:     "1",
+		RaftAddr:       "localhost:23901",
+		RaftStoreDir:   t.TempDir(),
+		RaftTimeout:    5 * time.Second,
+		RaftLeader:     true,
+		BackupMaxBytes: 1 << 20,
+	})
+	defer kv_service.Shutdown()
+
+	router := router.New(config, zlogger)
+	httpServer := server.New(zlogger, router.GetRouter(), sConfig, kv_service)
+	httpServer.AddHandler(server.GET, "/admin/backup", BackupHandler)
+	httpServer.AddHandler(server.POST, "/admin/restore", RestoreHandler)
+	do := func(method string, body []byte) *httptest.ResponseRecorder {
+		path := "/admin/backup"
+		if method == "POST" {
+			path = "/admin/restore"
+		}
+		req, err := http.NewRequest(method, path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		httpServer.GetRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	for key, val := range map[string]string{"a": "1", "b": "2"} {
+		if _, err := kv_service.Set(key, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr := do("GET", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("backup failed. Expected: %d, got: %d body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	archive := rr.Body.Bytes()
+	sum := sha256.Sum256(archive[:len(archive)-sha256.Size])
+	if got := rr.Result().Trailer.Get(BackupChecksumTrailer); got != hex.EncodeToString(sum[:]) {
+		t.Fatalf("checksum trailer mismatch. Expected: %s, got: %s", hex.EncodeToString(sum[:]), got)
+	}
+	if !strings.Contains(rr.Header().Get("Content-Disposition"), "dkv-1-") {
+		t.Fatalf("unexpected Content-Disposition: %s", rr.Header().Get("Content-Disposition"))
+	}
+
+	// a second backup without new writes reuses the last snapshot.
+	if rr := do("GET", nil); rr.Code != http.StatusOK {
+		t.Fatalf("backup without new writes failed. Expected: %d, got: %d body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	if _, err := kv_service.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv_service.Set("c", "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := bytes.Clone(archive)
+	tampered[len(tampered)-sha256.Size-2] ^= 0xff
+	meta, data, err := readBackup(archive)
+	if err != nil || data.kvtree.Len() != 2 {
+		t.Fatalf("backup does not read back. data: %+v err: %v", data, err)
+	}
+
+	// a forced snapshot covers the writes made since the backup.
+	info, err := kv_service.TakeSnapshot()
+	if err != nil || info.ID == "" || info.Index <= meta.Index {
+		t.Fatalf("snapshot after new writes. info: %+v err: %v", info, err)
+	}
+	if meta.SnapshotVersion != snapshotVersion {
+		t.Fatalf("snapshot version of the backup. Expected: %d, got: %d", snapshotVersion, meta.SnapshotVersion)
+	}
+
+	// a JSON snapshot left from before an upgrade is backed up with its own
+	// version, whatever the archive metadata claims.
+	oldSnapshot := []byte(`{"a":"1"}`)
+	version, rc, err := peekSnapshotVersion(io.NopCloser(bytes.NewReader(oldSnapshot)))
+	if err != nil || version != 0 {
+		t.Fatalf("version of a JSON snapshot. Expected: 0, got: %d err: %v", version, err)
+	}
+	if b, _ := io.ReadAll(rc); !bytes.Equal(b, oldSnapshot) {
+		t.Fatalf("snapshot changed by reading its version: %s", b)
+	}
+	oldMeta := meta
+	oldMeta.Size = int64(len(oldSnapshot))
+	var old bytes.Buffer
+	if _, err := writeBackup(&old, oldMeta, bytes.NewReader(oldSnapshot)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err := readBackup(old.Bytes()); err != nil || got.SnapshotVersion != 0 {
+		t.Fatalf("snapshot version of an old backup. Expected: 0, got: %d err: %v", got.SnapshotVersion, err)
+	}
+
+	futureSnapshot := []byte(snapshotMagic + "\x63\x00")
+	meta.Size = int64(len(futureSnapshot))
+	var future bytes.Buffer
+	if _, err := writeBackup(&future, meta, bytes.NewReader(futureSnapshot)); err != nil {
+		t.Fatal(err)
+	}
+
+	beforeRestore := kv_service.LastAppliedIndex()
+	_, watcher, err := kv_service.Watch(WatchFilter{}, beforeRestore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		archive []byte
+		want    int
+	}{
+		{name: "not a backup", archive: []byte("hello"), want: http.StatusBadRequest},
+		{name: "tampered backup", archive: tampered, want: http.StatusBadRequest},
+		{name: "incompatible snapshot version", archive: future.Bytes(), want: http.StatusBadRequest},
+		{name: "valid backup", archive: archive, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rr := do("POST", tt.archive); rr.Code != tt.want {
+			t.Fatalf("%s. Expected: %d, got: %d body: %s", tt.name, tt.want, rr.Code, rr.Body.String())
+		}
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if got, err := kv_service.Get(key); err != nil || got != want {
+			t.Fatalf("key %s after restore. Expected: %s, got: %s err: %v", key, want, got, err)
+		}
+	}
+	if _, err := kv_service.Get("c"); err == nil {
+		t.Fatal("key c written after the backup survived the restore")
+	}
+
+	// the restore is a change after the writes it undid, so the applied index
+	// goes on and watchers cannot resume from before it. It is the index raft
+	// installed the snapshot at, which a node restarting from it reads back.
+	snapshots, err := kv_service.snapshots.List()
+	if err != nil || len(snapshots) == 0 {
+		t.Fatalf("snapshots after restore: %v err: %v", snapshots, err)
+	}
+	installed := snapshots[0].Index
+	if got := kv_service.LastAppliedIndex(); got <= beforeRestore || got != installed {
+		t.Fatalf("applied index after restore. Before: %d, installed at: %d, got: %d", beforeRestore, installed, got)
+	}
+	_, rc, err = kv_service.snapshots.Open(snapshots[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := readSnapshot(rc)
+	rc.Close()
+	if err != nil || restored.index != installed {
+		t.Fatalf("index of the installed snapshot. Expected: %d, got: %d err: %v", installed, restored.index, err)
+	}
+	if _, ok := <-watcher.Events; ok {
+		t.Fatal("watcher from before the restore got an event instead of being closed")
+	}
+	if _, _, err := kv_service.Watch(WatchFilter{}, beforeRestore); !errors.Is(err, HistoryCompacted) {
+		t.Fatalf("watch from before the restore. Expected: %v, got: %v", HistoryCompacted, err)
+	}
+
+	// the store keeps taking writes after a restore.
+	if _, err := kv_service.Set("d", "4"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/raft"
+)
+
+// NodeMeta holds the addresses of a cluster member. It is kept in the FSM so
+// that any node can translate a raft leader into an HTTP endpoint.
+type NodeMeta struct {
+	RaftAddr string `json:"raft_addr"`
+	HTTPAddr string `json:"http_addr"`
+}
+
+var (
+	LeaderUnknown error = errors.New("leader HTTP address is not known yet")
+	InvalidPeer   error = errors.New("invalid raft peer. Use id=raftAddr@httpAddr")
+)
+
+// Peer is one entry of the static RAFT_PEERS list.
+type Peer struct {
+	ID       string
+	RaftAddr string
+	HTTPAddr string
+}
+
+// ParsePeers parses id=raftAddr@httpAddr entries. The HTTP address is
+// optional, without it followers cannot forward requests to that peer.
+func ParsePeers(entries []string) ([]Peer, error) {
+	peers := make([]Peer, 0, len(entries))
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		id, addrs, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		raftAddr, httpAddr, _ := strings.Cut(addrs, "@")
+		if !ok || id == "" || raftAddr == "" {
+			return nil, fmt.Errorf("%w. Got: %q", InvalidPeer, entry)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("%w. Duplicate id %q", InvalidPeer, id)
+		}
+		seen[id] = true
+		peers = append(peers, Peer{ID: id, RaftAddr: raftAddr, HTTPAddr: httpAddr})
+	}
+	return peers, nil
+}
+
+// validatePeers checks the static peers parse and that this node is one of
+// them with the raft address it listens on.
+func validatePeers(config Config) error {
+	peers, err := ParsePeers(config.RaftPeers)
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		if peer.ID == config.RaftNodeID {
+			if peer.RaftAddr != config.RaftAddr {
+				return fmt.Errorf("%w. NodeID %s is listed with raft address %s but RAFT_ADDR is %s",
+					InvalidPeer, peer.ID, peer.RaftAddr, config.RaftAddr)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%w. NodeID %s is not in the list", InvalidPeer, config.RaftNodeID)
+}
+
+// NodeMeta returns the replicated addresses recorded for nodeID.
+func (s *DKVService) NodeMeta(nodeID string) (NodeMeta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, ok := s.nodes[nodeID]
+	return meta, ok
+}
+
+// LeaderHTTPAddr returns the node ID and HTTP address of the current raft
+// leader using the replicated node metadata.
+func (s *DKVService) LeaderHTTPAddr() (string, string, error) {
+	leaderAddr, leaderId := s.raft.LeaderWithID()
+	if leaderAddr == "" || leaderId == "" {
+		return "", "", LeaderNotReady
+	}
+
+	meta, ok := s.NodeMeta(string(leaderId))
+	if !ok || meta.HTTPAddr == "" {
+		return string(leaderId), "", fmt.Errorf("%w. NodeID: %s", LeaderUnknown, leaderId)
+	}
+	return string(leaderId), meta.HTTPAddr, nil
+}
+
+// registerNodeMeta replicates the addresses of nodeID through raft. It is a
+// no-op when the same addresses are already recorded. Must run on the leader.
+func (s *DKVService) registerNodeMeta(nodeID, raftAddr, httpAddr string) error {
+	if httpAddr == "" {
+		s.logger.Info().Msgf("No HTTP address given for NodeID %s. Skipping node metadata.", nodeID)
+		return nil
+	}
+
+	want := NodeMeta{RaftAddr: raftAddr, HTTPAddr: httpAddr}
+	if meta, ok := s.NodeMeta(nodeID); ok && meta == want {
+		return nil
+	}
+
+	cmd := encodeCommand(command{Op: opSetNode, Key: nodeID, RaftAddr: raftAddr, HTTPAddr: httpAddr})
+	if err := s.raft.Apply(cmd, s.ServiceConfig.RaftTimeout).Error(); err != nil {
+		s.logger.Error().Msgf("Unable to replicate node metadata for NodeID %s. Error: %s", nodeID, err)
+		return err
+	}
+	s.logger.Info().Msgf("Node metadata registered. NodeID: %s RaftAddr: %s HTTPAddr: %s", nodeID, raftAddr, httpAddr)
+	return nil
+}
+
+// monitorLeadership reacts to leadership changes reported by raft on the
+// NotifyCh. A freshly elected leader makes sure its own HTTP address and those
+// of the static peers are in the replicated node metadata so followers can
+// forward writes to it, and runs the key expiry loop for as long as it stays
+// leader.
+func (s *DKVService) monitorLeadership(notifyCh <-chan bool) {
+	var stopExpiry chan struct{}
+	for isLeader := range notifyCh {
+		s.logger.Info().Msgf("Leadership changed. Is leader: %t", isLeader)
+		s.readBarrierDone.Store(false)
+		s.leaseVerifiedAt.Store(0)
+		if stopExpiry != nil {
+			close(stopExpiry)
+			stopExpiry = nil
+		}
+		if !isLeader {
+			continue
+		}
+
+		stopExpiry = make(chan struct{})
+		go s.runExpiry(stopExpiry)
+
+		// raft blocks on NotifyCh writes, so never wait on raft from this loop.
+		go func() {
+			err := s.registerNodeMeta(s.ServiceConfig.RaftNodeID, s.ServiceConfig.RaftAddr, s.ServiceConfig.HTTPAddr)
+			if err != nil && !errors.Is(err, raft.ErrNotLeader) && !errors.Is(err, raft.ErrLeadershipLost) {
+				s.logger.Error().Msgf("Unable to register leader metadata. Error: %s", err)
+			}
+
+			// static peers never register, so their addresses come from the config.
+			peers, _ := ParsePeers(s.ServiceConfig.RaftPeers)
+			for _, peer := range peers {
+				if peer.ID == s.ServiceConfig.RaftNodeID {
+					continue
+				}
+				err := s.registerNodeMeta(peer.ID, peer.RaftAddr, peer.HTTPAddr)
+				if err != nil && !errors.Is(err, raft.ErrNotLeader) && !errors.Is(err, raft.ErrLeadershipLost) {
+					s.logger.Error().Msgf("Unable to register metadata of peer %s. Error: %s", peer.ID, err)
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,230 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/router"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+func TestParsePeers(t *testing.T) {
+	peers, err := ParsePeers([]string{"node1=localhost:21001@localhost:8888", " node2=localhost:21002 "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Peer{
+		{ID: "node1", RaftAddr: "localhost:21001", HTTPAddr: "localhost:8888"},
+		{ID: "node2", RaftAddr: "localhost:21002"},
+	}
+	if !reflect.DeepEqual(peers, want) {
+		t.Fatalf("unexpected peers. Expected: %+v, got: %+v", want, peers)
+	}
+
+	for _, entries := range [][]string{
+		{"localhost:21001@localhost:8888"},
+		{"node1=@localhost:8888"},
+		{"node1=localhost:21001", "node1=localhost:21002"},
+	} {
+		if _, err := ParsePeers(entries); !errors.Is(err, InvalidPeer) {
+			t.Fatalf("expected InvalidPeer for %q, got: %v", entries, err)
+		}
+	}
+
+	config := Config{RaftNodeID: "node2", RaftAddr: "localhost:21003", RaftPeers: []string{"node2=localhost:21002"}}
+	if err := validatePeers(config); !errors.Is(err, InvalidPeer) {
+		t.Fatalf("expected InvalidPeer for a mismatching raft address, got: %v", err)
+	}
+}
+
+func TestRaftStaticPeersAndJoinThroughFollower(t *testing.T) {
+	config := router.Config{
+		RequestTimeout: 60 * time.Second,
+	}
+	sConfig := server.Config{
+		Address:         "localhost:9999",
+		ShutdownTimeout: time.Second * 5,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+
+	// every node needs a reachable HTTP API before raft starts, so peers can
+	// forward to each other.
+	const n = 4
+	routers := make([]*router.Router, n)
+	httpAddrs := make([]string, n)
+	for i := range n {
+		routers[i] = router.New(config, zlogger)
+		ts := httptest.NewServer(routers[i].GetRouter())
+		defer ts.Close()
+		httpAddrs[i] = ts.Listener.Addr().String()
+	}
+	var peers []string
+	for i := range 3 {
+		peers = append(peers, fmt.Sprintf("%d=localhost:2370%d@%s", i+1, i+1, httpAddrs[i]))
+	}
+
+	nodes := make([]*DKVService, n)
+	newNode := func(i int, serviceConfig Config) {
+		serviceConfig.KeyMaxLen = 100
+		serviceConfig.ValMaxLen = 200
+		serviceConfig.MaxMapSize = 1000
+		serviceConfig.RaftNodeID = fmt.Sprint(i + 1)
+		serviceConfig.RaftAddr = fmt.Sprintf("localhost:2370%d", i+1)
+		serviceConfig.RaftStoreDir = t.TempDir()
+		serviceConfig.RaftTimeout = 5 * time.Second
+		serviceConfig.HTTPAddr = httpAddrs[i]
+		nodes[i] = New(zlogger, serviceConfig)
+
+		httpServer := server.New(zlogger, routers[i].GetRouter(), sConfig, nodes[i])
+		httpServer.AddHandler(server.POST, "/register-follower", RegisterFollowerHandler)
+	}
+
+	// no node is special, they all bootstrap the same configuration and
+	// wait for a leader together.
+	var wg sync.WaitGroup
+	for i := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newNode(i, Config{RaftPeers: peers})
+		}()
+	}
+	wg.Wait()
+	for i := range 3 {
+		defer nodes[i].Shutdown()
+	}
+
+	var leader, follower *DKVService
+	for _, node := range nodes[:3] {
+		if node.raft.State() == raft.Leader {
+			leader = node
+		} else {
+			follower = node
+		}
+	}
+	if leader == nil {
+		t.Fatal("no leader among the static peers")
+	}
+
+	// the leader replicates the HTTP addresses of the static peers.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, ok1 := follower.NodeMeta("1")
+		_, ok2 := follower.NodeMeta("2")
+		_, ok3 := follower.NodeMeta("3")
+		if ok1 && ok2 && ok3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("peer metadata was not replicated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a new node registers through a dead address and a follower, which
+	// forwards the registration to the leader.
+	newNode(3, Config{RaftJoinAddr: []string{"localhost:1", follower.ServiceConfig.HTTPAddr}})
+	defer nodes[3].Shutdown()
+
+	member, err := leader.findMember("4")
+	if err != nil {
+		t.Fatalf("joining node is not a member: %s", err)
+	}
+	if member.Suffrage != raft.Voter {
+		t.Fatalf("joining node has suffrage %s", member.Suffrage)
+	}
+}
+
+func TestRaftJoinAndForwardOverTLS(t *testing.T) {
+	config := router.Config{
+		RequestTimeout: 60 * time.Second,
+	}
+	sConfig := server.Config{
+		Address:         "localhost:9999",
+		ShutdownTimeout: time.Second * 5,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+
+	// both nodes serve their API over HTTPS only. The test servers share one
+	// certificate, so the client config of one trusts the other.
+	routers := make([]*router.Router, 2)
+	servers := make([]*httptest.Server, 2)
+	for i := range 2 {
+		routers[i] = router.New(config, zlogger)
+		servers[i] = httptest.NewTLSServer(routers[i].GetRouter())
+		defer servers[i].Close()
+	}
+	peerTLS := servers[0].Client().Transport.(*http.Transport).TLSClientConfig
+
+	nodes := make([]*DKVService, 2)
+	for i := range 2 {
+		serviceConfig := Config{
+			KeyMaxLen:    100,
+			ValMaxLen:    200,
+			MaxMapSize:   1000,
+			RaftNodeID:   fmt.Sprint(i + 1),
+			RaftAddr:     fmt.Sprintf("localhost:2400%d", i+1),
+			RaftStoreDir: t.TempDir(),
+			RaftTimeout:  5 * time.Second,
+			HTTPAddr:     servers[i].Listener.Addr().String(),
+			PeerTLS:      peerTLS,
+		}
+		if i == 0 {
+			serviceConfig.RaftLeader = true
+		} else {
+			serviceConfig.RaftJoinAddr = []string{nodes[0].ServiceConfig.HTTPAddr}
+		}
+		nodes[i] = New(zlogger, serviceConfig)
+		defer nodes[i].Shutdown()
+
+		httpServer := server.New(zlogger, routers[i].GetRouter(), sConfig, nodes[i])
+		httpServer.AddHandler(server.POST, "/register-follower", RegisterFollowerHandler)
+		httpServer.AddHandler(server.POST, "/key", SetHandler)
+	}
+
+	if _, err := nodes[0].findMember("2"); err != nil {
+		t.Fatalf("follower did not join over TLS: %s", err)
+	}
+
+	// the follower learns the leader's HTTP address, then relays writes to it.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, err := nodes[1].LeaderHTTPAddr(); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("leader HTTP address was not replicated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, err := servers[1].Client().Post(servers[1].URL+"/key", "application/json",
+		strings.NewReader(`{"key":"a","value":"b"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("write forwarded over TLS failed. Expected: %d, got: %d", http.StatusCreated, resp.StatusCode)
+	}
+	if val, err := nodes[0].Get("a"); err != nil || val != "b" {
+		t.Fatalf("forwarded write not applied on the leader. got: %q err: %v", val, err)
+	}
+}
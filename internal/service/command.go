@@ -0,0 +1,412 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// commandVersion is written as the first byte of every raft log entry
+// produced by encodeCommand. Legacy entries start with the ASCII text
+// "command:" and are detected by decodeCommand so old logs still replay.
+const commandVersion byte = 1
+
+const legacyCommandPrefix = "command:"
+
+// opCode identifies the operation carried by a raft log entry.
+type opCode byte
+
+const (
+	opSet opCode = iota + 1
+	opDel
+	// opSetNode records the raft and HTTP addresses of a cluster member.
+	opSetNode
+	// opExpire removes a key whose TTL ran out, unless it was rewritten since.
+	opExpire
+	// opTxn applies a guarded multi-key transaction atomically.
+	opTxn
+	// opGet reads a key. It is only valid as a branch op of opTxn.
+	opGet
+	// opDelNode forgets the addresses of a member removed from the cluster.
+	opDelNode
+	// opSetRole and opSetToken store an auth role or token, JSON encoded in
+	// Val. Key is the role name, or the SHA-256 of the token. See auth.go.
+	opSetRole
+	opDelRole
+	opSetToken
+	// opDelToken revokes a token. Key is the token name.
+	opDelToken
+)
+
+func (op opCode) String() string {
+	switch op {
+	case opSet:
+		return "SET"
+	case opDel:
+		return "DEL"
+	case opSetNode:
+		return "SETNODE"
+	case opExpire:
+		return "EXPIRE"
+	case opTxn:
+		return "TXN"
+	case opGet:
+		return "GET"
+	case opDelNode:
+		return "DELNODE"
+	case opSetRole:
+		return "SETROLE"
+	case opDelRole:
+		return "DELROLE"
+	case opSetToken:
+		return "SETTOKEN"
+	case opDelToken:
+		return "DELTOKEN"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", byte(op))
+	}
+}
+
+// field tags used in the binary encoding. Each field is written as
+// tag byte, uvarint length, raw bytes.
+const (
+	fieldKey byte = iota + 1
+	fieldVal
+	fieldRaftAddr
+	fieldHTTPAddr
+	fieldMode
+	fieldRevision
+	fieldNow
+	fieldExpiresAt
+	// transaction fields, each holding one nested encoded compare or op.
+	fieldCompare
+	fieldSuccess
+	fieldFailure
+)
+
+// field tags of a nested transaction compare.
+const (
+	compareKey byte = iota + 1
+	compareTarget
+	compareOp
+	compareVal
+	compareRevision
+	compareExists
+)
+
+var (
+	InvalidCommand error = errors.New("invalid raft command")
+)
+
+// command is the decoded form of a raft log entry applied by the FSM.
+// For opSetNode and opDelNode, Key holds the raft node ID.
+type command struct {
+	Op  opCode
+	Key string
+	Val string
+
+	// Mode is the precondition for opSet. Entries written before modes
+	// existed carry no mode field and decode as WriteUpsert.
+	Mode WriteMode
+	// CheckRevision makes opSet and opDel fail unless the key's current
+	// revision equals Revision.
+	CheckRevision bool
+	Revision      uint64
+
+	// Now is the proposer's wall clock in unix milliseconds. The FSM uses it
+	// instead of its own clock to decide whether a key has expired, so all
+	// replicas agree. ExpiresAt is the absolute expiry of an opSet, 0 if none.
+	Now       int64
+	ExpiresAt int64
+
+	RaftAddr string
+	HTTPAddr string
+
+	// Txn is set for opTxn.
+	Txn *txn
+}
+
+// encodeCommand serializes cmd into the versioned binary log format:
+//
+//	version(1) | op(1) | { tag(1) | len(uvarint) | bytes }...
+//
+// Keys and values are length-prefixed so any byte sequence round-trips.
+func encodeCommand(cmd command) []byte {
+	b := make([]byte, 0, 2+2*binary.MaxVarintLen64+len(cmd.Key)+len(cmd.Val))
+	b = append(b, commandVersion, byte(cmd.Op))
+	b = appendField(b, fieldKey, cmd.Key)
+	switch cmd.Op {
+	case opSet:
+		b = appendField(b, fieldVal, cmd.Val)
+		if cmd.Mode != WriteUpsert {
+			b = appendField(b, fieldMode, string([]byte{byte(cmd.Mode)}))
+		}
+	case opSetRole, opSetToken:
+		b = appendField(b, fieldVal, cmd.Val)
+	case opSetNode:
+		b = appendField(b, fieldRaftAddr, cmd.RaftAddr)
+		b = appendField(b, fieldHTTPAddr, cmd.HTTPAddr)
+	}
+	if cmd.CheckRevision {
+		b = appendUvarintField(b, fieldRevision, cmd.Revision)
+	}
+	if cmd.Now > 0 {
+		b = appendUvarintField(b, fieldNow, uint64(cmd.Now))
+	}
+	if cmd.ExpiresAt > 0 {
+		b = appendUvarintField(b, fieldExpiresAt, uint64(cmd.ExpiresAt))
+	}
+	if cmd.Txn != nil {
+		for _, c := range cmd.Txn.Compares {
+			b = appendField(b, fieldCompare, string(encodeCompare(c)))
+		}
+		for _, op := range cmd.Txn.Success {
+			b = appendField(b, fieldSuccess, string(encodeCommand(op)))
+		}
+		for _, op := range cmd.Txn.Failure {
+			b = appendField(b, fieldFailure, string(encodeCommand(op)))
+		}
+	}
+	return b
+}
+
+func appendField(b []byte, tag byte, val string) []byte {
+	b = append(b, tag)
+	b = binary.AppendUvarint(b, uint64(len(val)))
+	return append(b, val...)
+}
+
+func appendUvarintField(b []byte, tag byte, val uint64) []byte {
+	return appendField(b, tag, string(binary.AppendUvarint(nil, val)))
+}
+
+func decodeUvarintField(val string) (uint64, error) {
+	n, sz := binary.Uvarint([]byte(val))
+	if sz <= 0 || sz != len(val) {
+		return 0, fmt.Errorf("%w: invalid number field", InvalidCommand)
+	}
+	return n, nil
+}
+
+// decodeCommand parses a raft log entry written by encodeCommand or by the
+// older "command:SET,key:k,val:v" string format.
+func decodeCommand(data []byte) (command, error) {
+	if len(data) == 0 {
+		return command{}, fmt.Errorf("%w: empty log entry", InvalidCommand)
+	}
+	if strings.HasPrefix(string(data), legacyCommandPrefix) {
+		return decodeLegacyCommand(string(data))
+	}
+	if data[0] != commandVersion {
+		return command{}, fmt.Errorf("%w: unsupported version %d", InvalidCommand, data[0])
+	}
+	if len(data) < 2 {
+		return command{}, fmt.Errorf("%w: missing op code", InvalidCommand)
+	}
+
+	cmd := command{Op: opCode(data[1])}
+	err := decodeFields(data[2:], func(tag byte, val string) error {
+		switch tag {
+		case fieldKey:
+			cmd.Key = val
+		case fieldVal:
+			cmd.Val = val
+		case fieldRaftAddr:
+			cmd.RaftAddr = val
+		case fieldHTTPAddr:
+			cmd.HTTPAddr = val
+		case fieldMode:
+			if len(val) != 1 || WriteMode(val[0]) > WriteUpdateOnly {
+				return fmt.Errorf("%w: invalid write mode %q", InvalidCommand, val)
+			}
+			cmd.Mode = WriteMode(val[0])
+		case fieldRevision:
+			rev, err := decodeUvarintField(val)
+			if err != nil {
+				return err
+			}
+			cmd.CheckRevision = true
+			cmd.Revision = rev
+		case fieldNow, fieldExpiresAt:
+			n, err := decodeUvarintField(val)
+			if err != nil || n > math.MaxInt64 {
+				return fmt.Errorf("%w: invalid timestamp", InvalidCommand)
+			}
+			if tag == fieldNow {
+				cmd.Now = int64(n)
+			} else {
+				cmd.ExpiresAt = int64(n)
+			}
+		case fieldCompare, fieldSuccess, fieldFailure:
+			if cmd.Txn == nil {
+				cmd.Txn = &txn{}
+			}
+			if tag == fieldCompare {
+				c, err := decodeCompare(val)
+				if err != nil {
+					return err
+				}
+				cmd.Txn.Compares = append(cmd.Txn.Compares, c)
+				return nil
+			}
+			op, err := decodeCommand([]byte(val))
+			if err != nil {
+				return err
+			}
+			if op.Op != opSet && op.Op != opDel && op.Op != opGet {
+				return fmt.Errorf("%w: op %s not allowed in a transaction", InvalidCommand, op.Op)
+			}
+			if tag == fieldSuccess {
+				cmd.Txn.Success = append(cmd.Txn.Success, op)
+			} else {
+				cmd.Txn.Failure = append(cmd.Txn.Failure, op)
+			}
+		default:
+			return fmt.Errorf("%w: unknown field %d", InvalidCommand, tag)
+		}
+		return nil
+	})
+	if err != nil {
+		return command{}, err
+	}
+
+	switch cmd.Op {
+	case opSet, opDel, opSetNode, opExpire, opGet, opDelNode,
+		opSetRole, opDelRole, opSetToken, opDelToken:
+	case opTxn:
+		if cmd.Txn == nil {
+			cmd.Txn = &txn{}
+		}
+	default:
+		return command{}, fmt.Errorf("%w: unknown op %s", InvalidCommand, cmd.Op)
+	}
+	return cmd, nil
+}
+
+// decodeFields walks a tag, uvarint length, bytes sequence and hands every
+// field to fn.
+func decodeFields(data []byte, fn func(tag byte, val string) error) error {
+	for len(data) > 0 {
+		tag := data[0]
+		n, sz := binary.Uvarint(data[1:])
+		if sz <= 0 || uint64(len(data)-1-sz) < n {
+			return fmt.Errorf("%w: truncated field %d", InvalidCommand, tag)
+		}
+		val := string(data[1+sz : 1+sz+int(n)])
+		data = data[1+sz+int(n):]
+
+		if err := fn(tag, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeCompare(c Compare) []byte {
+	var b []byte
+	b = appendField(b, compareKey, c.Key)
+	b = appendField(b, compareTarget, c.Target)
+	b = appendField(b, compareOp, c.Op)
+	switch c.Target {
+	case CompareValue:
+		b = appendField(b, compareVal, c.Val)
+	case CompareRevision:
+		b = appendUvarintField(b, compareRevision, c.Revision)
+	case CompareExists:
+		exists := "0"
+		if c.Exists {
+			exists = "1"
+		}
+		b = appendField(b, compareExists, exists)
+	}
+	return b
+}
+
+func decodeCompare(data string) (Compare, error) {
+	var c Compare
+	err := decodeFields([]byte(data), func(tag byte, val string) error {
+		switch tag {
+		case compareKey:
+			c.Key = val
+		case compareTarget:
+			c.Target = val
+		case compareOp:
+			c.Op = val
+		case compareVal:
+			c.Val = val
+		case compareRevision:
+			rev, err := decodeUvarintField(val)
+			if err != nil {
+				return err
+			}
+			c.Revision = rev
+		case compareExists:
+			c.Exists = val == "1"
+		default:
+			return fmt.Errorf("%w: unknown compare field %d", InvalidCommand, tag)
+		}
+		return nil
+	})
+	if err != nil {
+		return Compare{}, err
+	}
+	if err := c.validate(); err != nil {
+		return Compare{}, fmt.Errorf("%w: %s", InvalidCommand, err)
+	}
+	return c, nil
+}
+
+// decodeLegacyCommand understands entries written before the binary codec.
+// Those entries could not escape ',' or ':', so the value is taken to be
+// everything after the first ",val:" to recover as much as possible.
+func decodeLegacyCommand(cmdStr string) (command, error) {
+	segments := ExtractCmdSegments(cmdStr)
+	if len(segments) < 2 {
+		return command{}, fmt.Errorf("%w: malformed legacy entry %q", InvalidCommand, cmdStr)
+	}
+
+	var cmd command
+	switch ExtractCommand(segments[0]) {
+	case "SET":
+		cmd.Op = opSet
+	case "DEL":
+		cmd.Op = opDel
+	default:
+		return command{}, fmt.Errorf("%w: unknown legacy command %q", InvalidCommand, segments[0])
+	}
+
+	rest := strings.TrimPrefix(cmdStr, segments[0]+",")
+	if cmd.Op == opSet {
+		keyPart, valPart, found := strings.Cut(rest, ",val:")
+		if !found {
+			return command{}, fmt.Errorf("%w: legacy SET without val %q", InvalidCommand, cmdStr)
+		}
+		cmd.Key = strings.TrimPrefix(keyPart, "key:")
+		cmd.Val = valPart
+		return cmd, nil
+	}
+	cmd.Key = strings.TrimPrefix(rest, "key:")
+	return cmd, nil
+}
+
+func ExtractCmdSegments(cmd string) []string {
+	segments := strings.Split(cmd, ",")
+	return segments
+}
+
+func ExtractCommand(cmdSegment string) string {
+	_, label, _ := strings.Cut(cmdSegment, ":")
+	return label
+}
+
+func ExtractKey(cmdSegment string) string {
+	_, key, _ := strings.Cut(cmdSegment, ":")
+	return key
+}
+
+func ExtractVal(cmdSegment string) string {
+	_, val, _ := strings.Cut(cmdSegment, ":")
+	return val
+}
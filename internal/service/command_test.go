@@ -0,0 +1,76 @@
+package service
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCommandRoundTrip(t *testing.T) {
+	cmds := []command{
+		{Op: opSet, Key: "a", Val: "b"},
+		{Op: opSet, Key: "url", Val: "https://example.com:8080/path?x=1,y=2"},
+		{Op: opSet, Key: "json,key:1", Val: `{"a":1,"b":"c:d"}`},
+		{Op: opSet, Key: "empty", Val: ""},
+		{Op: opSet, Key: "a", Val: "b", Mode: WriteCreateOnly},
+		{Op: opSet, Key: "a", Val: "b", Mode: WriteUpdateOnly},
+		{Op: opSet, Key: "a", Val: "b", CheckRevision: true, Revision: 300},
+		{Op: opDel, Key: "a", CheckRevision: true, Revision: 0},
+		{Op: opSet, Key: "a", Val: "b", Now: 1700000000000, ExpiresAt: 1700000060000},
+		{Op: opExpire, Key: "a", CheckRevision: true, Revision: 7, Now: 1700000060001},
+		{Op: opDel, Key: "2024-01-01T10:00:00Z"},
+		{Op: opSetNode, Key: "node1", RaftAddr: "localhost:21001", HTTPAddr: "localhost:8888"},
+		{Op: opDelNode, Key: "node1"},
+		{Op: opSetRole, Key: "app", Val: `{"name":"app","rules":[{"prefix":"app/","read":true}]}`},
+		{Op: opDelRole, Key: "app"},
+		{Op: opSetToken, Key: hashToken("dkv_secret"), Val: `{"name":"ci","roles":["app"]}`},
+		{Op: opDelToken, Key: "ci"},
+	}
+
+	for _, want := range cmds {
+		got, err := decodeCommand(encodeCommand(want))
+		if err != nil {
+			t.Fatalf("decode of %+v failed: %s", want, err)
+		}
+		if got != want {
+			t.Fatalf("round trip mismatch. Expected: %+v, got: %+v", want, got)
+		}
+	}
+}
+
+func TestDecodeLegacyCommand(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want command
+	}{
+		{raw: "command:SET,key:a,val:b", want: command{Op: opSet, Key: "a", Val: "b"}},
+		{raw: "command:SET,key:a,val:http://x", want: command{Op: opSet, Key: "a", Val: "http://x"}},
+		{raw: "command:DEL,key:a", want: command{Op: opDel, Key: "a"}},
+	}
+
+	for _, tt := range tests {
+		got, err := decodeCommand([]byte(tt.raw))
+		if err != nil {
+			t.Fatalf("decode of %q failed: %s", tt.raw, err)
+		}
+		if got != tt.want {
+			t.Fatalf("legacy decode mismatch. Expected: %+v, got: %+v", tt.want, got)
+		}
+	}
+}
+
+func TestDecodeInvalidCommand(t *testing.T) {
+	inputs := [][]byte{
+		nil,
+		{commandVersion},
+		{99, byte(opSet)},
+		{commandVersion, 42},
+		{commandVersion, byte(opSet), fieldKey, 10, 'a'},
+		[]byte("command:NOP,key:a"),
+	}
+
+	for _, in := range inputs {
+		if _, err := decodeCommand(in); !errors.Is(err, InvalidCommand) {
+			t.Fatalf("expected InvalidCommand for %v, got: %v", in, err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Consistency is the guarantee a read asks for.
+type Consistency string
+
+const (
+	// ConsistencyStale serves the read from the local FSM of whichever node
+	// received it. The result may lag behind the leader.
+	ConsistencyStale Consistency = "stale"
+	// ConsistencyLeaderLease serves the read on the leader without a quorum
+	// round trip as long as leadership was confirmed within the raft leader
+	// lease timeout.
+	ConsistencyLeaderLease Consistency = "leader-lease"
+	// ConsistencyLinearizable commits a raft barrier and re-confirms
+	// leadership with a quorum before reading from the leader's FSM.
+	ConsistencyLinearizable Consistency = "linearizable"
+)
+
+// LastAppliedIndexHeader reports the raft index of the last write applied to
+// the FSM that served a read.
+const LastAppliedIndexHeader = "X-DKV-Last-Applied-Index"
+
+var (
+	InvalidConsistency error = errors.New("invalid consistency level. Use stale, leader-lease or linearizable")
+)
+
+// ParseConsistency validates a consistency level. An empty string maps to stale.
+func ParseConsistency(level string) (Consistency, error) {
+	switch Consistency(level) {
+	case "", ConsistencyStale:
+		return ConsistencyStale, nil
+	case ConsistencyLeaderLease, ConsistencyLinearizable:
+		return Consistency(level), nil
+	default:
+		return "", fmt.Errorf("%w. Got: %q", InvalidConsistency, level)
+	}
+}
+
+// GetWithConsistency reads key after establishing the requested consistency
+// guarantee. Non-stale reads must run on the leader and fail with an error
+// wrapping NotLeader elsewhere.
+func (s *DKVService) GetWithConsistency(key string, level Consistency) (Entry, error) {
+	if err := s.establishConsistency(level); err != nil {
+		return Entry{}, err
+	}
+	return s.GetEntry(key)
+}
+
+// establishConsistency blocks until a local FSM read satisfies level.
+func (s *DKVService) establishConsistency(level Consistency) error {
+	if s.ServiceConfig.Debug || level == ConsistencyStale {
+		return nil
+	}
+
+	if err := s.checkLeader(); err != nil {
+		return err
+	}
+
+	switch level {
+	case ConsistencyLeaderLease:
+		if err := s.ensureReadBarrier(); err != nil {
+			return err
+		}
+		verifiedAt := time.Unix(0, s.leaseVerifiedAt.Load())
+		if time.Since(verifiedAt) > s.leaderLease {
+			return s.verifyLeader()
+		}
+		return nil
+	case ConsistencyLinearizable:
+		// The barrier makes the FSM reflect every entry committed before this
+		// read, verifying afterwards proves we were still leader at read time.
+		if err := s.raft.Barrier(s.ServiceConfig.RaftTimeout).Error(); err != nil {
+			return fmt.Errorf("%w. raft barrier failed: %s", LeaderNotReady, err)
+		}
+		s.readBarrierDone.Store(true)
+		return s.verifyLeader()
+	default:
+		return fmt.Errorf("%w. Got: %q", InvalidConsistency, level)
+	}
+}
+
+// ensureReadBarrier commits a barrier once per leadership term so the FSM has
+// applied everything the previous leader committed before serving lease reads.
+func (s *DKVService) ensureReadBarrier() error {
+	if s.readBarrierDone.Load() {
+		return nil
+	}
+	if err := s.raft.Barrier(s.ServiceConfig.RaftTimeout).Error(); err != nil {
+		return fmt.Errorf("%w. raft barrier failed: %s", LeaderNotReady, err)
+	}
+	s.readBarrierDone.Store(true)
+	return nil
+}
+
+// verifyLeader confirms leadership with a quorum and renews the read lease
+// from the moment the check started.
+func (s *DKVService) verifyLeader() error {
+	start := time.Now()
+	if err := s.raft.VerifyLeader().Error(); err != nil {
+		return fmt.Errorf("%w. leadership could not be verified: %s", NotLeader, err)
+	}
+	s.leaseVerifiedAt.Store(start.UnixNano())
+	return nil
+}
+
+// LastAppliedIndex returns the raft index of the last command applied to the FSM.
+func (s *DKVService) LastAppliedIndex() uint64 {
+	return s.appliedIndex.Load()
+}
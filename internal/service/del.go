@@ -21,12 +21,38 @@ func DelHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
 
 	key := chi.URLParam(r, "id")
 
-	_, err := dkvService.Delete(key)
+	if err := dkvService.Authorize(r, AccessWrite, key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// If-Match: * only requires the key to exist, which a plain delete
+	// checks too. Under any If-Match a missing key fails the precondition.
+	var err error
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && ifMatch != "*" {
+		revision, perr := parseETag(ifMatch)
+		if perr != nil {
+			http.Error(w, perr.Error(), http.StatusBadRequest)
+			return
+		}
+		err = dkvService.CompareAndDelete(key, revision)
+	} else {
+		_, err = dkvService.Delete(key)
+	}
 	if err != nil {
-		if errors.Is(err, LeaderNotReady) {
+		switch {
+		case errors.Is(err, NotLeader):
+			forwardToLeader(dkvService, w, r, nil)
+		case errors.Is(err, LeaderNotReady):
 			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case errors.Is(err, RevisionMismatch), ifMatch != "" && errors.Is(err, KeyNotFound):
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		case errors.Is(err, KeyNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
-		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 	resp := "key deleted successfully"
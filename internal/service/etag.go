@@ -0,0 +1,30 @@
+package service
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	InvalidETag error = errors.New("invalid If-Match header. Expected a quoted revision like \"42\" or *")
+)
+
+// formatETag renders a key revision as a strong HTTP entity tag.
+func formatETag(revision uint64) string {
+	return strconv.Quote(strconv.FormatUint(revision, 10))
+}
+
+// parseETag extracts the revision from an If-Match header value. Quotes are
+// optional so clients can send the bare revision too.
+func parseETag(etag string) (uint64, error) {
+	etag = strings.TrimSpace(etag)
+	if strings.HasPrefix(etag, "W/") {
+		return 0, InvalidETag
+	}
+	revision, err := strconv.ParseUint(strings.Trim(etag, `"`), 10, 64)
+	if err != nil {
+		return 0, InvalidETag
+	}
+	return revision, nil
+}
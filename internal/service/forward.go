@@ -0,0 +1,106 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+const (
+	// ForwardedByHeader carries the node ID of the follower that relayed a
+	// request to the leader. A request carrying it is never forwarded again.
+	ForwardedByHeader = "X-DKV-Forwarded-By"
+
+	ForwardModeProxy    = "proxy"
+	ForwardModeRedirect = "redirect"
+)
+
+var (
+	ForwardLoop error = errors.New("request was already forwarded once and this node is not the leader. please retry")
+)
+
+// newPeerClient builds the client used to call other nodes. With tlsConfig
+// set it speaks HTTPS and presents this node's certificate. dialTLS, when
+// set, makes the HTTPS connections instead.
+func newPeerClient(tlsConfig *tls.Config, dialTLS func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.DialTLSContext = dialTLS
+	return &http.Client{Transport: transport}
+}
+
+// newPeerRequest builds a request to path on the node whose HTTP API listens
+// on httpAddr. It carries the bootstrap token, so it passes auth there.
+func (s *DKVService) newPeerRequest(method, httpAddr, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, s.peerURL(httpAddr, path), body)
+	if err != nil {
+		return nil, err
+	}
+	if token := s.ServiceConfig.AuthBootstrapToken; token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// peerScheme is the scheme the HTTP API of other nodes is served on.
+func (s *DKVService) peerScheme() string {
+	if s.ServiceConfig.PeerTLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// peerURL is the URL of path on the node whose HTTP API listens on httpAddr.
+func (s *DKVService) peerURL(httpAddr, path string) string {
+	return (&url.URL{Scheme: s.peerScheme(), Host: httpAddr, Path: path}).String()
+}
+
+// forwardToLeader relays a write that hit a follower to the current leader.
+// Depending on ForwardMode the request is either proxied, or answered with a
+// 307 pointing at the leader so the client can repeat it there. body is the
+// already consumed request body, replayed towards the leader.
+func forwardToLeader(dkvService *DKVService, w http.ResponseWriter, r *http.Request, body []byte) {
+	if by := r.Header.Get(ForwardedByHeader); by != "" {
+		dkvService.logger.Error().Msgf("Refusing to forward request already forwarded by %s", by)
+		http.Error(w, ForwardLoop.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	leaderId, leaderHTTPAddr, err := dkvService.LeaderHTTPAddr()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	target := &url.URL{Scheme: dkvService.peerScheme(), Host: leaderHTTPAddr}
+	if dkvService.ServiceConfig.ForwardMode == ForwardModeRedirect {
+		location := target.String() + r.URL.RequestURI()
+		dkvService.logger.Info().Msgf("Redirecting %s %s to leader %s at %s", r.Method, r.URL.Path, leaderId, location)
+		http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+		return
+	}
+
+	dkvService.logger.Info().Msgf("Forwarding %s %s to leader %s at %s", r.Method, r.URL.Path, leaderId, leaderHTTPAddr)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	proxy := &httputil.ReverseProxy{
+		Transport: dkvService.peerClient.Transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			pr.Out.Header.Set(ForwardedByHeader, dkvService.ServiceConfig.RaftNodeID)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			dkvService.logger.Error().Msgf("Forwarding to leader %s failed. Error: %s", leaderId, err)
+			http.Error(w, fmt.Sprintf("unable to reach leader %s", leaderId), http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
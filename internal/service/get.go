@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/go-chi/chi"
 	"github.com/tomkaith13/dist-kv-store/internal/server"
@@ -24,22 +25,42 @@ func GetHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
 
 	key := chi.URLParam(r, "id")
 
+	if err := dkvService.Authorize(r, AccessRead, key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	if len(key) > dkvService.ServiceConfig.KeyMaxLen {
 		err := errors.New("key size exceeded")
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Dummy set
-	// dkvService.Set("asd", "def")
+	level := r.URL.Query().Get("consistency")
+	if level == "" {
+		level = dkvService.ServiceConfig.ReadConsistency
+	}
+	consistency, err := ParseConsistency(level)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// TODO: call store.Get()
-	val, err := dkvService.Get(key)
+	entry, err := dkvService.GetWithConsistency(key, consistency)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		switch {
+		case errors.Is(err, NotLeader):
+			forwardToLeader(dkvService, w, r, nil)
+		case errors.Is(err, KeyNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
 		return
 	}
-	resp := fmt.Sprintf("{ %q : %q }", key, val)
+	w.Header().Set(LastAppliedIndexHeader, strconv.FormatUint(dkvService.LastAppliedIndex(), 10))
+	w.Header().Set("ETag", formatETag(entry.Revision))
+	resp := fmt.Sprintf("{ %q : %q }", key, entry.Val)
 	w.Write([]byte(resp))
 	w.WriteHeader(http.StatusOK)
 }
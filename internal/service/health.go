@@ -0,0 +1,140 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+// Readiness is the answer of GET /readyz. Checks maps each check to "ok" or
+// the reason it failed.
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Status is the answer of GET /status.
+type Status struct {
+	NodeStatus
+	// LeaderHTTPAddr is where clients reach the leader's HTTP API. It is empty
+	// while no leader is known.
+	LeaderHTTPAddr  string `json:"leader_http_addr,omitempty"`
+	Term            uint64 `json:"term"`
+	CommitIndex     uint64 `json:"commit_index"`
+	FSMAppliedIndex uint64 `json:"fsm_applied_index"`
+	Keys            int    `json:"keys"`
+	Config          Config `json:"config"`
+}
+
+// Readiness tells whether this node can take part in serving requests: raft
+// knows a leader and this node applied the log up to within ReadyMaxLag
+// entries of the commit index. Debug mode has no raft and is never ready.
+func (s *DKVService) Readiness() Readiness {
+	readiness := Readiness{Ready: true, Checks: make(map[string]string)}
+	check := func(name string, failure string) {
+		if failure == "" {
+			readiness.Checks[name] = "ok"
+			return
+		}
+		readiness.Ready = false
+		readiness.Checks[name] = failure
+	}
+
+	if s.ServiceConfig.Debug {
+		check("raft", RaftDisabled.Error())
+		return readiness
+	}
+	check("raft", "")
+
+	leaderAddr, leaderId := s.raft.LeaderWithID()
+	if leaderAddr == "" || leaderId == "" {
+		check("leader", LeaderNotReady.Error())
+	} else {
+		check("leader", "")
+	}
+
+	applied, commit := s.raft.AppliedIndex(), s.raft.CommitIndex()
+	if applied+s.ServiceConfig.ReadyMaxLag < commit {
+		check("applied_index", fmt.Sprintf("applied index %d trails commit index %d by more than %d",
+			applied, commit, s.ServiceConfig.ReadyMaxLag))
+	} else {
+		check("applied_index", "")
+	}
+	return readiness
+}
+
+// Status reports the raft view of this node along with its effective config.
+func (s *DKVService) Status() Status {
+	status := Status{
+		FSMAppliedIndex: s.appliedIndex.Load(),
+		Keys:            s.KeyCount(),
+		Config:          s.ServiceConfig,
+	}
+	if s.ServiceConfig.Debug {
+		status.ID = s.ServiceConfig.RaftNodeID
+		status.State = "Debug"
+		return status
+	}
+
+	status.NodeStatus, _ = s.LocalStatus()
+	if _, leaderHTTPAddr, err := s.LeaderHTTPAddr(); err == nil {
+		status.LeaderHTTPAddr = leaderHTTPAddr
+	}
+	status.CommitIndex = s.raft.CommitIndex()
+	status.Term, _ = strconv.ParseUint(s.raft.Stats()["term"], 10, 64)
+	return status
+}
+
+// HealthzHandler answers GET /healthz. It only tells the process is up.
+func HealthzHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// ReadyzHandler answers GET /readyz with a 200 when the node is ready and a
+// 503 otherwise, listing the result of every check.
+func ReadyzHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	readiness := dkvService.Readiness()
+	b, err := json.Marshal(readiness)
+	if err != nil {
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if readiness.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
+
+// StatusHandler answers GET /status with the Status of the node that got the
+// request. It is never forwarded.
+func StatusHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(dkvService.Status())
+	if err != nil {
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/router"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+func TestProbesAndStatus(t *testing.T) {
+	config := router.Config{
+		RequestTimeout: 60 * time.Second,
+	}
+	sConfig := server.Config{
+		Address:         "localhost:9999",
+		ShutdownTimeout: time.Second * 5,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+
+	debugService := New(zlogger, Config{
+		KeyMaxLen:  100,
+		ValMaxLen:  200,
+		MaxMapSize: 1000,
+		RaftNodeID: "debug",
+		Debug:      true,
+	})
+	raftService := New(zlogger, Config{
+		KeyMaxLen:    100,
+		ValMaxLen:    200,
+		MaxMapSize:   1000,
+		RaftNodeID:   "1",
+		RaftAddr:     "localhost:23801",
+		HTTPAddr:     "localhost:9999",
+		RaftStoreDir: t.TempDir(),
+		RaftTimeout:  5 * time.Second,
+		RaftLeader:   true,
+	})
+	defer raftService.Shutdown()
+	if _, err := raftService.Set("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(kv_service *DKVService, path string) *httptest.ResponseRecorder {
+		router := router.New(config, zlogger)
+		httpServer := server.New(zlogger, router.GetRouter(), sConfig, kv_service)
+		httpServer.AddHandler(server.GET, "/healthz", HealthzHandler)
+		httpServer.AddHandler(server.GET, "/readyz", ReadyzHandler)
+		httpServer.AddHandler(server.GET, "/status", StatusHandler)
+
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		httpServer.GetRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name       string
+		kv_service *DKVService
+		path       string
+		want       int
+	}{
+		{name: "healthz in debug mode", kv_service: debugService, path: "/healthz", want: http.StatusOK},
+		{name: "readyz in debug mode", kv_service: debugService, path: "/readyz", want: http.StatusServiceUnavailable},
+		{name: "healthz on the leader", kv_service: raftService, path: "/healthz", want: http.StatusOK},
+		{name: "readyz on the leader", kv_service: raftService, path: "/readyz", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rr := get(tt.kv_service, tt.path); rr.Code != tt.want {
+			t.Fatalf("%s. Expected: %d, got: %d body: %s", tt.name, tt.want, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := get(raftService, "/status")
+	var status Status
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.ID != "1" || status.State != "Leader" || status.LeaderID != "1" || status.Role != RoleVoter {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	if status.Term == 0 || status.CommitIndex == 0 || status.FSMAppliedIndex == 0 || status.Keys != 1 {
+		t.Fatalf("unexpected status indices: %+v", status)
+	}
+	if status.Config.RaftAddr != "localhost:23801" {
+		t.Fatalf("status is missing the config: %+v", status.Config)
+	}
+
+	// the leader records its own address right after winning the election.
+	deadline := time.Now().Add(5 * time.Second)
+	for raftService.Status().LeaderHTTPAddr != "localhost:9999" {
+		if time.Now().After(deadline) {
+			t.Fatalf("status does not name the leader address: %+v", raftService.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
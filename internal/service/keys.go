@@ -0,0 +1,193 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+var (
+	InvalidListRequest error = errors.New("invalid list request")
+)
+
+// ListOptions selects a sorted range of keys. Prefix and the [Start, End)
+// range can be combined, in which case a key has to satisfy both. An empty
+// End means no upper bound.
+type ListOptions struct {
+	Prefix string
+	Start  string
+	End    string
+	// Limit caps the number of keys returned. 0 uses the default of 100.
+	Limit int
+	// Values includes the values in the result, not just keys and revisions.
+	Values bool
+	// Continue is the token returned as Next by the previous page.
+	Continue string
+}
+
+// ListedKey is one key of a list result.
+type ListedKey struct {
+	Key      string `json:"key"`
+	Val      string `json:"value,omitempty"`
+	Revision uint64 `json:"revision"`
+}
+
+// ListResult is a page of keys in ascending order. Next is empty on the last
+// page, otherwise it is passed back as ListOptions.Continue.
+type ListResult struct {
+	Keys []ListedKey `json:"keys"`
+	Next string      `json:"next,omitempty"`
+}
+
+// List returns the keys matching opts from the local FSM. Expired keys that
+// were not reaped yet are skipped.
+func (s *DKVService) List(opts ListOptions) (ListResult, error) {
+	if opts.Limit == 0 {
+		opts.Limit = defaultListLimit
+	}
+	if opts.Limit < 0 || opts.Limit > maxListLimit {
+		return ListResult{}, fmt.Errorf("%w: limit must be between 1 and %d", InvalidListRequest, maxListLimit)
+	}
+
+	// Start from the highest of the range start, the prefix and the key right
+	// after the last one of the previous page.
+	from := opts.Start
+	if opts.Prefix > from {
+		from = opts.Prefix
+	}
+	if opts.Continue != "" {
+		last, err := base64.RawURLEncoding.DecodeString(opts.Continue)
+		if err != nil {
+			return ListResult{}, fmt.Errorf("%w: malformed continuation token", InvalidListRequest)
+		}
+		if after := string(last) + "\x00"; after > from {
+			from = after
+		}
+	}
+
+	now := time.Now().UnixMilli()
+	result := ListResult{Keys: []ListedKey{}}
+	it := s.tree().Root().Iterator()
+	it.SeekLowerBound([]byte(from))
+	for k, v, ok := it.Next(); ok; k, v, ok = it.Next() {
+		key := string(k)
+		if opts.End != "" && key >= opts.End {
+			break
+		}
+		if !strings.HasPrefix(key, opts.Prefix) {
+			break
+		}
+		entry := v.(Entry)
+		if entry.expiredAt(now) {
+			continue
+		}
+		if len(result.Keys) == opts.Limit {
+			last := result.Keys[len(result.Keys)-1].Key
+			result.Next = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+
+		listed := ListedKey{Key: key, Revision: entry.Revision}
+		if opts.Values {
+			listed.Val = entry.Val
+		}
+		result.Keys = append(result.Keys, listed)
+	}
+	return result, nil
+}
+
+// ListWithConsistency is List run after establishing the requested
+// consistency guarantee, the same way GetWithConsistency does for one key.
+func (s *DKVService) ListWithConsistency(opts ListOptions, level Consistency) (ListResult, error) {
+	if err := s.establishConsistency(level); err != nil {
+		return ListResult{}, err
+	}
+	return s.List(opts)
+}
+
+// KeysHandler lists keys in sorted order:
+//
+//	GET /keys?prefix=user/&limit=50&values=true
+//	GET /keys?start=a&end=m&continue=<next>
+func KeysHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	opts := ListOptions{
+		Prefix:   query.Get("prefix"),
+		Start:    query.Get("start"),
+		End:      query.Get("end"),
+		Continue: query.Get("continue"),
+	}
+	// a listing is only allowed on a prefix the token may read as a whole.
+	if err := dkvService.Authorize(r, AccessRead, opts.Prefix); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: limit must be a number", InvalidListRequest), http.StatusBadRequest)
+			return
+		}
+		opts.Limit = n
+	}
+	if values := query.Get("values"); values != "" {
+		b, err := strconv.ParseBool(values)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: values must be true or false", InvalidListRequest), http.StatusBadRequest)
+			return
+		}
+		opts.Values = b
+	}
+
+	level := query.Get("consistency")
+	if level == "" {
+		level = dkvService.ServiceConfig.ReadConsistency
+	}
+	consistency, err := ParseConsistency(level)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := dkvService.ListWithConsistency(opts, consistency)
+	if err != nil {
+		switch {
+		case errors.Is(err, NotLeader):
+			forwardToLeader(dkvService, w, r, nil)
+		case errors.Is(err, InvalidListRequest):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(LastAppliedIndexHeader, strconv.FormatUint(dkvService.LastAppliedIndex(), 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
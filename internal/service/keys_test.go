@@ -0,0 +1,112 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/router"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+func TestKeysHandler(t *testing.T) {
+	config := router.Config{
+		RequestTimeout: 60 * time.Second,
+	}
+	sConfig := server.Config{
+		Address:         "localhost:9999",
+		ShutdownTimeout: time.Second * 5,
+	}
+	serviceConfig := Config{
+		KeyMaxLen:  100,
+		ValMaxLen:  200,
+		MaxMapSize: 1000,
+		RaftNodeID: "1",
+		Debug:      true,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+	router := router.New(config, zlogger)
+	kv_service := New(zlogger, serviceConfig)
+	httpServer := server.New(zlogger, router.GetRouter(), sConfig, kv_service)
+
+	httpServer.AddHandler(server.GET, "/keys", KeysHandler)
+
+	for _, key := range []string{"user/3", "a", "user/1", "user/2", "z", "user/10"} {
+		if _, err := kv_service.Set(key, "v-"+key); err != nil {
+			t.Fatalf("Set %s failed: %v", key, err)
+		}
+	}
+	if _, _, err := kv_service.Put("user/0", "gone", WriteUpsert, time.Millisecond); err != nil {
+		t.Fatalf("Put with TTL failed: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	list := func(query string) ListResult {
+		req, err := http.NewRequest("GET", "/keys?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		httpServer.GetRouter().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET /keys?%s failed. Expected: %d, got: %d", query, http.StatusOK, rr.Code)
+		}
+		var result ListResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	keys := func(result ListResult) []string {
+		out := []string{}
+		for _, k := range result.Keys {
+			out = append(out, k.Key)
+		}
+		return out
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "", want: []string{"a", "user/1", "user/10", "user/2", "user/3", "z"}},
+		{query: "prefix=user/", want: []string{"user/1", "user/10", "user/2", "user/3"}},
+		{query: "start=user/10&end=user/3", want: []string{"user/10", "user/2"}},
+		{query: "prefix=user/&start=b&end=user/2", want: []string{"user/1", "user/10"}},
+	}
+	for _, tt := range tests {
+		if got := keys(list(tt.query)); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("GET /keys?%s. Expected: %v, got: %v", tt.query, tt.want, got)
+		}
+	}
+
+	var paged []string
+	result := list("prefix=user/&limit=3&values=true")
+	if result.Keys[0].Val != "v-user/1" {
+		t.Fatalf("values=true did not return values. got: %+v", result.Keys[0])
+	}
+	paged = append(paged, keys(result)...)
+	for result.Next != "" {
+		result = list("prefix=user/&limit=3&continue=" + result.Next)
+		paged = append(paged, keys(result)...)
+	}
+	if want := []string{"user/1", "user/10", "user/2", "user/3"}; !reflect.DeepEqual(paged, want) {
+		t.Fatalf("paging failed. Expected: %v, got: %v", want, paged)
+	}
+
+	req, _ := http.NewRequest("GET", "/keys?limit=5000", nil)
+	rr := httptest.NewRecorder()
+	httpServer.GetRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("limit over max. Expected: %d, got: %d", http.StatusBadRequest, rr.Code)
+	}
+}
@@ -0,0 +1,511 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/raft"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+var (
+	MemberNotFound error = errors.New("node is not a member of the cluster")
+	RaftDisabled   error = errors.New("raft is disabled in debug mode")
+
+	InvalidTransferTarget error = errors.New("leadership can only be transferred to a voter")
+	InvalidRole           error = errors.New("invalid raft role. Use voter or nonvoter")
+	NotCaughtUp           error = errors.New("nonvoter has not caught up with the leader yet")
+	NodeUnreachable       error = errors.New("node could not be reached over HTTP")
+	RemovingLeader        error = errors.New("the leader cannot remove itself. Transfer leadership first, then remove the node on the new leader")
+)
+
+// Roles a node can join the cluster with.
+const (
+	RoleVoter    = "voter"
+	RoleNonvoter = "nonvoter"
+)
+
+// ParseRole validates a raft role. An empty string maps to voter.
+func ParseRole(role string) (string, error) {
+	switch role {
+	case "", RoleVoter:
+		return RoleVoter, nil
+	case RoleNonvoter:
+		return RoleNonvoter, nil
+	default:
+		return "", fmt.Errorf("%w. Got: %q", InvalidRole, role)
+	}
+}
+
+// roleOf maps a raft suffrage to a role. Staging servers are on their way to
+// become voters.
+func roleOf(suffrage raft.ServerSuffrage) string {
+	if suffrage == raft.Nonvoter {
+		return RoleNonvoter
+	}
+	return RoleVoter
+}
+
+// Member describes one server of the raft configuration as seen by the
+// leader. LastContact is only known for followers the leader currently fails
+// to heartbeat, as raft does not expose it otherwise.
+type Member struct {
+	ID          string     `json:"id"`
+	RaftAddr    string     `json:"raft_addr"`
+	HTTPAddr    string     `json:"http_addr,omitempty"`
+	Suffrage    string     `json:"suffrage"`
+	Role        string     `json:"role"`
+	Leader      bool       `json:"leader"`
+	Healthy     bool       `json:"healthy"`
+	LastContact *time.Time `json:"last_contact,omitempty"`
+}
+
+// observeHeartbeats follows the leader's heartbeat failures so Members can
+// report which followers are unreachable and since when.
+func (s *DKVService) observeHeartbeats() {
+	s.unreachable = make(map[raft.ServerID]time.Time)
+	ch := make(chan raft.Observation, 16)
+	s.raft.RegisterObserver(raft.NewObserver(ch, false, func(o *raft.Observation) bool {
+		switch o.Data.(type) {
+		case raft.FailedHeartbeatObservation, raft.ResumedHeartbeatObservation, raft.PeerObservation, raft.RaftState:
+			return true
+		}
+		return false
+	}))
+
+	go func() {
+		for o := range ch {
+			s.healthMu.Lock()
+			switch data := o.Data.(type) {
+			case raft.FailedHeartbeatObservation:
+				s.unreachable[data.PeerID] = data.LastContact
+			case raft.ResumedHeartbeatObservation:
+				delete(s.unreachable, data.PeerID)
+			case raft.PeerObservation:
+				if data.Removed {
+					delete(s.unreachable, data.Peer.ID)
+				}
+			case raft.RaftState:
+				// heartbeat tracking starts over with every leadership term.
+				clear(s.unreachable)
+			}
+			s.healthMu.Unlock()
+		}
+	}()
+}
+
+// Members lists the raft configuration. Must run on the leader.
+func (s *DKVService) Members() ([]Member, error) {
+	if s.ServiceConfig.Debug {
+		return nil, RaftDisabled
+	}
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	_, leaderId := s.raft.LeaderWithID()
+
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+
+	var members []Member
+	for _, srv := range future.Configuration().Servers {
+		meta, _ := s.NodeMeta(string(srv.ID))
+		member := Member{
+			ID:       string(srv.ID),
+			RaftAddr: string(srv.Address),
+			HTTPAddr: meta.HTTPAddr,
+			Suffrage: srv.Suffrage.String(),
+			Role:     roleOf(srv.Suffrage),
+			Leader:   srv.ID == leaderId,
+			Healthy:  true,
+		}
+		if lastContact, ok := s.unreachable[srv.ID]; ok {
+			member.Healthy = false
+			member.LastContact = &lastContact
+		}
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members, nil
+}
+
+// findMember returns the raft configuration entry of nodeID.
+func (s *DKVService) findMember(nodeID string) (raft.Server, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return raft.Server{}, err
+	}
+	for _, srv := range future.Configuration().Servers {
+		if srv.ID == raft.ServerID(nodeID) {
+			return srv, nil
+		}
+	}
+	return raft.Server{}, fmt.Errorf("%w. NodeID: %s", MemberNotFound, nodeID)
+}
+
+// RemoveMember takes nodeID out of the raft configuration and drops its
+// replicated addresses. Must run on the leader, and nodeID must not be the
+// leader: it would step down before its addresses could be dropped.
+func (s *DKVService) RemoveMember(nodeID string) error {
+	if s.ServiceConfig.Debug {
+		return RaftDisabled
+	}
+	if err := s.checkLeader(); err != nil {
+		return err
+	}
+	if nodeID == s.ServiceConfig.RaftNodeID {
+		return RemovingLeader
+	}
+	if _, err := s.findMember(nodeID); err != nil {
+		return err
+	}
+
+	if err := s.raft.RemoveServer(raft.ServerID(nodeID), 0, s.ServiceConfig.RaftTimeout).Error(); err != nil {
+		s.logger.Error().Msgf("Unable to remove NodeID %s from the raft config. Error: %s", nodeID, err)
+		return err
+	}
+	s.logger.Info().Msgf("NodeID %s removed from the raft config", nodeID)
+
+	if _, ok := s.NodeMeta(nodeID); ok {
+		cmd := encodeCommand(command{Op: opDelNode, Key: nodeID})
+		if err := s.raft.Apply(cmd, s.ServiceConfig.RaftTimeout).Error(); err != nil {
+			s.logger.Error().Msgf("Unable to drop node metadata for NodeID %s. Error: %s", nodeID, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// DemoteMember turns the voter nodeID into a nonvoter that keeps replicating
+// the log without taking part in elections. Must run on the leader.
+func (s *DKVService) DemoteMember(nodeID string) error {
+	if s.ServiceConfig.Debug {
+		return RaftDisabled
+	}
+	if err := s.checkLeader(); err != nil {
+		return err
+	}
+	srv, err := s.findMember(nodeID)
+	if err != nil {
+		return err
+	}
+	if srv.Suffrage != raft.Voter {
+		return nil
+	}
+
+	if err := s.raft.DemoteVoter(raft.ServerID(nodeID), 0, s.ServiceConfig.RaftTimeout).Error(); err != nil {
+		s.logger.Error().Msgf("Unable to demote NodeID %s. Error: %s", nodeID, err)
+		return err
+	}
+	s.logger.Info().Msgf("NodeID %s demoted to nonvoter", nodeID)
+	return nil
+}
+
+// NodeStatus is the raft view of the node answering the request.
+type NodeStatus struct {
+	ID           string `json:"id"`
+	Role         string `json:"role"`
+	State        string `json:"state"`
+	LeaderID     string `json:"leader_id"`
+	AppliedIndex uint64 `json:"applied_index"`
+	LastLogIndex uint64 `json:"last_log_index"`
+}
+
+// LocalStatus reports the raft state of this node.
+func (s *DKVService) LocalStatus() (NodeStatus, error) {
+	if s.ServiceConfig.Debug {
+		return NodeStatus{}, RaftDisabled
+	}
+
+	_, leaderId := s.raft.LeaderWithID()
+	status := NodeStatus{
+		ID:           s.ServiceConfig.RaftNodeID,
+		Role:         RoleVoter,
+		State:        s.raft.State().String(),
+		LeaderID:     string(leaderId),
+		AppliedIndex: s.raft.AppliedIndex(),
+		LastLogIndex: s.raft.LastIndex(),
+	}
+	if srv, err := s.findMember(status.ID); err == nil {
+		status.Role = roleOf(srv.Suffrage)
+	}
+	return status, nil
+}
+
+// fetchNodeStatus asks the node listening on httpAddr for its NodeStatus.
+func (s *DKVService) fetchNodeStatus(httpAddr string) (NodeStatus, error) {
+	client := &http.Client{Transport: s.peerClient.Transport, Timeout: s.ServiceConfig.RaftTimeout}
+	req, err := s.newPeerRequest(http.MethodGet, httpAddr, "/cluster/node", nil)
+	if err != nil {
+		return NodeStatus{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return NodeStatus{}, fmt.Errorf("%w. %s", NodeUnreachable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return NodeStatus{}, fmt.Errorf("%w. GET /cluster/node answered %d", NodeUnreachable, resp.StatusCode)
+	}
+
+	var status NodeStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return NodeStatus{}, fmt.Errorf("%w. %s", NodeUnreachable, err)
+	}
+	return status, nil
+}
+
+// PromoteMember turns the nonvoter nodeID into a voter once it applied the
+// log up to within RaftPromoteMaxLag entries of the leader. Must run on the
+// leader.
+func (s *DKVService) PromoteMember(nodeID string) error {
+	if s.ServiceConfig.Debug {
+		return RaftDisabled
+	}
+	if err := s.checkLeader(); err != nil {
+		return err
+	}
+	srv, err := s.findMember(nodeID)
+	if err != nil {
+		return err
+	}
+	if srv.Suffrage != raft.Nonvoter {
+		return nil
+	}
+
+	meta, ok := s.NodeMeta(nodeID)
+	if !ok || meta.HTTPAddr == "" {
+		return fmt.Errorf("%w. No HTTP address is known for NodeID %s", NodeUnreachable, nodeID)
+	}
+	status, err := s.fetchNodeStatus(meta.HTTPAddr)
+	if err != nil {
+		return err
+	}
+	leaderIndex := s.raft.AppliedIndex()
+	if status.AppliedIndex+s.ServiceConfig.RaftPromoteMaxLag < leaderIndex {
+		return fmt.Errorf("%w. NodeID %s applied index %d, leader is at %d",
+			NotCaughtUp, nodeID, status.AppliedIndex, leaderIndex)
+	}
+
+	if err := s.raft.AddVoter(srv.ID, srv.Address, 0, s.ServiceConfig.RaftTimeout).Error(); err != nil {
+		s.logger.Error().Msgf("Unable to promote NodeID %s. Error: %s", nodeID, err)
+		return err
+	}
+	s.logger.Info().Msgf("NodeID %s promoted to voter", nodeID)
+	return nil
+}
+
+// writeMembershipError maps the errors of the membership operations to HTTP
+// responses, forwarding to the leader when this node is a follower.
+func writeMembershipError(dkvService *DKVService, w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, NotLeader):
+		forwardToLeader(dkvService, w, r, nil)
+	case errors.Is(err, MemberNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, NotCaughtUp), errors.Is(err, RemovingLeader):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, NodeUnreachable):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	case errors.Is(err, RaftDisabled), errors.Is(err, LeaderNotReady):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ListMembersHandler answers GET /cluster/members with the raft configuration.
+func ListMembersHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	members, err := dkvService.Members()
+	if err != nil {
+		writeMembershipError(dkvService, w, r, err)
+		return
+	}
+
+	b, err := json.Marshal(members)
+	if err != nil {
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// RemoveMemberHandler answers DELETE /cluster/members/{id}.
+func RemoveMemberHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	if err := dkvService.RemoveMember(chi.URLParam(r, "id")); err != nil {
+		writeMembershipError(dkvService, w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("removed"))
+}
+
+// DemoteMemberHandler answers POST /cluster/members/{id}/demote.
+func DemoteMemberHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	if err := dkvService.DemoteMember(chi.URLParam(r, "id")); err != nil {
+		writeMembershipError(dkvService, w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("demoted"))
+}
+
+// PromoteMemberHandler answers POST /cluster/members/{id}/promote.
+func PromoteMemberHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	if err := dkvService.PromoteMember(chi.URLParam(r, "id")); err != nil {
+		writeMembershipError(dkvService, w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("promoted"))
+}
+
+// NodeStatusHandler answers GET /cluster/node with the raft state of the node
+// that got the request. It is never forwarded.
+func NodeStatusHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	status, err := dkvService.LocalStatus()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// TransferLeadershipRequest optionally names the voter that should take over.
+type TransferLeadershipRequest struct {
+	TargetId string `json:"target_id"`
+}
+
+// TransferLeadership hands leadership to targetID, or to the most up to date
+// voter when targetID is empty, and returns the ID of the new leader if it is
+// already known. Must run on the leader.
+func (s *DKVService) TransferLeadership(targetID string) (string, error) {
+	if s.ServiceConfig.Debug {
+		return "", RaftDisabled
+	}
+	if err := s.checkLeader(); err != nil {
+		return "", err
+	}
+
+	var future raft.Future
+	if targetID == "" {
+		future = s.raft.LeadershipTransfer()
+	} else {
+		srv, err := s.findMember(targetID)
+		if err != nil {
+			return "", err
+		}
+		if srv.Suffrage != raft.Voter {
+			return "", fmt.Errorf("%w. NodeID %s is a %s", InvalidTransferTarget, targetID, srv.Suffrage)
+		}
+		future = s.raft.LeadershipTransferToServer(srv.ID, srv.Address)
+	}
+	if err := future.Error(); err != nil {
+		s.logger.Error().Msgf("Leadership transfer failed. Error: %s", err)
+		return "", err
+	}
+
+	_, leaderId := s.raft.LeaderWithID()
+	s.logger.Info().Msgf("Leadership transferred. New leader: %q", leaderId)
+	return string(leaderId), nil
+}
+
+// TransferLeadershipHandler answers POST /cluster/leader/transfer. The body is
+// optional; without a target_id raft picks the most up to date voter.
+func TransferLeadershipHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	var reqBody TransferLeadershipRequest
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &reqBody); err != nil {
+			http.Error(w, "Unable to decode body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	leaderId, err := dkvService.TransferLeadership(reqBody.TargetId)
+	if err != nil {
+		switch {
+		case errors.Is(err, NotLeader):
+			forwardToLeader(dkvService, w, r, body)
+		case errors.Is(err, InvalidTransferTarget):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, raft.ErrLeadershipTransferInProgress):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			writeMembershipError(dkvService, w, r, err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("leadership transferred to %q", leaderId)))
+}
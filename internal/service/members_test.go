@@ -0,0 +1,327 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/router"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+func TestRaftMembershipAdmin(t *testing.T) {
+	config := router.Config{
+		RequestTimeout: 60 * time.Second,
+	}
+	sConfig := server.Config{
+		Address:         "localhost:9999",
+		ShutdownTimeout: time.Second * 5,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+
+	// the leader's HTTP API has to be reachable for the follower to register.
+	leaderRouter := router.New(config, zlogger)
+	ts := httptest.NewServer(leaderRouter.GetRouter())
+	defer ts.Close()
+	leaderHTTPAddr := ts.Listener.Addr().String()
+
+	leader := New(zlogger, Config{
+		KeyMaxLen:    100,
+		ValMaxLen:    200,
+		MaxMapSize:   1000,
+		RaftNodeID:   "1",
+		RaftAddr:     "localhost:23401",
+		RaftStoreDir: t.TempDir(),
+		RaftTimeout:  5 * time.Second,
+		RaftLeader:   true,
+		HTTPAddr:     leaderHTTPAddr,
+	})
+	httpServer := server.New(zlogger, leaderRouter.GetRouter(), sConfig, leader)
+	httpServer.AddHandler(server.POST, "/register-follower", RegisterFollowerHandler)
+	httpServer.AddHandler(server.GET, "/cluster/members", ListMembersHandler)
+	httpServer.AddHandler(server.DELETE, "/cluster/members/{id}", RemoveMemberHandler)
+	httpServer.AddHandler(server.POST, "/cluster/members/{id}/demote", DemoteMemberHandler)
+
+	follower := New(zlogger, Config{
+		KeyMaxLen:    100,
+		ValMaxLen:    200,
+		MaxMapSize:   1000,
+		RaftNodeID:   "2",
+		RaftAddr:     "localhost:23402",
+		RaftStoreDir: t.TempDir(),
+		RaftTimeout:  5 * time.Second,
+		RaftJoinAddr: []string{leaderHTTPAddr},
+		HTTPAddr:     "localhost:23412",
+	})
+	defer leader.Shutdown()
+	defer follower.Shutdown()
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		httpServer.GetRouter().ServeHTTP(rr, req)
+		return rr
+	}
+	members := func() map[string]Member {
+		rr := do("GET", "/cluster/members")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET /cluster/members failed. Expected: %d, got: %d", http.StatusOK, rr.Code)
+		}
+		var list []Member
+		if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		byID := make(map[string]Member)
+		for _, m := range list {
+			byID[m.ID] = m
+		}
+		return byID
+	}
+
+	got := members()
+	if len(got) != 2 || !got["1"].Leader || got["2"].Leader {
+		t.Fatalf("unexpected members: %+v", got)
+	}
+	if got["2"].Suffrage != "Voter" || got["2"].RaftAddr != "localhost:23402" || got["2"].HTTPAddr != "localhost:23412" {
+		t.Fatalf("unexpected follower entry: %+v", got["2"])
+	}
+
+	if rr := do("POST", "/cluster/members/2/demote"); rr.Code != http.StatusOK {
+		t.Fatalf("demote failed. Expected: %d, got: %d", http.StatusOK, rr.Code)
+	}
+	if got := members(); got["2"].Suffrage != "Nonvoter" {
+		t.Fatalf("demote did not take effect: %+v", got["2"])
+	}
+
+	if rr := do("DELETE", "/cluster/members/1"); rr.Code != http.StatusConflict {
+		t.Fatalf("remove of the leader. Expected: %d, got: %d", http.StatusConflict, rr.Code)
+	}
+	if rr := do("DELETE", "/cluster/members/3"); rr.Code != http.StatusNotFound {
+		t.Fatalf("remove of unknown member. Expected: %d, got: %d", http.StatusNotFound, rr.Code)
+	}
+	if rr := do("DELETE", "/cluster/members/2"); rr.Code != http.StatusOK {
+		t.Fatalf("remove failed. Expected: %d, got: %d", http.StatusOK, rr.Code)
+	}
+	if got := members(); len(got) != 1 {
+		t.Fatalf("remove did not take effect: %+v", got)
+	}
+	if _, ok := leader.NodeMeta("2"); ok {
+		t.Fatal("node metadata of the removed member was kept")
+	}
+}
+
+func TestRaftLeadershipTransferAndShutdown(t *testing.T) {
+	config := router.Config{
+		RequestTimeout: 60 * time.Second,
+	}
+	sConfig := server.Config{
+		Address:         "localhost:9999",
+		ShutdownTimeout: time.Second * 5,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+
+	leaderRouter := router.New(config, zlogger)
+	ts := httptest.NewServer(leaderRouter.GetRouter())
+	defer ts.Close()
+	leaderHTTPAddr := ts.Listener.Addr().String()
+
+	leader := New(zlogger, Config{
+		KeyMaxLen:    100,
+		ValMaxLen:    200,
+		MaxMapSize:   1000,
+		RaftNodeID:   "1",
+		RaftAddr:     "localhost:23501",
+		RaftStoreDir: t.TempDir(),
+		RaftTimeout:  5 * time.Second,
+		RaftLeader:   true,
+		HTTPAddr:     leaderHTTPAddr,
+	})
+	httpServer := server.New(zlogger, leaderRouter.GetRouter(), sConfig, leader)
+	httpServer.AddHandler(server.POST, "/register-follower", RegisterFollowerHandler)
+	httpServer.AddHandler(server.POST, "/cluster/leader/transfer", TransferLeadershipHandler)
+
+	follower := New(zlogger, Config{
+		KeyMaxLen:    100,
+		ValMaxLen:    200,
+		MaxMapSize:   1000,
+		RaftNodeID:   "2",
+		RaftAddr:     "localhost:23502",
+		RaftStoreDir: t.TempDir(),
+		RaftTimeout:  5 * time.Second,
+		RaftJoinAddr: []string{leaderHTTPAddr},
+	})
+
+	waitForLeader := func(s *DKVService) {
+		deadline := time.Now().Add(5 * time.Second)
+		for s.raft.State() != raft.Leader {
+			if time.Now().After(deadline) {
+				t.Fatalf("NodeID %s did not become leader", s.ServiceConfig.RaftNodeID)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// only a voter that caught up on the configuration can win the election.
+	deadline := time.Now().Add(5 * time.Second)
+	for follower.raft.AppliedIndex() < leader.raft.AppliedIndex() {
+		if time.Now().After(deadline) {
+			t.Fatal("follower did not catch up with the leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req, err := http.NewRequest("POST", "/cluster/leader/transfer", strings.NewReader(`{"target_id": "3"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	httpServer.GetRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("transfer to unknown node. Expected: %d, got: %d", http.StatusNotFound, rr.Code)
+	}
+
+	req, err = http.NewRequest("POST", "/cluster/leader/transfer", strings.NewReader(`{"target_id": "2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	httpServer.GetRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("transfer failed. Expected: %d, got: %d body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	waitForLeader(follower)
+
+	// a leader shutting down hands leadership back before leaving.
+	if err := follower.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %s", err)
+	}
+	waitForLeader(leader)
+
+	if err := leader.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %s", err)
+	}
+}
+
+func TestRaftNonvoterPromotion(t *testing.T) {
+	config := router.Config{
+		RequestTimeout: 60 * time.Second,
+	}
+	sConfig := server.Config{
+		Address:         "localhost:9999",
+		ShutdownTimeout: time.Second * 5,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+
+	leaderRouter := router.New(config, zlogger)
+	leaderTS := httptest.NewServer(leaderRouter.GetRouter())
+	defer leaderTS.Close()
+	leaderHTTPAddr := leaderTS.Listener.Addr().String()
+
+	leader := New(zlogger, Config{
+		KeyMaxLen:    100,
+		ValMaxLen:    200,
+		MaxMapSize:   1000,
+		RaftNodeID:   "1",
+		RaftAddr:     "localhost:23601",
+		RaftStoreDir: t.TempDir(),
+		RaftTimeout:  5 * time.Second,
+		RaftLeader:   true,
+		HTTPAddr:     leaderHTTPAddr,
+	})
+	httpServer := server.New(zlogger, leaderRouter.GetRouter(), sConfig, leader)
+	httpServer.AddHandler(server.POST, "/register-follower", RegisterFollowerHandler)
+	httpServer.AddHandler(server.GET, "/cluster/members", ListMembersHandler)
+	httpServer.AddHandler(server.POST, "/cluster/members/{id}/promote", PromoteMemberHandler)
+
+	// the leader asks the replica how far it got before promoting it.
+	replicaRouter := router.New(config, zlogger)
+	replicaTS := httptest.NewServer(replicaRouter.GetRouter())
+	defer replicaTS.Close()
+	replica := New(zlogger, Config{
+		KeyMaxLen:    100,
+		ValMaxLen:    200,
+		MaxMapSize:   1000,
+		RaftNodeID:   "2",
+		RaftAddr:     "localhost:23602",
+		RaftStoreDir: t.TempDir(),
+		RaftTimeout:  5 * time.Second,
+		RaftJoinAddr: []string{leaderHTTPAddr},
+		RaftRole:     RoleNonvoter,
+		HTTPAddr:     replicaTS.Listener.Addr().String(),
+	})
+	defer leader.Shutdown()
+	defer replica.Shutdown()
+	replicaServer := server.New(zlogger, replicaRouter.GetRouter(), sConfig, replica)
+	replicaServer.AddHandler(server.GET, "/cluster/node", NodeStatusHandler)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		httpServer.GetRouter().ServeHTTP(rr, req)
+		return rr
+	}
+	role := func(id string) string {
+		var list []Member
+		if err := json.Unmarshal(do("GET", "/cluster/members", "").Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range list {
+			if m.ID == id {
+				return m.Role
+			}
+		}
+		return ""
+	}
+
+	if got := role("2"); got != RoleNonvoter {
+		t.Fatalf("replica joined with role %q", got)
+	}
+	if _, err := leader.Set("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"follower_id": "3", "follower_addr": "localhost:23603", "role": "observer"}`
+	if rr := do("POST", "/register-follower", body); rr.Code != http.StatusBadRequest {
+		t.Fatalf("register with unknown role. Expected: %d, got: %d", http.StatusBadRequest, rr.Code)
+	}
+
+	// the promotion is refused with a 409 until the replica caught up.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rr := do("POST", "/cluster/members/2/promote", "")
+		if rr.Code == http.StatusOK {
+			break
+		}
+		if rr.Code != http.StatusConflict || time.Now().After(deadline) {
+			t.Fatalf("promote failed. Expected: %d, got: %d body: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := role("2"); got != RoleVoter {
+		t.Fatalf("promote did not take effect, role: %q", got)
+	}
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	keysDesc = prometheus.NewDesc("dkv_keys",
+		"Keys held by the FSM, including expired keys not reaped yet.", nil, nil)
+	keyBytesDesc = prometheus.NewDesc("dkv_key_bytes",
+		"Bytes of all keys and values held by the FSM.", nil, nil)
+	fsmAppliedIndexDesc = prometheus.NewDesc("dkv_fsm_applied_index",
+		"Raft index of the last command applied to the FSM.", nil, nil)
+	raftStateDesc = prometheus.NewDesc("dkv_raft_state",
+		"1 for the raft state this node is in, 0 for the others.", []string{"state"}, nil)
+	raftTermDesc = prometheus.NewDesc("dkv_raft_term",
+		"Current raft term.", nil, nil)
+	raftCommitIndexDesc = prometheus.NewDesc("dkv_raft_commit_index",
+		"Raft commit index.", nil, nil)
+	raftAppliedIndexDesc = prometheus.NewDesc("dkv_raft_applied_index",
+		"Raft applied index, including entries that never reach the FSM.", nil, nil)
+	raftLastLogIndexDesc = prometheus.NewDesc("dkv_raft_last_log_index",
+		"Index of the last entry in the raft log.", nil, nil)
+	raftLastContactDesc = prometheus.NewDesc("dkv_raft_last_contact_seconds",
+		"Seconds since a follower last heard from the leader. 0 on the leader.", nil, nil)
+)
+
+var raftStates = []raft.RaftState{raft.Follower, raft.Candidate, raft.Leader, raft.Shutdown}
+
+func newApplyDurationHistogram() prometheus.Histogram {
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dkv_apply_duration_seconds",
+		Help:    "Time from proposing a write to raft until the FSM applied it.",
+		Buckets: prometheus.DefBuckets,
+	})
+}
+
+// storeCollector reads the store and raft gauges at scrape time.
+type storeCollector struct {
+	s *DKVService
+}
+
+// RegisterMetrics exposes the store and raft metrics through reg.
+func (s *DKVService) RegisterMetrics(reg prometheus.Registerer) error {
+	return errors.Join(reg.Register(s.applyDuration), reg.Register(storeCollector{s: s}))
+}
+
+func (c storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c storeCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.s
+	s.mu.Lock()
+	keys, keyBytes := s.kvtree.Len(), s.kvBytes
+	s.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(keysDesc, prometheus.GaugeValue, float64(keys))
+	ch <- prometheus.MustNewConstMetric(keyBytesDesc, prometheus.GaugeValue, float64(keyBytes))
+	ch <- prometheus.MustNewConstMetric(fsmAppliedIndexDesc, prometheus.GaugeValue, float64(s.appliedIndex.Load()))
+	if s.ServiceConfig.Debug {
+		return
+	}
+
+	state := s.raft.State()
+	for _, st := range raftStates {
+		value := 0.0
+		if st == state {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(raftStateDesc, prometheus.GaugeValue, value, st.String())
+	}
+
+	stats := s.raft.Stats()
+	for desc, stat := range map[*prometheus.Desc]string{
+		raftTermDesc:         "term",
+		raftCommitIndexDesc:  "commit_index",
+		raftAppliedIndexDesc: "applied_index",
+		raftLastLogIndexDesc: "last_log_index",
+	} {
+		if v, err := strconv.ParseUint(stats[stat], 10, 64); err == nil {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(v))
+		}
+	}
+
+	if state == raft.Leader {
+		ch <- prometheus.MustNewConstMetric(raftLastContactDesc, prometheus.GaugeValue, 0)
+	} else if lastContact := s.raft.LastContact(); !lastContact.IsZero() {
+		ch <- prometheus.MustNewConstMetric(raftLastContactDesc, prometheus.GaugeValue, time.Since(lastContact).Seconds())
+	}
+}
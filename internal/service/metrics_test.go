@@ -0,0 +1,84 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/metrics"
+	"github.com/tomkaith13/dist-kv-store/internal/router"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	config := router.Config{
+		RequestTimeout: 60 * time.Second,
+	}
+	sConfig := server.Config{
+		Address:         "localhost:9999",
+		ShutdownTimeout: time.Second * 5,
+	}
+	serviceConfig := Config{
+		KeyMaxLen:  100,
+		ValMaxLen:  200,
+		MaxMapSize: 1000,
+		RaftNodeID: "1",
+		Debug:      true,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+	dkvMetrics := metrics.New(zlogger)
+	router := router.New(config, zlogger)
+	router.GetRouter().Use(dkvMetrics.Middleware)
+	router.GetRouter().Method("GET", "/metrics", dkvMetrics.Handler())
+	kv_service := New(zlogger, serviceConfig)
+	if err := kv_service.RegisterMetrics(dkvMetrics.Registerer()); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := server.New(zlogger, router.GetRouter(), sConfig, kv_service)
+	httpServer.AddHandler(server.GET, "/key/{id}", GetHandler)
+
+	kv_service.Set("ab", "cde")
+	kv_service.Set("f", "g")
+	kv_service.Put("f", "gh", WriteUpsert, 0)
+	kv_service.Delete("ab")
+
+	for _, key := range []string{"f", "missing"} {
+		req, err := http.NewRequest("GET", "/key/"+key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpServer.GetRouter().ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	httpServer.GetRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /metrics failed. Expected: %d, got: %d", http.StatusOK, rr.Code)
+	}
+
+	body := rr.Body.String()
+	for _, want := range []string{
+		"dkv_keys 1\n",
+		"dkv_key_bytes 3\n",
+		"dkv_fsm_applied_index 4\n",
+		`dkv_http_requests_total{code="200",method="GET",route="/key/{id}"} 1`,
+		`dkv_http_requests_total{code="404",method="GET",route="/key/{id}"} 1`,
+		`dkv_http_request_duration_seconds_count{method="GET",route="/key/{id}"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics are missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+type PutRequestBody struct {
+	Val string `json:"value"`
+	// TTL is the number of seconds after which the key expires. 0 keeps it forever.
+	TTL int64 `json:"ttl"`
+}
+
+// PutHandler upserts the key in the path. The write can be made conditional
+// with the standard precondition headers:
+//   - If-None-Match: * only creates the key
+//   - If-Match: * only updates an existing key
+//   - If-Match: "<revision>" only updates the key if it is still at the
+//     revision returned as ETag by an earlier GET or PUT
+//
+// If-None-Match and If-Match together cannot both hold, and are rejected with
+// 400. A failed precondition is answered with 412. The new revision is
+// returned in the ETag header.
+func PutHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	var reqBody PutRequestBody
+	defer r.Body.Close()
+
+	// The raw body is kept around in case the write has to be forwarded to the leader.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return
+	}
+
+	err = json.Unmarshal(body, &reqBody)
+	if err != nil {
+		err := errors.New("Unable to decode body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	key := chi.URLParam(r, "id")
+
+	if err := dkvService.Authorize(r, AccessWrite, key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Validations for key and val
+	if len(key) > dkvService.ServiceConfig.KeyMaxLen {
+		err := errors.New("key size exceeded")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(reqBody.Val) > dkvService.ServiceConfig.ValMaxLen {
+		err := errors.New("value size exceeded")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if reqBody.TTL < 0 {
+		http.Error(w, InvalidTTL.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := time.Duration(reqBody.TTL) * time.Second
+
+	mode := WriteUpsert
+	ifMatch := r.Header.Get("If-Match")
+	var casRevision uint64
+	switch {
+	case r.Header.Get("If-None-Match") == "*" && ifMatch != "":
+		err := errors.New("If-None-Match: * and If-Match cannot be combined")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case r.Header.Get("If-None-Match") == "*":
+		mode = WriteCreateOnly
+	case ifMatch == "*":
+		mode = WriteUpdateOnly
+	case ifMatch != "":
+		mode = WriteUpdateOnly
+		casRevision, err = parseETag(ifMatch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if mode != WriteUpdateOnly && dkvService.KeyCount() > dkvService.ServiceConfig.MaxMapSize {
+		err := errors.New("max keys exceeded")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var created bool
+	var revision uint64
+	if ifMatch != "" && ifMatch != "*" {
+		revision, err = dkvService.CompareAndSwapTTL(key, reqBody.Val, casRevision, ttl)
+	} else {
+		created, revision, err = dkvService.Put(key, reqBody.Val, mode, ttl)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, NotLeader):
+			forwardToLeader(dkvService, w, r, body)
+		case errors.Is(err, LeaderNotReady):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case errors.Is(err, KeyAlreadyExists), errors.Is(err, KeyNotFound), errors.Is(err, RevisionMismatch):
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(revision))
+	if created {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("key created successfully!"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("key updated successfully!"))
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/router"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+func TestPutConditionalModes(t *testing.T) {
+	config := router.Config{
+		RequestTimeout: 60 * time.Second,
+	}
+	sConfig := server.Config{
+		Address:         "localhost:9999",
+		ShutdownTimeout: time.Second * 5,
+	}
+	serviceConfig := Config{
+		KeyMaxLen:  100,
+		ValMaxLen:  200,
+		MaxMapSize: 1000,
+		RaftNodeID: "1",
+		Debug:      true,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+	router := router.New(config, zlogger)
+	kv_service := New(zlogger, serviceConfig)
+	httpServer := server.New(zlogger, router.GetRouter(), sConfig, kv_service)
+
+	httpServer.AddHandler(server.PUT, "/key/{id}", PutHandler)
+
+	put := func(val string, header, headerVal string) int {
+		b, err := json.Marshal(PutRequestBody{Val: val})
+		if err != nil {
+			t.Fatal("failed to marshal Put Request Body")
+		}
+		req, err := http.NewRequest("PUT", "/key/a", bytes.NewBuffer(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set(header, headerVal)
+		}
+		rr := httptest.NewRecorder()
+		httpServer.GetRouter().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	steps := []struct {
+		name   string
+		val    string
+		header string
+		want   int
+	}{
+		{name: "update-only on missing key", val: "x", header: "If-Match", want: http.StatusPreconditionFailed},
+		{name: "create-only on missing key", val: "b", header: "If-None-Match", want: http.StatusCreated},
+		{name: "create-only on existing key", val: "c", header: "If-None-Match", want: http.StatusPreconditionFailed},
+		{name: "update-only on existing key", val: "d", header: "If-Match", want: http.StatusOK},
+		{name: "upsert on existing key", val: "e", want: http.StatusOK},
+	}
+	for _, step := range steps {
+		if code := put(step.val, step.header, "*"); code != step.want {
+			t.Fatalf("%s failed. Expected: %d, got: %d", step.name, step.want, code)
+		}
+	}
+
+	val, err := kv_service.Get("a")
+	if err != nil || val != "e" {
+		t.Fatalf("GET after PUTs failed. Expected: e, got: %q err: %v", val, err)
+	}
+
+	// create-only and update-only cannot both hold.
+	req, err := http.NewRequest("PUT", "/key/a", strings.NewReader(`{"value": "f"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", "*")
+	req.Header.Set("If-Match", `"1"`)
+	rr := httptest.NewRecorder()
+	httpServer.GetRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("PUT with If-None-Match and If-Match. Expected: %d, got: %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestCompareAndSwapWithETags(t *testing.T) {
+	config := router.Config{
+		RequestTimeout: 60 * time.Second,
+	}
+	sConfig := server.Config{
+		Address:         "localhost:9999",
+		ShutdownTimeout: time.Second * 5,
+	}
+	serviceConfig := Config{
+		KeyMaxLen:  100,
+		ValMaxLen:  200,
+		MaxMapSize: 1000,
+		RaftNodeID: "1",
+		Debug:      true,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+	router := router.New(config, zlogger)
+	kv_service := New(zlogger, serviceConfig)
+	httpServer := server.New(zlogger, router.GetRouter(), sConfig, kv_service)
+
+	httpServer.AddHandler(server.GET, "/key/{id}", GetHandler)
+	httpServer.AddHandler(server.PUT, "/key/{id}", PutHandler)
+	httpServer.AddHandler(server.DELETE, "/key/{id}", DelHandler)
+
+	do := func(method, val, ifMatch string) *httptest.ResponseRecorder {
+		var body *bytes.Buffer
+		if method == "PUT" {
+			b, err := json.Marshal(PutRequestBody{Val: val})
+			if err != nil {
+				t.Fatal("failed to marshal Put Request Body")
+			}
+			body = bytes.NewBuffer(b)
+		} else {
+			body = &bytes.Buffer{}
+		}
+		req, err := http.NewRequest(method, "/key/a", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		httpServer.GetRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("PUT", "b", "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("PUT failed. Expected: %d, got: %d", http.StatusCreated, rr.Code)
+	}
+	firstETag := rr.Header().Get("ETag")
+
+	rr = do("GET", "", "")
+	if rr.Header().Get("ETag") != firstETag {
+		t.Fatalf("GET ETag mismatch. Expected: %s, got: %s", firstETag, rr.Header().Get("ETag"))
+	}
+
+	rr = do("PUT", "c", firstETag)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("CAS with current revision failed. Expected: %d, got: %d", http.StatusOK, rr.Code)
+	}
+	secondETag := rr.Header().Get("ETag")
+	if secondETag == firstETag {
+		t.Fatalf("CAS did not bump the revision. got: %s", secondETag)
+	}
+
+	if rr = do("PUT", "d", firstETag); rr.Code != http.StatusPreconditionFailed {
+		t.Fatalf("CAS with stale revision. Expected: %d, got: %d", http.StatusPreconditionFailed, rr.Code)
+	}
+	if rr = do("DELETE", "", firstETag); rr.Code != http.StatusPreconditionFailed {
+		t.Fatalf("DELETE with stale revision. Expected: %d, got: %d", http.StatusPreconditionFailed, rr.Code)
+	}
+	if rr = do("DELETE", "", secondETag); rr.Code != http.StatusOK {
+		t.Fatalf("DELETE with current revision. Expected: %d, got: %d", http.StatusOK, rr.Code)
+	}
+
+	// with the key gone, any If-Match fails the precondition.
+	for _, ifMatch := range []string{secondETag, "*"} {
+		if rr = do("DELETE", "", ifMatch); rr.Code != http.StatusPreconditionFailed {
+			t.Fatalf("DELETE of a missing key with If-Match: %s. Expected: %d, got: %d", ifMatch, http.StatusPreconditionFailed, rr.Code)
+		}
+	}
+	if rr = do("DELETE", "", ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("DELETE of a missing key. Expected: %d, got: %d", http.StatusNotFound, rr.Code)
+	}
+	if rr = do("PUT", "e", ""); rr.Code != http.StatusCreated {
+		t.Fatalf("PUT failed. Expected: %d, got: %d", http.StatusCreated, rr.Code)
+	}
+	if rr = do("DELETE", "", "*"); rr.Code != http.StatusOK {
+		t.Fatalf("DELETE with If-Match: *. Expected: %d, got: %d", http.StatusOK, rr.Code)
+	}
+}
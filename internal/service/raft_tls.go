@@ -0,0 +1,133 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/tomkaith13/dist-kv-store/internal/tlsconfig"
+)
+
+var (
+	UnknownRaftPeer  error = errors.New("peer is not part of the raft configuration")
+	RaftPeerMismatch error = errors.New("peer certificate does not name the expected raft node")
+)
+
+// tlsStreamLayer carries raft traffic over mutually authenticated TLS. Both
+// ends present a certificate signed by the raft CA, and the certificate has
+// to name the node ID, as its common name or one of its DNS names:
+//   - when dialing, the ID the raft configuration holds for the address;
+//   - when accepting, the ID of any server of the raft configuration. A node
+//     with no configuration yet accepts any node of the CA, so it can be added.
+type tlsStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+
+	server *tls.Config
+	client *tls.Config
+	// configuration returns the latest raft configuration.
+	configuration func() raft.Configuration
+}
+
+// newTLSStreamLayer listens on bindAddr. Client certificates are always
+// required, whatever certs was configured with.
+func newTLSStreamLayer(bindAddr string, advertise net.Addr, certs *tlsconfig.Reloader,
+	configuration func() raft.Configuration) (*tlsStreamLayer, error) {
+	listener, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &tlsStreamLayer{
+		Listener:      listener,
+		advertise:     advertise,
+		client:        certs.ClientConfig(""),
+		configuration: configuration,
+	}
+
+	server := certs.ServerConfig()
+	l.server = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			config, err := server.GetConfigForClient(hello)
+			if err != nil {
+				return nil, err
+			}
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+			config.VerifyConnection = l.verifyMember
+			return config, nil
+		},
+	}
+	return l, nil
+}
+
+// Accept wraps inbound connections in TLS. The handshake, and so the peer
+// check, runs on the first read, off the accept loop.
+func (l *tlsStreamLayer) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, l.server), nil
+}
+
+func (l *tlsStreamLayer) Addr() net.Addr {
+	if l.advertise != nil {
+		return l.advertise
+	}
+	return l.Listener.Addr()
+}
+
+// Dial connects to address and checks the peer is the node the raft
+// configuration expects there.
+func (l *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	var want raft.ServerID
+	for _, srv := range l.configuration().Servers {
+		if srv.Address == address {
+			want = srv.ID
+			break
+		}
+	}
+	if want == "" {
+		return nil, fmt.Errorf("%w. Address: %s", UnknownRaftPeer, address)
+	}
+
+	config := l.client.Clone()
+	verifyChain := config.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		// raft peers are identified by node ID, not by the host they dial,
+		// so the client config only verifies the chain.
+		if err := verifyChain(cs); err != nil {
+			return err
+		}
+		if !certNamesNode(cs.PeerCertificates[0], want) {
+			return fmt.Errorf("%w. Expected: %s at %s", RaftPeerMismatch, want, address)
+		}
+		return nil
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", string(address), config)
+}
+
+// verifyMember accepts peers whose certificate names a server of the raft
+// configuration. The chain was already verified against the client CA.
+func (l *tlsStreamLayer) verifyMember(cs tls.ConnectionState) error {
+	servers := l.configuration().Servers
+	if len(servers) == 0 {
+		return nil
+	}
+	for _, srv := range servers {
+		if certNamesNode(cs.PeerCertificates[0], srv.ID) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w. Certificate: %s", UnknownRaftPeer, cs.PeerCertificates[0].Subject.CommonName)
+}
+
+func certNamesNode(cert *x509.Certificate, id raft.ServerID) bool {
+	return cert.Subject.CommonName == string(id) || slices.Contains(cert.DNSNames, string(id))
+}
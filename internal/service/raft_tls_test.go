@@ -0,0 +1,163 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/router"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+	"github.com/tomkaith13/dist-kv-store/internal/tlsconfig"
+	"github.com/tomkaith13/dist-kv-store/internal/tlsconfig/tlstest"
+)
+
+func TestTLSStreamLayerVerifiesNodeID(t *testing.T) {
+	zlogger := zerolog.New(io.Discard)
+	ca := tlstest.NewCA(t)
+
+	// every layer reads its own view of the raft configuration.
+	configurations := make(map[string]*raft.Configuration)
+	newLayer := func(id string) *tlsStreamLayer {
+		certs, err := tlsconfig.New(zlogger, ca.WriteNode(t, t.TempDir(), 0, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		configuration := &raft.Configuration{}
+		configurations[id] = configuration
+		layer, err := newTLSStreamLayer("127.0.0.1:0", nil, certs, func() raft.Configuration { return *configuration })
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { layer.Close() })
+		go func() {
+			for {
+				conn, err := layer.Accept()
+				if err != nil {
+					return
+				}
+				go io.Copy(conn, conn)
+			}
+		}()
+		return layer
+	}
+	node1, node2, imposter := newLayer("1"), newLayer("2"), newLayer("imposter")
+	addr := func(l *tlsStreamLayer) raft.ServerAddress { return raft.ServerAddress(l.Addr().String()) }
+
+	// ping dials to and round trips a byte through the echoing peer.
+	ping := func(from *tlsStreamLayer, to raft.ServerAddress) error {
+		conn, err := from.Dial(to, time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write([]byte{1}); err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, make([]byte, 1))
+		return err
+	}
+
+	members := raft.Configuration{Servers: []raft.Server{
+		{ID: "1", Address: addr(node1)},
+		{ID: "2", Address: addr(node2)},
+	}}
+	for _, configuration := range configurations {
+		*configuration = members.Clone()
+	}
+	if err := ping(node1, addr(node2)); err != nil {
+		t.Fatalf("members failed to talk: %s", err)
+	}
+	if err := ping(node1, addr(imposter)); !errors.Is(err, UnknownRaftPeer) {
+		t.Fatalf("dialing an address outside the configuration. Expected UnknownRaftPeer, got: %v", err)
+	}
+	configurations["imposter"].Servers = append(configurations["imposter"].Servers, raft.Server{ID: "2", Address: addr(node2)})
+	if err := ping(imposter, addr(node2)); err == nil {
+		t.Fatal("a node outside the configuration was accepted")
+	}
+
+	// node 1 believes node 2 listens where the imposter does.
+	configurations["1"].Servers[1].Address = addr(imposter)
+	if err := ping(node1, addr(imposter)); !errors.Is(err, RaftPeerMismatch) {
+		t.Fatalf("dialing the wrong node. Expected RaftPeerMismatch, got: %v", err)
+	}
+
+	// a node without a configuration yet lets any node of the CA in, so it
+	// can be added to the cluster.
+	configurations["1"].Servers[1] = raft.Server{ID: "imposter", Address: addr(imposter)}
+	*configurations["imposter"] = raft.Configuration{}
+	if err := ping(node1, addr(imposter)); err != nil {
+		t.Fatalf("node without a configuration refused a CA member: %s", err)
+	}
+}
+
+func TestRaftOverTLS(t *testing.T) {
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+	ca := tlstest.NewCA(t)
+
+	// the follower registers through the leader's HTTP API.
+	leaderRouter := router.New(router.Config{RequestTimeout: 60 * time.Second}, zlogger)
+	ts := httptest.NewServer(leaderRouter.GetRouter())
+	defer ts.Close()
+
+	nodes := make([]*DKVService, 2)
+	for i, id := range []string{"1", "2"} {
+		serviceConfig := Config{
+			KeyMaxLen:    100,
+			ValMaxLen:    200,
+			MaxMapSize:   1000,
+			RaftNodeID:   id,
+			RaftAddr:     "localhost:2410" + id,
+			RaftStoreDir: t.TempDir(),
+			RaftTimeout:  5 * time.Second,
+			RaftTLS:      ca.WriteNode(t, t.TempDir(), 0, id),
+		}
+		if i == 0 {
+			serviceConfig.RaftLeader = true
+			serviceConfig.HTTPAddr = ts.Listener.Addr().String()
+		} else {
+			serviceConfig.RaftJoinAddr = []string{ts.Listener.Addr().String()}
+		}
+		nodes[i] = New(zlogger, serviceConfig)
+		defer nodes[i].Shutdown()
+
+		if i == 0 {
+			httpServer := server.New(zlogger, leaderRouter.GetRouter(), server.Config{Address: "localhost:9999"}, nodes[0])
+			httpServer.AddHandler(server.POST, "/register-follower", RegisterFollowerHandler)
+		}
+	}
+
+	if _, err := nodes[0].Set("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if val, err := nodes[1].Get("a"); err == nil && val == "b" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("write was not replicated over TLS")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// raft refuses plain TCP peers.
+	plain, err := raft.NewTCPTransport("127.0.0.1:0", nil, 1, time.Second, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	var resp raft.AppendEntriesResponse
+	if err := plain.AppendEntries("1", "localhost:24101", &raft.AppendEntriesRequest{}, &resp); err == nil {
+		t.Fatal("raft answered a plain TCP peer")
+	}
+}
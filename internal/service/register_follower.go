@@ -3,14 +3,18 @@ package service
 import (
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 
 	"github.com/tomkaith13/dist-kv-store/internal/server"
 )
 
 type RegisterFollowerRequest struct {
-	FollowerId   string `json:"follower_id"`
-	FollowerAddr string `json:"follower_addr"`
+	FollowerId       string `json:"follower_id"`
+	FollowerAddr     string `json:"follower_addr"`
+	FollowerHTTPAddr string `json:"follower_http_addr"`
+	// Role is "voter" or "nonvoter". Empty means voter.
+	Role string `json:"role"`
 }
 
 var (
@@ -21,7 +25,14 @@ func RegisterFollowerHandler(s *server.Server, w http.ResponseWriter, r *http.Re
 	var reqBody RegisterFollowerRequest
 	defer r.Body.Close()
 
-	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	// The raw body is kept around in case the registration has to be forwarded to the leader.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return
+	}
+
+	err = json.Unmarshal(body, &reqBody)
 	if err != nil {
 		err := errors.New("unable to decode body")
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -35,7 +46,15 @@ func RegisterFollowerHandler(s *server.Server, w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	err = dkvService.RegisterFollower(reqBody.FollowerId, reqBody.FollowerAddr)
+	err = dkvService.RegisterFollower(reqBody.FollowerId, reqBody.FollowerAddr, reqBody.FollowerHTTPAddr, reqBody.Role)
+	switch {
+	case errors.Is(err, NotLeader):
+		forwardToLeader(dkvService, w, r, body)
+		return
+	case errors.Is(err, InvalidRole):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, RegistrationFailed.Error(), http.StatusInternalServerError)
 		return
@@ -0,0 +1,46 @@
+package service
+
+import "github.com/tomkaith13/dist-kv-store/internal/server"
+
+// RegisterHandlers adds the routes of the dkv API to httpServer.
+func RegisterHandlers(httpServer *server.Server) {
+	// probes and node status
+	httpServer.AddHandler(server.GET, "/healthz", HealthzHandler)
+	httpServer.AddHandler(server.GET, "/readyz", ReadyzHandler)
+	httpServer.AddHandler(server.GET, "/status", StatusHandler)
+
+	// key handlers
+	httpServer.AddHandler(server.GET, "/key/{id}", GetHandler)
+	httpServer.AddHandler(server.POST, "/key", SetHandler)
+	httpServer.AddHandler(server.PUT, "/key/{id}", PutHandler)
+	httpServer.AddHandler(server.DELETE, "/key/{id}", DelHandler)
+	httpServer.AddHandler(server.GET, "/keys", KeysHandler)
+	httpServer.AddHandler(server.GET, "/watch", WatchHandler)
+
+	// multi-key transactions
+	httpServer.AddHandler(server.POST, "/txn", TxnHandler)
+
+	// handler for followers to register via the leader
+	httpServer.AddHandler(server.POST, "/register-follower", RegisterFollowerHandler)
+
+	// cluster membership admin
+	httpServer.AddHandler(server.GET, "/cluster/members", ListMembersHandler)
+	httpServer.AddHandler(server.DELETE, "/cluster/members/{id}", RemoveMemberHandler)
+	httpServer.AddHandler(server.POST, "/cluster/members/{id}/demote", DemoteMemberHandler)
+	httpServer.AddHandler(server.POST, "/cluster/members/{id}/promote", PromoteMemberHandler)
+	httpServer.AddHandler(server.GET, "/cluster/node", NodeStatusHandler)
+	httpServer.AddHandler(server.POST, "/cluster/leader/transfer", TransferLeadershipHandler)
+
+	// backup and restore
+	httpServer.AddHandler(server.GET, "/admin/backup", BackupHandler)
+	httpServer.AddHandler(server.POST, "/admin/restore", RestoreHandler)
+	httpServer.AddHandler(server.POST, "/admin/snapshot", SnapshotHandler)
+
+	// auth roles and tokens
+	httpServer.AddHandler(server.GET, "/auth/roles", ListAuthRolesHandler)
+	httpServer.AddHandler(server.PUT, "/auth/roles/{name}", PutAuthRoleHandler)
+	httpServer.AddHandler(server.DELETE, "/auth/roles/{name}", DeleteAuthRoleHandler)
+	httpServer.AddHandler(server.GET, "/auth/tokens", ListTokensHandler)
+	httpServer.AddHandler(server.POST, "/auth/tokens", CreateTokenHandler)
+	httpServer.AddHandler(server.DELETE, "/auth/tokens/{name}", DeleteTokenHandler)
+}
@@ -2,6 +2,8 @@ package service
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,23 +12,64 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"strings"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
+	iradix "github.com/hashicorp/go-immutable-radix"
 	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/tlsconfig"
 )
 
 type DKVService struct {
 	logger        zerolog.Logger
 	ServiceConfig Config
 	mu            sync.Mutex
-	kvmap         map[string]string
+	// kvtree holds the kv entries ordered by key. See store.go.
+	kvtree *iradix.Tree
+	// kvBytes is the size of all keys and values in kvtree.
+	kvBytes int
+	// nodes maps raft node IDs to their addresses. It is replicated through
+	// raft so every node can find the leader's HTTP address.
+	nodes map[string]NodeMeta
+	// roles and tokens are the replicated auth policy, tokens keyed by the
+	// SHA-256 of their secret. See auth.go.
+	roles  map[string]AuthRole
+	tokens map[string]APIToken
+	// watch publishes every committed change to watchers. See watch.go.
+	watch *watchHub
+
+	// appliedIndex is the raft index of the last command applied to kvtree.
+	appliedIndex atomic.Uint64
 
 	// raft FSM
-	raft *raft.Raft
+	raft      *raft.Raft
+	raftStore *raftboltdb.BoltStore
+	snapshots raft.SnapshotStore
+	transport raft.Transport
+
+	// read consistency bookkeeping, reset on every leadership change.
+	leaderLease     time.Duration
+	readBarrierDone atomic.Bool
+	leaseVerifiedAt atomic.Int64
+
+	// unreachable holds the followers the leader fails to heartbeat along
+	// with their last contact. See members.go.
+	healthMu    sync.Mutex
+	unreachable map[raft.ServerID]time.Time
+
+	// applyDuration times writes from proposal until the FSM applied them.
+	applyDuration prometheus.Histogram
+
+	// peerClient calls the HTTP API of other nodes. See forward.go.
+	peerClient *http.Client
+	// stopRaftTLSWatch stops reloading the raft TLS files. See raft_tls.go.
+	stopRaftTLSWatch context.CancelFunc
 }
 
 type Config struct {
@@ -39,9 +82,85 @@ type Config struct {
 	RaftStoreDir string        `envconfig:"RAFT_STORE_DIR" required:"true"`
 	RaftTimeout  time.Duration `envconfig:"RAFT_TIMEOUT" default:"20s"`
 
-	Debug        bool
-	RaftLeader   bool   `envconfig:"RAFT_LEADER" required:"true"`
-	RaftJoinAddr string `envconfig:"RAFT_JOIN_ADDR"`
+	// TxnMaxOps caps the number of ops in the branches of a POST /txn.
+	TxnMaxOps int `envconfig:"TXN_MAX_OPS" default:"64"`
+
+	// ExpiryInterval is how often the leader looks for keys whose TTL ran out.
+	ExpiryInterval time.Duration `envconfig:"EXPIRY_INTERVAL" default:"1s"`
+
+	// ReadConsistency is the level used by GET /key/{id} when the request has
+	// no consistency query parameter: stale, leader-lease or linearizable.
+	ReadConsistency string `envconfig:"READ_CONSISTENCY" default:"stale"`
+
+	Debug      bool
+	RaftLeader bool `envconfig:"RAFT_LEADER"`
+	// RaftJoinAddr lists the HTTP addresses of cluster members a new
+	// follower registers through. Any live member will do.
+	RaftJoinAddr []string `envconfig:"RAFT_JOIN_ADDR"`
+	// RaftPeers bootstraps a fixed cluster instead of a designated leader.
+	// Every node gets the same id=raftAddr@httpAddr list, including itself.
+	RaftPeers []string `envconfig:"RAFT_PEERS"`
+	// RaftRole is the role a follower joins with: "voter", or "nonvoter" for
+	// read replicas that replicate the log without counting towards quorum.
+	RaftRole string `envconfig:"RAFT_ROLE" default:"voter"`
+	// RaftPromoteMaxLag is how many log entries a nonvoter may trail the
+	// leader by and still be promoted to voter.
+	RaftPromoteMaxLag uint64 `envconfig:"RAFT_PROMOTE_MAX_LAG" default:"64"`
+	// ReadyMaxLag is how many committed log entries this node may still have
+	// to apply and be reported ready by GET /readyz.
+	ReadyMaxLag uint64 `envconfig:"READY_MAX_LAG" default:"64"`
+
+	// BackupMaxBytes caps the size of a backup uploaded to POST /admin/restore.
+	// 0 means no limit.
+	BackupMaxBytes int64 `envconfig:"BACKUP_MAX_BYTES" default:"268435456"`
+	// SnapshotCompression is how the records of new snapshots are compressed:
+	// "none", "gzip" or "zstd".
+	SnapshotCompression string `envconfig:"SNAPSHOT_COMPRESSION" default:"gzip"`
+
+	// HTTPAddr is the address other nodes use to reach this node's HTTP API.
+	// It defaults to SERVER_ADDRESS.
+	HTTPAddr string `envconfig:"HTTP_ADDR"`
+	// ForwardMode decides how writes hitting a follower reach the leader:
+	// "proxy" relays the request, "redirect" answers with a 307 to the leader.
+	ForwardMode string `envconfig:"FORWARD_MODE" default:"proxy"`
+
+	// WatchHistory is how many recent changes are kept for watchers resuming
+	// from an older index.
+	WatchHistory int `envconfig:"WATCH_HISTORY" default:"1024"`
+
+	// PeerTLS is the client TLS config used to call the HTTP API of other
+	// nodes. When set, they are called over HTTPS. It is not read from the env.
+	PeerTLS *tls.Config `ignored:"true" json:"-"`
+	// PeerDialTLS, when set, dials the HTTPS connections to other nodes in
+	// place of PeerTLS, e.g. to verify each node against the host dialled.
+	PeerDialTLS func(ctx context.Context, network, addr string) (net.Conn, error) `ignored:"true" json:"-"`
+
+	// RaftTLS runs raft traffic over mutual TLS when a certificate is set.
+	// ClientCAFile is the CA all raft certificates are signed by, and every
+	// certificate has to name its node ID. See raft_tls.go.
+	RaftTLS tlsconfig.Config `envconfig:"RAFT_TLS"`
+
+	// AuthEnabled requires an API token on every request but the probes and
+	// /metrics. See auth.go.
+	AuthEnabled bool `envconfig:"AUTH_ENABLED"`
+	// AuthBootstrapToken is an admin token accepted by every node without
+	// being stored. Nodes call each other with it, so all nodes share it.
+	AuthBootstrapToken string `envconfig:"AUTH_BOOTSTRAP_TOKEN" json:"-"`
+
+	// RaftTransport, RaftStore and RaftSnapshotStore replace the TCP
+	// transport, the bolt store and the file snapshot store when set, so a
+	// whole cluster can run in one process. See internal/clustertest. They
+	// are not read from the env.
+	RaftTransport     raft.Transport     `ignored:"true" json:"-"`
+	RaftStore         RaftStore          `ignored:"true" json:"-"`
+	RaftSnapshotStore raft.SnapshotStore `ignored:"true" json:"-"`
+}
+
+// RaftStore holds the raft log and the stable store (term, vote), like the
+// bolt store does by default.
+type RaftStore interface {
+	raft.LogStore
+	raft.StableStore
 }
 
 func New(logger zerolog.Logger, config Config) *DKVService {
@@ -50,51 +169,162 @@ func New(logger zerolog.Logger, config Config) *DKVService {
 		ServiceConfig: config,
 	}
 
-	service.kvmap = make(map[string]string)
+	service.kvtree = iradix.New()
+	service.nodes = make(map[string]NodeMeta)
+	service.roles = make(map[string]AuthRole)
+	service.tokens = make(map[string]APIToken)
+	service.watch = newWatchHub(config.WatchHistory)
+	service.applyDuration = newApplyDurationHistogram()
+	service.peerClient = newPeerClient(config.PeerTLS, config.PeerDialTLS)
 	service.PrintConfigs()
+	if _, err := ParseConsistency(config.ReadConsistency); err != nil {
+		logger.Fatal().Msgf("Invalid read consistency config. Error: %s", err)
+	}
+	if _, err := ParseSnapshotCompression(config.SnapshotCompression); err != nil {
+		logger.Fatal().Msgf("Invalid snapshot compression config. Error: %s", err)
+	}
+	if _, err := ParseRole(config.RaftRole); err != nil {
+		logger.Fatal().Msgf("Invalid raft role config. Error: %s", err)
+	}
+	if config.RaftLeader && config.RaftRole == RoleNonvoter {
+		logger.Fatal().Msg("The bootstrap leader has to be a voter")
+	}
+	if config.RaftTLS.Enabled() && config.RaftTLS.ClientCAFile == "" {
+		logger.Fatal().Msg("Raft TLS needs RAFT_TLS_CLIENT_CA_FILE to verify the other nodes")
+	}
+	if config.AuthEnabled && config.AuthBootstrapToken == "" {
+		logger.Fatal().Msg("Auth needs AUTH_BOOTSTRAP_TOKEN to administer the cluster and join nodes")
+	}
+	if len(config.RaftPeers) > 0 {
+		if config.RaftLeader {
+			logger.Fatal().Msg("RAFT_LEADER and RAFT_PEERS are mutually exclusive")
+		}
+		if err := validatePeers(config); err != nil {
+			logger.Fatal().Msgf("Invalid raft peers config. Error: %s", err)
+		}
+	}
 	if !config.Debug {
 		service.initializeRaftCluster()
 	}
 	return service
 }
 
+const (
+	// raftStoreFile is the bolt file inside RaftStoreDir holding the raft log and stable store.
+	raftStoreFile = "raft.db"
+	// raftLogCacheSize is the number of recent log entries kept in memory in front of the bolt store.
+	raftLogCacheSize = 512
+)
+
 var (
-	LeaderNotReady error = errors.New("Leader not ready yet!! please try later")
+	LeaderNotReady   error = errors.New("Leader not ready yet!! please try later")
+	NotLeader        error = errors.New("operation can be done only on leader node")
+	KeyNotFound      error = errors.New("key not found")
+	KeyAlreadyExists error = errors.New("key already exists")
+	RevisionMismatch error = errors.New("key revision mismatch")
+)
+
+// WriteMode is the existence precondition a write is applied with.
+type WriteMode byte
+
+const (
+	// WriteUpsert creates the key or overwrites its value.
+	WriteUpsert WriteMode = iota
+	// WriteCreateOnly fails with KeyAlreadyExists if the key is present.
+	WriteCreateOnly
+	// WriteUpdateOnly fails with KeyNotFound if the key is absent.
+	WriteUpdateOnly
 )
 
+// writeResult is the FSM response to a successful SET.
+type writeResult struct {
+	Created  bool
+	Revision uint64
+}
+
+// Entry is a value stored in the FSM. Revision is the raft log index of the
+// write that last modified the key.
+type Entry struct {
+	Val      string `json:"value"`
+	Revision uint64 `json:"revision"`
+	// ExpiresAt is the unix time in milliseconds after which the key is
+	// gone, 0 if it never expires.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// expiredAt reports whether the entry has expired at now, in unix milliseconds.
+func (e Entry) expiredAt(now int64) bool {
+	return e.ExpiresAt > 0 && now > 0 && e.ExpiresAt <= now
+}
+
 func (s *DKVService) initializeRaftCluster() {
 	// create store dir
-	if err := os.MkdirAll(s.ServiceConfig.RaftStoreDir, 0700); err != nil {
-		s.logger.Fatal().Msg("Unable to create local raft store directory")
+	if s.ServiceConfig.RaftStore == nil || s.ServiceConfig.RaftSnapshotStore == nil {
+		if err := os.MkdirAll(s.ServiceConfig.RaftStoreDir, 0700); err != nil {
+			s.logger.Fatal().Msg("Unable to create local raft store directory")
+		}
 	}
 	config := raft.DefaultConfig()
 	config.LocalID = raft.ServerID(s.ServiceConfig.RaftNodeID)
-
-	addr, err := net.ResolveTCPAddr("tcp", s.ServiceConfig.RaftAddr)
-	if err != nil {
-		s.logger.Fatal().Msgf("Error getting a tcp endpoiint for raft. Err: %q", err)
+	leaderNotifyCh := make(chan bool, 10)
+	config.NotifyCh = leaderNotifyCh
+	s.leaderLease = config.LeaderLeaseTimeout
+
+	// raftRef lets the TLS stream layer read the raft configuration of a raft
+	// instance that is created after the transport.
+	var raftRef atomic.Pointer[raft.Raft]
+	var err error
+	if s.ServiceConfig.RaftTransport != nil {
+		s.transport = s.ServiceConfig.RaftTransport
+	} else if s.transport, err = s.newNetworkTransport(&raftRef); err != nil {
+		s.logger.Fatal().Msgf("Error getting a transport layer for raft. Err: %q", err)
 		return
 	}
 
-	transport, err := raft.NewTCPTransport(s.ServiceConfig.RaftAddr, addr, 3, 10*time.Second, os.Stderr)
+	if s.ServiceConfig.RaftSnapshotStore != nil {
+		s.snapshots = s.ServiceConfig.RaftSnapshotStore
+	} else {
+		s.snapshots, err = raft.NewFileSnapshotStore(s.ServiceConfig.RaftStoreDir, 2, s.logger)
+		if err != nil {
+			s.logger.Fatal().Msgf("Error creating a snapshot store for raft. Err: %q", err)
+			return
+		}
+	}
+
+	// The bolt store backs both the raft log and the stable store (term, vote)
+	// so a restarted node picks up exactly where it left off.
+	var store RaftStore = s.ServiceConfig.RaftStore
+	if store == nil {
+		s.raftStore, err = raftboltdb.New(raftboltdb.Options{
+			Path: filepath.Join(s.ServiceConfig.RaftStoreDir, raftStoreFile),
+		})
+		if err != nil {
+			s.logger.Fatal().Msgf("Error creating a bolt store for raft. Err: %q", err)
+			return
+		}
+		store = s.raftStore
+	}
+	logStore, err := raft.NewLogCache(raftLogCacheSize, store)
 	if err != nil {
-		s.logger.Fatal().Msgf("Error getting a tcp transport layer for raft. Err: %q", err)
+		s.logger.Fatal().Msgf("Error creating a log cache for raft. Err: %q", err)
 		return
 	}
+	stableStore := store
 
-	snapshots, err := raft.NewFileSnapshotStore(s.ServiceConfig.RaftStoreDir, 2, s.logger)
+	hasState, err := raft.HasExistingState(logStore, stableStore, s.snapshots)
 	if err != nil {
-		s.logger.Fatal().Msgf("Error creating a snapshot store for raft. Err: %q", err)
+		s.logger.Fatal().Msgf("Unable to check for existing raft state. Err: %q", err)
 		return
 	}
-	logStore := raft.NewInmemStore()
-	stableStore := raft.NewInmemStore()
 
 	// Instantiate the Raft systems.
-	s.raft, err = raft.NewRaft(config, (*DKVService)(s), logStore, stableStore, snapshots, transport)
+	s.raft, err = raft.NewRaft(config, (*DKVService)(s), logStore, stableStore, s.snapshots, s.transport)
 	if err != nil {
 		s.logger.Fatal().Msg("Unable to instantiate a raft FSM")
 	}
+	raftRef.Store(s.raft)
+	go s.monitorLeadership(leaderNotifyCh)
+	s.observeHeartbeats()
 
 	// We use exponential backoff - default configs save for MaxElapsedTime to
 	// wait for leader to get elected. We want this guardrail since followers can get
@@ -102,12 +332,38 @@ func (s *DKVService) initializeRaftCluster() {
 	exponentialBackoffEngine := backoff.NewExponentialBackOff()
 	exponentialBackoffEngine.MaxElapsedTime = s.ServiceConfig.RaftTimeout
 
-	if s.ServiceConfig.RaftLeader {
+	if hasState {
+		// This node has been part of a cluster before. Its configuration, term
+		// and log are already on disk so raft rejoins on its own. Bootstrapping
+		// or registering again would fail or duplicate the membership.
+		s.logger.Info().Msgf("Existing raft state found in %s. Rejoining cluster as NodeID: %s",
+			s.ServiceConfig.RaftStoreDir, s.ServiceConfig.RaftNodeID)
+	} else if len(s.ServiceConfig.RaftPeers) > 0 {
+		// Every peer bootstraps the same configuration, so whichever nodes
+		// come up first elect a leader among themselves.
+		peers, _ := ParsePeers(s.ServiceConfig.RaftPeers)
+		raftConfig := raft.Configuration{}
+		for _, peer := range peers {
+			raftConfig.Servers = append(raftConfig.Servers, raft.Server{
+				ID:      raft.ServerID(peer.ID),
+				Address: raft.ServerAddress(peer.RaftAddr),
+			})
+		}
+		bootStrapFut := s.raft.BootstrapCluster(raftConfig)
+		if bootStrapFut.Error() != nil {
+			s.logger.Fatal().Msgf("Unable to bootstrap raft cluster with static peers. Error: %s", bootStrapFut.Error())
+		}
+		s.logger.Info().Msgf("Bootstrapped raft cluster with %d static peers", len(peers))
+
+		if err := backoff.Retry(s.leaderReadinessChecker, exponentialBackoffEngine); err != nil {
+			s.logger.Fatal().Msg("No leader elected among the static peers!")
+		}
+	} else if s.ServiceConfig.RaftLeader {
 		raftConfig := raft.Configuration{
 			Servers: []raft.Server{
 				{
 					ID:      config.LocalID,
-					Address: transport.LocalAddr(),
+					Address: s.transport.LocalAddr(),
 				},
 			},
 		}
@@ -116,54 +372,51 @@ func (s *DKVService) initializeRaftCluster() {
 			s.logger.Fatal().Msg("Unable to bootstrap raft cluster with leader")
 		}
 
-		// readiness checker for the leader.
-		leaderReadinessChecker := func() error {
-
-			lAddr, lID := s.raft.LeaderWithID()
-			if lAddr == "" || lID == "" {
-				s.logger.Info().Msg("Raft Leader election in progress...")
-				return errors.New("Leader not ready!")
-			}
-			s.logger.Info().Msg("Leader ready!!")
-			return nil
-		}
-
-		err := backoff.Retry(leaderReadinessChecker, exponentialBackoffEngine)
+		err := backoff.Retry(s.leaderReadinessChecker, exponentialBackoffEngine)
 		if err != nil {
 			s.logger.Fatal().Msg("Leader not promoted yet!")
 		}
 
 	} else {
-		// TODO: calling registering follower next, possibly with exponential backoff
 		s.logger.Info().Msg("registering as follower ....")
 		followerBody := RegisterFollowerRequest{
-			FollowerId:   s.ServiceConfig.RaftNodeID,
-			FollowerAddr: s.ServiceConfig.RaftAddr,
+			FollowerId:       s.ServiceConfig.RaftNodeID,
+			FollowerAddr:     s.ServiceConfig.RaftAddr,
+			FollowerHTTPAddr: s.ServiceConfig.HTTPAddr,
+			Role:             s.ServiceConfig.RaftRole,
 		}
 		b, err := json.Marshal(followerBody)
 		if err != nil {
 			s.logger.Error().Msgf("Unable to unmarshal follower request. Error: %s", err)
 		}
 
-		leaderURL := fmt.Sprintf("http://%s/register-follower", s.ServiceConfig.RaftJoinAddr)
+		// Any live member can take the registration, followers forward it to
+		// the leader. Each attempt walks the whole list of join addresses.
 		tryJoin := func() error {
-			resp, err := http.Post(leaderURL, "application/json", bytes.NewReader(b))
-			if err != nil {
-				s.logger.Error().Msgf("Unable to call register-follower. Got error: %s", err)
-				return err
+			for _, joinAddr := range s.ServiceConfig.RaftJoinAddr {
+				req, err := s.newPeerRequest(http.MethodPost, joinAddr, "/register-follower", bytes.NewReader(b))
+				if err != nil {
+					return backoff.Permanent(err)
+				}
+				req.Header.Set("Content-Type", "application/json")
+				resp, err := s.peerClient.Do(req)
+				if err != nil {
+					s.logger.Error().Msgf("Unable to call register-follower on %s. Got error: %s", joinAddr, err)
+					continue
+				}
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					s.logger.Info().Msgf("done calling register-follower on %s", joinAddr)
+					return nil
+				}
+				s.logger.Error().Msgf("POST /register-follower on %s answered %d", joinAddr, resp.StatusCode)
 			}
-
-			if resp.StatusCode != http.StatusOK {
-				return errors.New("POST /register-follower failed... trying again")
-			}
-			defer resp.Body.Close()
-			return nil
+			return errors.New("POST /register-follower failed on every join address... trying again")
 		}
 		err = backoff.Retry(tryJoin, exponentialBackoffEngine)
 		if err != nil {
-			s.logger.Fatal().Msg("Unable to send register-follower to leader")
+			s.logger.Fatal().Msg("Unable to send register-follower to any join address")
 		}
-		s.logger.Info().Msg("done calling register-follower on the leader")
 		s.logger.Info().Msg("registration complete!!!")
 	}
 	s.logger.Info().Msgf("Raft Node State: %+v", s.raft.State())
@@ -171,122 +424,263 @@ func (s *DKVService) initializeRaftCluster() {
 
 }
 
+// newNetworkTransport listens for raft traffic on RaftAddr, over mutual TLS
+// when RaftTLS is set.
+func (s *DKVService) newNetworkTransport(raftRef *atomic.Pointer[raft.Raft]) (*raft.NetworkTransport, error) {
+	addr, err := net.ResolveTCPAddr("tcp", s.ServiceConfig.RaftAddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %s: %w", s.ServiceConfig.RaftAddr, err)
+	}
+	if !s.ServiceConfig.RaftTLS.Enabled() {
+		return raft.NewTCPTransport(s.ServiceConfig.RaftAddr, addr, 3, 10*time.Second, os.Stderr)
+	}
+
+	certs, err := tlsconfig.New(s.logger, s.ServiceConfig.RaftTLS)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the raft TLS files: %w", err)
+	}
+	var watchCtx context.Context
+	watchCtx, s.stopRaftTLSWatch = context.WithCancel(context.Background())
+	go certs.Watch(watchCtx)
+
+	layer, err := newTLSStreamLayer(s.ServiceConfig.RaftAddr, addr, certs, func() raft.Configuration {
+		if r := raftRef.Load(); r != nil {
+			return r.GetConfiguration().Configuration()
+		}
+		return raft.Configuration{}
+	})
+	if err != nil {
+		s.stopRaftTLSWatch()
+		return nil, err
+	}
+	return raft.NewNetworkTransport(layer, 3, 10*time.Second, os.Stderr), nil
+}
+
+// leaderReadinessChecker fails until raft knows a leader. It is retried
+// with backoff while a freshly bootstrapped cluster elects one.
+func (s *DKVService) leaderReadinessChecker() error {
+	lAddr, lID := s.raft.LeaderWithID()
+	if lAddr == "" || lID == "" {
+		s.logger.Info().Msg("Raft Leader election in progress...")
+		return errors.New("Leader not ready!")
+	}
+	s.logger.Info().Msg("Leader ready!!")
+	return nil
+}
+
 func (s *DKVService) Get(key string) (string, error) {
+	entry, err := s.GetEntry(key)
+	if err != nil {
+		return "", err
+	}
+	return entry.Val, nil
+}
+
+// GetEntry returns the value of key together with its modification revision.
+func (s *DKVService) GetEntry(key string) (Entry, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, ok := s.kvmap[key]; !ok {
-		return "", errors.New("key not found")
+	entry, ok := s.getLocked(key)
+	if !ok || entry.expiredAt(time.Now().UnixMilli()) {
+		return Entry{}, KeyNotFound
 	}
-
-	return s.kvmap[key], nil
+	return entry, nil
 }
 
-func (s *DKVService) Set(key, val string) (string, error) {
+// KeyCount returns the number of keys held by the local FSM.
+func (s *DKVService) KeyCount() int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	// In debug mode, we shortcuit early
+
+	return s.kvtree.Len()
+}
+
+// Set creates key. It fails with KeyAlreadyExists if the key is present.
+func (s *DKVService) Set(key, val string) (string, error) {
+	if _, _, err := s.Put(key, val, WriteCreateOnly, 0); err != nil {
+		return "", err
+	}
+	return val, nil
+}
+
+// Put writes key according to mode and reports whether the key was created
+// along with the new revision. The mode is checked by the FSM against the
+// replicated state, so the outcome is the same on every node regardless of
+// what the leader saw.
+//
+// A positive ttl makes the key expire that long after the write. A write
+// without ttl clears any previous expiry.
+func (s *DKVService) Put(key, val string, mode WriteMode, ttl time.Duration) (bool, uint64, error) {
+	result, err := s.set(withTTL(command{Op: opSet, Key: key, Val: val, Mode: mode}, ttl))
+	return result.Created, result.Revision, err
+}
+
+// CompareAndSwap overwrites key only if its current revision is revision and
+// returns the new revision. It fails with KeyNotFound if the key is absent
+// and RevisionMismatch if it was modified in the meantime.
+func (s *DKVService) CompareAndSwap(key, val string, revision uint64) (uint64, error) {
+	return s.CompareAndSwapTTL(key, val, revision, 0)
+}
+
+// CompareAndSwapTTL is CompareAndSwap for a value that expires after ttl.
+func (s *DKVService) CompareAndSwapTTL(key, val string, revision uint64, ttl time.Duration) (uint64, error) {
+	cmd := command{Op: opSet, Key: key, Val: val, CheckRevision: true, Revision: revision}
+	result, err := s.set(withTTL(cmd, ttl))
+	return result.Revision, err
+}
+
+func (s *DKVService) set(cmd command) (writeResult, error) {
+	resp, err := s.propose(cmd)
+	if err != nil {
+		return writeResult{}, err
+	}
+	result, _ := resp.(writeResult)
+	return result, nil
+}
+
+// Shutdown stops raft and closes the raft store. A leader first hands its
+// leadership to another voter so the cluster does not sit through an election
+// timeout without a leader.
+func (s *DKVService) Shutdown() error {
 	if s.ServiceConfig.Debug {
-		s.kvmap[key] = val
-		return val, nil
+		return nil
 	}
 
-	leaderAddr, leaderId := s.raft.LeaderWithID()
-	if leaderAddr == "" || leaderId == "" {
-		s.logger.Error().Msg("Leader not ready yet!! please try later")
-		return "", LeaderNotReady
+	if s.raft.State() == raft.Leader {
+		s.logger.Info().Msg("Transferring leadership before shutting down")
+		if err := s.raft.LeadershipTransfer().Error(); err != nil {
+			s.logger.Error().Msgf("Leadership transfer failed, shutting down anyway. Error: %s", err)
+		}
 	}
-	errStr := fmt.Sprintf("set can be done only on leader node. The leader addr is: %s the nodeid is: %s",
-		leaderAddr, leaderId)
 
-	if s.raft.State() != raft.Leader {
-		s.logger.Error().Msg(errStr)
-		return "", errors.New(errStr)
+	return s.Close()
+}
+
+// Close stops raft and closes the raft store right away. Unlike Shutdown, a
+// leader does not hand over its leadership first, so the cluster goes through
+// an election as it would after a crash.
+func (s *DKVService) Close() error {
+	if s.ServiceConfig.Debug {
+		return nil
 	}
 
-	if _, ok := s.kvmap[key]; ok {
-		return "", errors.New("key already exists")
+	if err := s.raft.Shutdown().Error(); err != nil {
+		return fmt.Errorf("raft shutdown failed: %w", err)
+	}
+	if s.raftStore != nil {
+		if err := s.raftStore.Close(); err != nil {
+			return fmt.Errorf("closing raft store failed: %w", err)
+		}
+	}
+	if closer, ok := s.transport.(raft.WithClose); ok {
+		if err := closer.Close(); err != nil {
+			return fmt.Errorf("closing raft transport failed: %w", err)
+		}
 	}
+	if s.stopRaftTLSWatch != nil {
+		s.stopRaftTLSWatch()
+	}
+	s.logger.Info().Msg("Raft shut down")
+	return nil
+}
 
-	cmdStr := fmt.Sprintf("command:SET,key:%s,val:%s", key, val)
-	applyFut := s.raft.Apply([]byte(cmdStr), s.ServiceConfig.RaftTimeout)
-	err := applyFut.Error()
-	if err != nil {
+func (s *DKVService) Delete(key string) (string, error) {
+	if _, err := s.propose(command{Op: opDel, Key: key}); err != nil {
 		return "", err
 	}
-	return val, nil
+	return key, nil
+}
 
+// CompareAndDelete removes key only if its current revision is revision.
+func (s *DKVService) CompareAndDelete(key string, revision uint64) error {
+	_, err := s.propose(command{Op: opDel, Key: key, CheckRevision: true, Revision: revision})
+	return err
 }
 
-func (s *DKVService) Delete(key string) (string, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// propose replicates cmd through raft and returns the FSM's response for it.
+// In debug mode there is no raft, so cmd is applied to the local FSM directly.
+func (s *DKVService) propose(cmd command) (any, error) {
+	if cmd.Now == 0 {
+		cmd.Now = time.Now().UnixMilli()
+	}
 
-	// In debug mode, we shortcircuit early
+	var resp any
 	if s.ServiceConfig.Debug {
-		if _, ok := s.kvmap[key]; !ok {
-			return "", errors.New("key not found")
+		resp = s.applyCommand(cmd, 0)
+	} else {
+		if err := s.checkLeader(); err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		applyFut := s.raft.Apply(encodeCommand(cmd), s.ServiceConfig.RaftTimeout)
+		if err := applyFut.Error(); err != nil {
+			return nil, err
 		}
-		delete(s.kvmap, key)
-		return key, nil
+		s.applyDuration.Observe(time.Since(start).Seconds())
+		resp = applyFut.Response()
 	}
 
+	if err, ok := resp.(error); ok {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// checkLeader returns nil when this node is the raft leader. Otherwise it
+// returns LeaderNotReady if no leader is known yet, or an error wrapping
+// NotLeader that names the current leader.
+func (s *DKVService) checkLeader() error {
 	leaderAddr, leaderId := s.raft.LeaderWithID()
 	if leaderAddr == "" || leaderId == "" {
 		s.logger.Error().Msg("Leader not ready yet!! please try later")
-		return "", LeaderNotReady
+		return LeaderNotReady
 	}
-	errStr := fmt.Sprintf("set can be done only on leader node. The leader addr is: %s the nodeid is: %s",
-		leaderAddr, leaderId)
 
 	if s.raft.State() != raft.Leader {
-		s.logger.Error().Msg(errStr)
-		return "", errors.New(errStr)
-	}
-	if _, ok := s.kvmap[key]; !ok {
-		return "", errors.New("key not found")
+		err := fmt.Errorf("%w. The leader addr is: %s the nodeid is: %s", NotLeader, leaderAddr, leaderId)
+		s.logger.Error().Msg(err.Error())
+		return err
 	}
+	return nil
+}
 
-	cmdStr := fmt.Sprintf("command:DEL,key:%s", key)
-	applyFut := s.raft.Apply([]byte(cmdStr), s.ServiceConfig.RaftTimeout)
-	err := applyFut.Error()
+func (s *DKVService) RegisterFollower(followerId, followerAddr, followerHTTPAddr, role string) error {
+	role, err := ParseRole(role)
 	if err != nil {
-		return "", err
+		return err
 	}
-	return key, nil
 
-}
+	// only the leader can change the configuration. Followers hand the
+	// registration on through the NotLeader error.
+	if err := s.checkLeader(); err != nil {
+		return err
+	}
 
-func (s *DKVService) RegisterFollower(followerId, followerAddr string) error {
 	// get raft configs
 	confFuture := s.raft.GetConfiguration()
-	err := confFuture.Error()
+	err = confFuture.Error()
 	if err != nil {
-		s.logger.Error().Msgf("Unable to get raft conf as follower: %q", err)
+		s.logger.Error().Msgf("Unable to get raft conf: %q", err)
 		return err
 	}
-
 	raftServers := confFuture.Configuration().Servers
-	if len(raftServers) == 0 {
-		s.logger.Fatal().Msg("No servers found. please initalize the leader first!")
-	}
-
-	_, leaderId := s.raft.LeaderWithID()
-	if leaderId == "" {
-		s.logger.Error().Msg("no leader in raft cluster yet")
-		return errors.New("no leader in raft cluster yet")
-	}
 
 	for _, rServer := range raftServers {
 		if rServer.ID == raft.ServerID(followerId) && rServer.Address == raft.ServerAddress(followerAddr) {
 			s.logger.Info().Msgf("NodeID %s already present in raft config... no need to re-register.", followerId)
-			return nil
+			return s.registerNodeMeta(followerId, followerAddr, followerHTTPAddr)
 		}
 	}
 
 	// If not present in config
 	// now we are clear to add this new raft server to the mix!
-	addFuture := s.raft.AddVoter(
+	addServer := s.raft.AddVoter
+	if role == RoleNonvoter {
+		addServer = s.raft.AddNonvoter
+	}
+	addFuture := addServer(
 		raft.ServerID(followerId),
 		raft.ServerAddress(followerAddr),
 		0, s.ServiceConfig.RaftTimeout,
@@ -299,38 +693,90 @@ func (s *DKVService) RegisterFollower(followerId, followerAddr string) error {
 			s.ServiceConfig.RaftNodeID, s.ServiceConfig.RaftAddr)
 		return err
 	}
-	s.logger.Info().Msgf("Follower registered. FollowerID: %s FollowerAddr: %s", followerId, followerAddr)
-	return nil
+	s.logger.Info().Msgf("Follower registered. FollowerID: %s FollowerAddr: %s Role: %s", followerId, followerAddr, role)
+	return s.registerNodeMeta(followerId, followerAddr, followerHTTPAddr)
 
 }
 
 func (s *DKVService) PrintConfigs() {
 	s.logger.Info().Msg("--- KVService Config ---")
-	s.logger.Info().Msgf("%+v", s.ServiceConfig)
+	config := s.ServiceConfig
+	if config.AuthBootstrapToken != "" {
+		config.AuthBootstrapToken = "<redacted>"
+	}
+	s.logger.Info().Msgf("%+v", config)
 	s.logger.Info().Msg("--- KVService Config ---")
 
 }
 
 // FSM interface funcs
 func (s *DKVService) Apply(log *raft.Log) any {
-	cmd := string(log.Data)
-	segments := ExtractCmdSegments(cmd)
-	cmdLabel := ExtractCommand(segments[0])
-	key := ExtractKey(segments[1])
-
-	// Del does not have val
-	var val string
-	if len(segments) == 3 {
-		val = ExtractVal(segments[2])
-	}
-
-	switch cmdLabel {
-	case "SET":
-		s.kvmap[key] = val
-	case "DEL":
-		delete(s.kvmap, key)
+	cmd, err := decodeCommand(log.Data)
+	if err != nil {
+		s.logger.Error().Msgf("Unable to decode raft log at index %d. Error: %s", log.Index, err)
+		return err
+	}
+	return s.applyCommand(cmd, log.Index)
+}
+
+// applyCommand mutates the FSM state. Every decision made here must only
+// depend on cmd and the replicated state so all replicas end up identical.
+// The returned value is handed back to the proposer as the apply response.
+func (s *DKVService) applyCommand(cmd command, index uint64) any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if index == 0 {
+		// debug mode has no raft log, so writes are numbered locally.
+		index = s.appliedIndex.Load() + 1
+	}
+	s.appliedIndex.Store(index)
+
+	switch cmd.Op {
+	case opSet:
+		current, exists := s.getLocked(cmd.Key)
+		// An expired key that was not reaped yet counts as absent.
+		exists = exists && !current.expiredAt(cmd.Now)
+		switch {
+		case cmd.Mode == WriteCreateOnly && exists:
+			return KeyAlreadyExists
+		case cmd.Mode == WriteUpdateOnly && !exists:
+			return KeyNotFound
+		case cmd.CheckRevision && !exists:
+			return KeyNotFound
+		case cmd.CheckRevision && current.Revision != cmd.Revision:
+			return fmt.Errorf("%w. Expected: %d, current: %d", RevisionMismatch, cmd.Revision, current.Revision)
+		}
+		s.putLocked(cmd.Key, Entry{Val: cmd.Val, Revision: index, ExpiresAt: cmd.ExpiresAt})
+		s.watch.publish(WatchEvent{Type: WatchEventSet, Key: cmd.Key, Val: cmd.Val, Index: index})
+		return writeResult{Created: !exists, Revision: index}
+	case opDel:
+		current, ok := s.getLocked(cmd.Key)
+		if !ok || current.expiredAt(cmd.Now) {
+			return KeyNotFound
+		}
+		if cmd.CheckRevision && current.Revision != cmd.Revision {
+			return fmt.Errorf("%w. Expected: %d, current: %d", RevisionMismatch, cmd.Revision, current.Revision)
+		}
+		s.deleteLocked(cmd.Key)
+		s.watch.publish(WatchEvent{Type: WatchEventDelete, Key: cmd.Key, Index: index})
+	case opExpire:
+		current, ok := s.getLocked(cmd.Key)
+		if !ok || current.Revision != cmd.Revision || !current.expiredAt(cmd.Now) {
+			// rewritten or already gone since the leader decided to expire it.
+			return nil
+		}
+		s.deleteLocked(cmd.Key)
+		s.watch.publish(WatchEvent{Type: WatchEventDelete, Key: cmd.Key, Index: index})
+	case opTxn:
+		return s.applyTxn(cmd.Txn, cmd.Now, index)
+	case opSetNode:
+		s.nodes[cmd.Key] = NodeMeta{RaftAddr: cmd.RaftAddr, HTTPAddr: cmd.HTTPAddr}
+	case opDelNode:
+		delete(s.nodes, cmd.Key)
+	case opSetRole, opDelRole, opSetToken, opDelToken:
+		return s.applyAuthLocked(cmd)
 	default:
-		s.logger.Error().Msg("Unknown command label. Only SET and DEL are supported")
+		s.logger.Error().Msg("Unknown command label. Only SET, DEL, EXPIRE, TXN, SETNODE, DELNODE and the auth commands are supported")
 		return errors.New("unknown command label. Apply failed")
 	}
 
@@ -341,70 +787,37 @@ func (s *DKVService) Snapshot() (raft.FSMSnapshot, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	clonedMap := maps.Clone(s.kvmap)
-
-	return &snapshot{kvmap: clonedMap}, nil
+	compression, _ := ParseSnapshotCompression(s.ServiceConfig.SnapshotCompression)
+	return &snapshot{
+		index:       s.appliedIndex.Load(),
+		kvtree:      s.kvtree,
+		nodes:       maps.Clone(s.nodes),
+		roles:       maps.Clone(s.roles),
+		tokens:      maps.Clone(s.tokens),
+		compression: compression,
+	}, nil
 
 }
 func (s *DKVService) Restore(snapshot io.ReadCloser) error {
-	reconstructedKVMap := make(map[string]string)
-	decoder := json.NewDecoder(snapshot)
-
-	if err := decoder.Decode(&reconstructedKVMap); err != nil {
-		s.logger.Error().Msg("Unable to restore map from snapshot")
-		return err
-	}
-	s.kvmap = reconstructedKVMap
-
-	return nil
-}
-
-func ExtractCmdSegments(cmd string) []string {
-	segments := strings.Split(cmd, ",")
-	return segments
-}
-
-func ExtractCommand(cmdSegment string) string {
-	segments := strings.Split(cmdSegment, ":")
-	return segments[1]
-}
-
-func ExtractKey(cmdSegment string) string {
-	segments := strings.Split(cmdSegment, ":")
-	return segments[1]
-}
-
-func ExtractVal(cmdSegment string) string {
-	segments := strings.Split(cmdSegment, ":")
-	return segments[1]
-}
-
-type snapshot struct {
-	kvmap map[string]string
-}
-
-func (snap *snapshot) Persist(sink raft.SnapshotSink) error {
-
-	// Encode data.
-	b, err := json.Marshal(snap.kvmap)
+	data, err := readSnapshot(snapshot)
 	if err != nil {
+		s.logger.Error().Msgf("Unable to restore map from snapshot. Error: %s", err)
 		return err
 	}
 
-	// Write data to sink.
-	if _, err := sink.Write(b); err != nil {
-		return err
-	}
-
-	// Close the sink.
-	err = sink.Close()
-
-	if err != nil {
-		sink.Cancel()
-		return err
-	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kvtree = data.kvtree
+	s.kvBytes = data.kvBytes
+	s.nodes = data.nodes
+	s.roles = data.roles
+	s.tokens = data.tokens
+
+	// a restored backup carries the index raft installed it at, see
+	// RestoreBackup, so the applied index does not go back and watchers
+	// resuming from before the restore get HistoryCompacted.
+	s.appliedIndex.Store(data.index)
+	s.watch.reset(data.index)
 
 	return nil
 }
-
-func (snap *snapshot) Release() {}
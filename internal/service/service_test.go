@@ -105,7 +105,7 @@ func TestRaftWithOneNodesSetAndGet(t *testing.T) {
 		MaxMapSize:   1000,
 		RaftNodeID:   "1",
 		RaftAddr:     "localhost:23001",
-		RaftStoreDir: "./test-raft-dir",
+		RaftStoreDir: t.TempDir(),
 		RaftLeader:   true,
 		Debug:        false,
 	}
@@ -219,3 +219,139 @@ func BenchmarkNoRaftWithOneNodesSetAndGet(b *testing.B) {
 	b.StopTimer()
 
 }
+
+func TestRaftRestartKeepsState(t *testing.T) {
+	serviceConfig := Config{
+		KeyMaxLen:    100,
+		ValMaxLen:    200,
+		MaxMapSize:   1000,
+		RaftNodeID:   "1",
+		RaftAddr:     "localhost:23101",
+		RaftStoreDir: t.TempDir(),
+		RaftTimeout:  5 * time.Second,
+		RaftLeader:   true,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+
+	kv_service := New(zlogger, serviceConfig)
+	if _, err := kv_service.Set("a", "b"); err != nil {
+		t.Fatalf("SET key failed: %s", err)
+	}
+	if err := kv_service.raft.Shutdown().Error(); err != nil {
+		t.Fatalf("raft shutdown failed: %s", err)
+	}
+	if err := kv_service.raftStore.Close(); err != nil {
+		t.Fatalf("raft store close failed: %s", err)
+	}
+
+	// The restarted node must skip bootstrap and replay its own log.
+	restarted := New(zlogger, serviceConfig)
+	deadline := time.Now().Add(serviceConfig.RaftTimeout)
+	for {
+		val, err := restarted.Get("a")
+		if err == nil {
+			if val != "b" {
+				t.Fatalf("GET after restart failed. Expected: b, got: %s", val)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("key not restored after restart: %s", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestRestoreSnapshotFormats(t *testing.T) {
+	zlogger := zerolog.New(io.Discard)
+	kv_service := New(zlogger, Config{RaftNodeID: "1", Debug: true})
+
+	legacy := `{"a":"b","version":"v1"}`
+	if err := kv_service.Restore(io.NopCloser(bytes.NewBufferString(legacy))); err != nil {
+		t.Fatalf("restore of legacy snapshot failed: %s", err)
+	}
+	if val, err := kv_service.Get("version"); err != nil || val != "v1" {
+		t.Fatalf("legacy snapshot not restored. Expected: v1, got: %q err: %v", val, err)
+	}
+
+}
+
+func TestForwardLoopProtection(t *testing.T) {
+	zlogger := zerolog.New(io.Discard)
+	kv_service := New(zlogger, Config{RaftNodeID: "2", Debug: true})
+
+	req := httptest.NewRequest("POST", "/key", nil)
+	req.Header.Set(ForwardedByHeader, "1")
+	rr := httptest.NewRecorder()
+	forwardToLeader(kv_service, rr, req, nil)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("forwarded request should not be forwarded again. Expected: %d, got: %d",
+			http.StatusServiceUnavailable, rr.Code)
+	}
+}
+
+func TestRaftConsistencyLevels(t *testing.T) {
+	config := router.Config{
+		RequestTimeout: 60 * time.Second,
+	}
+	sLeaderConfig := server.Config{
+		Address:         "localhost:9999",
+		ShutdownTimeout: time.Second * 5,
+	}
+	serviceLeaderConfig := Config{
+		KeyMaxLen:    100,
+		ValMaxLen:    200,
+		MaxMapSize:   1000,
+		RaftNodeID:   "1",
+		RaftAddr:     "localhost:23201",
+		RaftStoreDir: t.TempDir(),
+		RaftTimeout:  5 * time.Second,
+		RaftLeader:   true,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+	router := router.New(config, zlogger)
+	kv_service := New(zlogger, serviceLeaderConfig)
+	httpLeaderServer := server.New(zlogger, router.GetRouter(), sLeaderConfig, kv_service)
+
+	httpLeaderServer.AddHandler(server.GET, "/key/{id}", GetHandler)
+
+	if _, err := kv_service.Set("a", "b"); err != nil {
+		t.Fatalf("SET key failed: %s", err)
+	}
+
+	for _, level := range []string{"stale", "leader-lease", "linearizable"} {
+		reqUrl := fmt.Sprintf("http://%s/key/a?consistency=%s", sLeaderConfig.Address, level)
+		getReq, err := http.NewRequest("GET", reqUrl, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		httpLeaderServer.GetRouter().ServeHTTP(rr, getReq)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET with %s failed. Expected: %d, got: %d", level, http.StatusOK, rr.Code)
+		}
+		if rr.Header().Get(LastAppliedIndexHeader) == "" || rr.Header().Get(LastAppliedIndexHeader) == "0" {
+			t.Fatalf("GET with %s is missing %s", level, LastAppliedIndexHeader)
+		}
+	}
+
+	reqUrl := fmt.Sprintf("http://%s/key/a?consistency=eventual", sLeaderConfig.Address)
+	getReq, err := http.NewRequest("GET", reqUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	httpLeaderServer.GetRouter().ServeHTTP(rr, getReq)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("GET with unknown consistency. Expected: %d, got: %d", http.StatusBadRequest, rr.Code)
+	}
+}
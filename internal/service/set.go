@@ -3,7 +3,9 @@ package service
 import (
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
+	"time"
 
 	"github.com/tomkaith13/dist-kv-store/internal/server"
 )
@@ -11,14 +13,27 @@ import (
 type SetRequestBody struct {
 	Key string `json:"key"`
 	Val string `json:"value"`
+	// TTL is the number of seconds after which the key expires. 0 keeps it forever.
+	TTL int64 `json:"ttl"`
 }
 
+var (
+	InvalidTTL error = errors.New("ttl must be a non-negative number of seconds")
+)
+
 func SetHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
 
 	var reqBody SetRequestBody
 	defer r.Body.Close()
 
-	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	// The raw body is kept around in case the write has to be forwarded to the leader.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return
+	}
+
+	err = json.Unmarshal(body, &reqBody)
 	if err != nil {
 		err := errors.New("Unable to decode body")
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -31,6 +46,11 @@ func SetHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := dkvService.Authorize(r, AccessWrite, reqBody.Key); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	// Validations for key and val
 	if len(reqBody.Key) > dkvService.ServiceConfig.KeyMaxLen {
 		err := errors.New("key size exceeded")
@@ -44,18 +64,29 @@ func SetHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(dkvService.kvmap) > dkvService.ServiceConfig.MaxMapSize {
+	if reqBody.TTL < 0 {
+		http.Error(w, InvalidTTL.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if dkvService.KeyCount() > dkvService.ServiceConfig.MaxMapSize {
 		err := errors.New("max keys exceeded")
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	_, err = dkvService.Set(reqBody.Key, reqBody.Val)
+	_, _, err = dkvService.Put(reqBody.Key, reqBody.Val, WriteCreateOnly, time.Duration(reqBody.TTL)*time.Second)
 	if err != nil {
-		if errors.Is(err, LeaderNotReady) {
+		switch {
+		case errors.Is(err, NotLeader):
+			forwardToLeader(dkvService, w, r, body)
+		case errors.Is(err, LeaderNotReady):
 			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case errors.Is(err, KeyAlreadyExists):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
-		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
 
@@ -0,0 +1,505 @@
+package service
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"maps"
+	"slices"
+
+	iradix "github.com/hashicorp/go-immutable-radix"
+	"github.com/hashicorp/raft"
+	"github.com/klauspost/compress/zstd"
+)
+
+// snapshotVersion is the snapshot layout Persist writes and Restore reads,
+// the streamed layout below. Snapshots taken before it are a bare JSON object
+// of kv pairs.
+//
+// A streamed snapshot is laid out as:
+//
+//	magic | version(1) | compression(1) | entries(uvarint) | nodes(uvarint) | index(uvarint)
+//	roles(uvarint) | tokens(uvarint)
+//	{ len(uvarint) | record }... | 0(uvarint) | crc32c(4, big endian)
+//
+// Everything after the header is compressed as a single stream. The CRC covers
+// the header and the uncompressed records, and sits inside the compressed
+// stream right after the end marker.
+const snapshotVersion = 5
+
+const (
+	snapshotMagic = "DKVS"
+	// snapshotMaxRecord bounds a single record so a corrupt length cannot
+	// make Restore allocate unbounded memory.
+	snapshotMaxRecord = 16 << 20
+)
+
+// record kinds of a streamed snapshot. A record is the kind byte followed by
+// fields encoded like raft commands.
+const (
+	recordEntry byte = iota + 1
+	recordNode
+	// recordRole and recordToken hold the name, or token hash, as key and
+	// the JSON definition as value.
+	recordRole
+	recordToken
+)
+
+// compression of the records of a streamed snapshot.
+const (
+	compressionNone byte = iota
+	compressionGzip
+	compressionZstd
+)
+
+var (
+	InvalidSnapshot     error = errors.New("snapshot is corrupt")
+	UnsupportedSnapshot error = errors.New("snapshot format is not supported")
+	InvalidCompression  error = errors.New("invalid snapshot compression. Use none, gzip or zstd")
+)
+
+var snapshotCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ParseSnapshotCompression validates a SNAPSHOT_COMPRESSION value. An empty
+// value defaults to gzip.
+func ParseSnapshotCompression(compression string) (byte, error) {
+	switch compression {
+	case "", "gzip":
+		return compressionGzip, nil
+	case "none":
+		return compressionNone, nil
+	case "zstd":
+		return compressionZstd, nil
+	default:
+		return 0, fmt.Errorf("%w. Got: %q", InvalidCompression, compression)
+	}
+}
+
+type snapshot struct {
+	index       uint64
+	kvtree      *iradix.Tree
+	nodes       map[string]NodeMeta
+	roles       map[string]AuthRole
+	tokens      map[string]APIToken
+	compression byte
+}
+
+func (snap *snapshot) Persist(sink raft.SnapshotSink) error {
+	if err := snap.write(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+	if err := sink.Close(); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return nil
+}
+
+func (snap *snapshot) Release() {}
+
+// write streams the snapshot to w one record at a time, so persisting never
+// holds more than one encoded entry in memory.
+func (snap *snapshot) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	crc := crc32.New(snapshotCRCTable)
+
+	header := make([]byte, 0, len(snapshotMagic)+2+5*binary.MaxVarintLen64)
+	header = append(header, snapshotMagic...)
+	header = append(header, snapshotVersion, snap.compression)
+	header = binary.AppendUvarint(header, uint64(snap.kvtree.Len()))
+	header = binary.AppendUvarint(header, uint64(len(snap.nodes)))
+	header = binary.AppendUvarint(header, snap.index)
+	header = binary.AppendUvarint(header, uint64(len(snap.roles)))
+	header = binary.AppendUvarint(header, uint64(len(snap.tokens)))
+	crc.Write(header)
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	var body io.WriteCloser
+	switch snap.compression {
+	case compressionNone:
+		body = nopWriteCloser{bw}
+	case compressionGzip:
+		body = gzip.NewWriter(bw)
+	case compressionZstd:
+		enc, err := zstd.NewWriter(bw, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		body = enc
+	default:
+		return fmt.Errorf("%w. Got: %d", InvalidCompression, snap.compression)
+	}
+	records := io.MultiWriter(body, crc)
+
+	var rec, lenBuf []byte
+	writeRecord := func(rec []byte) error {
+		lenBuf = binary.AppendUvarint(lenBuf[:0], uint64(len(rec)))
+		if _, err := records.Write(lenBuf); err != nil {
+			return err
+		}
+		_, err := records.Write(rec)
+		return err
+	}
+
+	var err error
+	snap.kvtree.Root().Walk(func(k []byte, v interface{}) bool {
+		rec = appendEntryRecord(rec[:0], string(k), v.(Entry))
+		err = writeRecord(rec)
+		return err != nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range slices.Sorted(maps.Keys(snap.nodes)) {
+		rec = appendNodeRecord(rec[:0], id, snap.nodes[id])
+		if err := writeRecord(rec); err != nil {
+			return err
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(snap.roles)) {
+		if rec, err = appendJSONRecord(rec[:0], recordRole, name, snap.roles[name]); err != nil {
+			return err
+		}
+		if err := writeRecord(rec); err != nil {
+			return err
+		}
+	}
+	for _, hash := range slices.Sorted(maps.Keys(snap.tokens)) {
+		if rec, err = appendJSONRecord(rec[:0], recordToken, hash, snap.tokens[hash]); err != nil {
+			return err
+		}
+		if err := writeRecord(rec); err != nil {
+			return err
+		}
+	}
+
+	if _, err := records.Write([]byte{0}); err != nil {
+		return err
+	}
+	if _, err := body.Write(crc.Sum(nil)); err != nil {
+		return err
+	}
+	if err := body.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func appendEntryRecord(b []byte, key string, entry Entry) []byte {
+	b = append(b, recordEntry)
+	b = appendField(b, fieldKey, key)
+	b = appendField(b, fieldVal, entry.Val)
+	b = appendUvarintField(b, fieldRevision, entry.Revision)
+	if entry.ExpiresAt > 0 {
+		b = appendUvarintField(b, fieldExpiresAt, uint64(entry.ExpiresAt))
+	}
+	return b
+}
+
+func appendNodeRecord(b []byte, id string, node NodeMeta) []byte {
+	b = append(b, recordNode)
+	b = appendField(b, fieldKey, id)
+	b = appendField(b, fieldRaftAddr, node.RaftAddr)
+	return appendField(b, fieldHTTPAddr, node.HTTPAddr)
+}
+
+func appendJSONRecord(b []byte, kind byte, key string, v any) ([]byte, error) {
+	val, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, kind)
+	b = appendField(b, fieldKey, key)
+	return appendField(b, fieldVal, string(val)), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// snapshotData is the FSM state read back from a snapshot.
+type snapshotData struct {
+	version int
+	index   uint64
+	kvtree  *iradix.Tree
+	kvBytes int
+	nodes   map[string]NodeMeta
+	roles   map[string]AuthRole
+	tokens  map[string]APIToken
+}
+
+// readSnapshot reads a snapshot in the streamed layout or in the JSON layout
+// of older snapshots. Errors wrap InvalidSnapshot when the data is damaged and
+// UnsupportedSnapshot when it was written by a newer version.
+func readSnapshot(r io.Reader) (snapshotData, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(snapshotMagic))
+	if err != nil || string(magic) != snapshotMagic {
+		return readJSONSnapshot(br)
+	}
+	return readStreamedSnapshot(br)
+}
+
+// crcReader feeds every byte read through it to crc.
+type crcReader struct {
+	r interface {
+		io.Reader
+		io.ByteReader
+	}
+	crc hash.Hash32
+}
+
+func (cr *crcReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.crc.Write(p[:n])
+	return n, err
+}
+
+func (cr *crcReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func readStreamedSnapshot(br *bufio.Reader) (snapshotData, error) {
+	truncated := func(err error) error {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: truncated", InvalidSnapshot)
+		}
+		return fmt.Errorf("%w: %s", InvalidSnapshot, err)
+	}
+
+	crc := crc32.New(snapshotCRCTable)
+	hr := &crcReader{r: br, crc: crc}
+	header := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(hr, header); err != nil {
+		return snapshotData{}, truncated(err)
+	}
+	version, compression := header[len(snapshotMagic)], header[len(snapshotMagic)+1]
+	if version != snapshotVersion {
+		return snapshotData{}, fmt.Errorf("%w. Snapshot version: %d, supported: %d",
+			UnsupportedSnapshot, version, snapshotVersion)
+	}
+	var counts [5]uint64
+	for i := range counts {
+		n, err := binary.ReadUvarint(hr)
+		if err != nil {
+			return snapshotData{}, truncated(err)
+		}
+		counts[i] = n
+	}
+	entries, nodes, index, roles, tokens := counts[0], counts[1], counts[2], counts[3], counts[4]
+
+	var body interface {
+		io.Reader
+		io.ByteReader
+	}
+	switch compression {
+	case compressionNone:
+		body = br
+	case compressionGzip:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return snapshotData{}, truncated(err)
+		}
+		defer gz.Close()
+		body = bufio.NewReader(gz)
+	case compressionZstd:
+		dec, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return snapshotData{}, truncated(err)
+		}
+		defer dec.Close()
+		body = bufio.NewReader(dec)
+	default:
+		return snapshotData{}, fmt.Errorf("%w. Unknown compression: %d", UnsupportedSnapshot, compression)
+	}
+
+	data := snapshotData{
+		version: int(version),
+		index:   index,
+		nodes:   make(map[string]NodeMeta),
+		roles:   make(map[string]AuthRole),
+		tokens:  make(map[string]APIToken),
+	}
+	txn := iradix.New().Txn()
+	rr := &crcReader{r: body, crc: crc}
+	var rec []byte
+	for {
+		n, err := binary.ReadUvarint(rr)
+		if err != nil {
+			return snapshotData{}, truncated(err)
+		}
+		if n == 0 {
+			break
+		}
+		if n > snapshotMaxRecord {
+			return snapshotData{}, fmt.Errorf("%w: record of %d bytes", InvalidSnapshot, n)
+		}
+		rec = slices.Grow(rec[:0], int(n))[:n]
+		if _, err := io.ReadFull(rr, rec); err != nil {
+			return snapshotData{}, truncated(err)
+		}
+
+		switch rec[0] {
+		case recordEntry:
+			key, entry, err := decodeEntryRecord(rec[1:])
+			if err != nil {
+				return snapshotData{}, err
+			}
+			txn.Insert([]byte(key), entry)
+			data.kvBytes += entry.size(key)
+		case recordNode:
+			id, node, err := decodeNodeRecord(rec[1:])
+			if err != nil {
+				return snapshotData{}, err
+			}
+			data.nodes[id] = node
+		case recordRole:
+			var role AuthRole
+			name, err := decodeJSONRecord(rec[1:], &role)
+			if err != nil {
+				return snapshotData{}, err
+			}
+			data.roles[name] = role
+		case recordToken:
+			var token APIToken
+			hash, err := decodeJSONRecord(rec[1:], &token)
+			if err != nil {
+				return snapshotData{}, err
+			}
+			data.tokens[hash] = token
+		default:
+			return snapshotData{}, fmt.Errorf("%w. Unknown record kind: %d", UnsupportedSnapshot, rec[0])
+		}
+	}
+
+	want := crc.Sum32()
+	var sum [4]byte
+	if _, err := io.ReadFull(body, sum[:]); err != nil {
+		return snapshotData{}, truncated(err)
+	}
+	if got := binary.BigEndian.Uint32(sum[:]); got != want {
+		return snapshotData{}, fmt.Errorf("%w: checksum mismatch", InvalidSnapshot)
+	}
+	// reading up to EOF also makes the decompressor verify its own footer.
+	if _, err := body.ReadByte(); err != io.EOF {
+		if err == nil {
+			return snapshotData{}, fmt.Errorf("%w: trailing data after checksum", InvalidSnapshot)
+		}
+		return snapshotData{}, fmt.Errorf("%w: %s", InvalidSnapshot, err)
+	}
+
+	data.kvtree = txn.Commit()
+	if uint64(data.kvtree.Len()) != entries || uint64(len(data.nodes)) != nodes {
+		return snapshotData{}, fmt.Errorf("%w: expected %d entries and %d nodes, got %d and %d",
+			InvalidSnapshot, entries, nodes, data.kvtree.Len(), len(data.nodes))
+	}
+	if uint64(len(data.roles)) != roles || uint64(len(data.tokens)) != tokens {
+		return snapshotData{}, fmt.Errorf("%w: expected %d roles and %d tokens, got %d and %d",
+			InvalidSnapshot, roles, tokens, len(data.roles), len(data.tokens))
+	}
+	return data, nil
+}
+
+func decodeEntryRecord(rec []byte) (string, Entry, error) {
+	var key string
+	var entry Entry
+	err := decodeFields(rec, func(tag byte, val string) error {
+		var err error
+		switch tag {
+		case fieldKey:
+			key = val
+		case fieldVal:
+			entry.Val = val
+		case fieldRevision:
+			entry.Revision, err = decodeUvarintField(val)
+		case fieldExpiresAt:
+			var expiresAt uint64
+			expiresAt, err = decodeUvarintField(val)
+			entry.ExpiresAt = int64(expiresAt)
+		}
+		return err
+	})
+	if err != nil {
+		return "", Entry{}, fmt.Errorf("%w: %s", InvalidSnapshot, err)
+	}
+	return key, entry, nil
+}
+
+func decodeNodeRecord(rec []byte) (string, NodeMeta, error) {
+	var id string
+	var node NodeMeta
+	err := decodeFields(rec, func(tag byte, val string) error {
+		switch tag {
+		case fieldKey:
+			id = val
+		case fieldRaftAddr:
+			node.RaftAddr = val
+		case fieldHTTPAddr:
+			node.HTTPAddr = val
+		}
+		return nil
+	})
+	if err != nil {
+		return "", NodeMeta{}, fmt.Errorf("%w: %s", InvalidSnapshot, err)
+	}
+	return id, node, nil
+}
+
+// decodeJSONRecord decodes the value of a role or token record into v and
+// returns its key.
+func decodeJSONRecord(rec []byte, v any) (string, error) {
+	var key, val string
+	err := decodeFields(rec, func(tag byte, field string) error {
+		switch tag {
+		case fieldKey:
+			key = field
+		case fieldVal:
+			val = field
+		}
+		return nil
+	})
+	if err == nil {
+		err = json.Unmarshal([]byte(val), v)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", InvalidSnapshot, err)
+	}
+	return key, nil
+}
+
+// readJSONSnapshot reads the snapshots written before they were streamed,
+// a bare JSON object of kv pairs.
+func readJSONSnapshot(r io.Reader) (snapshotData, error) {
+	var kv map[string]string
+	if err := json.NewDecoder(r).Decode(&kv); err != nil {
+		return snapshotData{}, fmt.Errorf("%w: %s", InvalidSnapshot, err)
+	}
+
+	entries := make(map[string]Entry, len(kv))
+	data := snapshotData{
+		nodes:  make(map[string]NodeMeta),
+		roles:  make(map[string]AuthRole),
+		tokens: make(map[string]APIToken),
+	}
+	for key, val := range kv {
+		entries[key] = Entry{Val: val}
+		data.kvBytes += entries[key].size(key)
+	}
+	data.kvtree = treeFromEntries(entries)
+	return data, nil
+}
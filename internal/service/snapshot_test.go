@@ -0,0 +1,94 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	zlogger := zerolog.New(io.Discard)
+	source := New(zlogger, Config{RaftNodeID: "1", Debug: true})
+	source.mu.Lock()
+	for i := 0; i < 500; i++ {
+		entry := Entry{Val: fmt.Sprintf("val-%d", i), Revision: uint64(i + 1)}
+		if i%3 == 0 {
+			entry.ExpiresAt = 1700000000000 + int64(i)
+		}
+		source.putLocked(fmt.Sprintf("key-%03d", i), entry)
+	}
+	source.putLocked("", Entry{Val: "\x00binary\xff", Revision: 7})
+	source.nodes["1"] = NodeMeta{RaftAddr: "localhost:21001", HTTPAddr: "localhost:8888"}
+	source.nodes["2"] = NodeMeta{RaftAddr: "localhost:21002", HTTPAddr: "localhost:8889"}
+	source.roles["app"] = AuthRole{Name: "app", Rules: []ACLRule{{Prefix: "app/", Read: true, Write: true}}}
+	source.roles["ops"] = AuthRole{Name: "ops", Admin: true}
+	source.tokens[hashToken("dkv_secret")] = APIToken{Name: "ci", Roles: []string{"app"}}
+	source.appliedIndex.Store(42)
+	source.mu.Unlock()
+
+	for _, compression := range []string{"none", "gzip", "zstd"} {
+		source.ServiceConfig.SnapshotCompression = compression
+		fsmSnapshot, err := source.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := fsmSnapshot.(*snapshot).write(&buf); err != nil {
+			t.Fatalf("%s: write failed: %s", compression, err)
+		}
+
+		restored := New(zlogger, Config{RaftNodeID: "2", Debug: true})
+		if err := restored.Restore(io.NopCloser(bytes.NewReader(buf.Bytes()))); err != nil {
+			t.Fatalf("%s: restore failed: %s", compression, err)
+		}
+		if !reflect.DeepEqual(entriesFromTree(restored.kvtree), entriesFromTree(source.kvtree)) {
+			t.Fatalf("%s: restored entries differ", compression)
+		}
+		if !reflect.DeepEqual(restored.nodes, source.nodes) {
+			t.Fatalf("%s: restored nodes differ. Expected: %v, got: %v", compression, source.nodes, restored.nodes)
+		}
+		if !reflect.DeepEqual(restored.roles, source.roles) || !reflect.DeepEqual(restored.tokens, source.tokens) {
+			t.Fatalf("%s: restored auth differs. Expected: %v %v, got: %v %v",
+				compression, source.roles, source.tokens, restored.roles, restored.tokens)
+		}
+		if restored.kvBytes != source.kvBytes || restored.appliedIndex.Load() != 42 {
+			t.Fatalf("%s: restored kvBytes %d and index %d, expected %d and 42",
+				compression, restored.kvBytes, restored.appliedIndex.Load(), source.kvBytes)
+		}
+
+		// any damage to the snapshot is caught.
+		for _, at := range []int{len(snapshotMagic) + 3, buf.Len() / 2, buf.Len() - 2} {
+			damaged := bytes.Clone(buf.Bytes())
+			damaged[at] ^= 0x55
+			if _, err := readSnapshot(bytes.NewReader(damaged)); !errors.Is(err, InvalidSnapshot) {
+				t.Fatalf("%s: byte %d flipped. Expected InvalidSnapshot, got: %v", compression, at, err)
+			}
+		}
+		if _, err := readSnapshot(bytes.NewReader(buf.Bytes()[:buf.Len()-3])); !errors.Is(err, InvalidSnapshot) {
+			t.Fatalf("%s: truncated snapshot. Expected InvalidSnapshot, got: %v", compression, err)
+		}
+	}
+}
+
+func TestSnapshotVersions(t *testing.T) {
+	newer := []byte(snapshotMagic + "\x09\x00\x00\x00\x00")
+	if _, err := readSnapshot(bytes.NewReader(newer)); !errors.Is(err, UnsupportedSnapshot) {
+		t.Fatalf("newer streamed snapshot. Expected UnsupportedSnapshot, got: %v", err)
+	}
+	if _, err := readSnapshot(bytes.NewBufferString(`{"a":`)); !errors.Is(err, InvalidSnapshot) {
+		t.Fatalf("truncated JSON snapshot. Expected InvalidSnapshot, got: %v", err)
+	}
+
+	data, err := readSnapshot(bytes.NewBufferString(`{"a":"b"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := data.kvtree.Get([]byte("a")); !ok || entry.(Entry).Val != "b" || data.index != 0 || data.kvBytes != 2 {
+		t.Fatalf("unexpected JSON snapshot data: %+v", data)
+	}
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	iradix "github.com/hashicorp/go-immutable-radix"
+)
+
+// The FSM keeps its entries in an immutable radix tree ordered by key. Every
+// write swaps in a new root, so a snapshot or a range scan can hold on to a
+// root and walk it without blocking later writes.
+
+// getLocked returns the entry stored for key. s.mu must be held.
+func (s *DKVService) getLocked(key string) (Entry, bool) {
+	v, ok := s.kvtree.Get([]byte(key))
+	if !ok {
+		return Entry{}, false
+	}
+	return v.(Entry), true
+}
+
+// size is the number of bytes key and its entry account for in kvBytes.
+func (e Entry) size(key string) int {
+	return len(key) + len(e.Val)
+}
+
+// putLocked stores entry under key. s.mu must be held.
+func (s *DKVService) putLocked(key string, entry Entry) {
+	var old interface{}
+	var updated bool
+	s.kvtree, old, updated = s.kvtree.Insert([]byte(key), entry)
+	if updated {
+		s.kvBytes -= old.(Entry).size(key)
+	}
+	s.kvBytes += entry.size(key)
+}
+
+// deleteLocked removes key. s.mu must be held.
+func (s *DKVService) deleteLocked(key string) {
+	var old interface{}
+	var deleted bool
+	s.kvtree, old, deleted = s.kvtree.Delete([]byte(key))
+	if deleted {
+		s.kvBytes -= old.(Entry).size(key)
+	}
+}
+
+// tree returns the current root of the kv tree. The returned tree is
+// immutable and safe to read without holding s.mu.
+func (s *DKVService) tree() *iradix.Tree {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.kvtree
+}
+
+// treeFromEntries builds a kv tree in a single radix transaction.
+func treeFromEntries(entries map[string]Entry) *iradix.Tree {
+	txn := iradix.New().Txn()
+	for key, entry := range entries {
+		txn.Insert([]byte(key), entry)
+	}
+	return txn.Commit()
+}
+
+// entriesFromTree flattens a kv tree into a map.
+func entriesFromTree(tree *iradix.Tree) map[string]Entry {
+	entries := make(map[string]Entry, tree.Len())
+	tree.Root().Walk(func(k []byte, v interface{}) bool {
+		entries[string(k)] = v.(Entry)
+		return false
+	})
+	return entries
+}
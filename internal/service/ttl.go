@@ -0,0 +1,74 @@
+package service
+
+import (
+	"errors"
+	"time"
+)
+
+// maxExpiryBatch caps the number of keys reaped per expiry tick so a large
+// backlog of expired keys does not flood the raft log at once.
+const maxExpiryBatch = 256
+
+// withTTL stamps cmd with the proposer's clock and, for a positive ttl, the
+// absolute expiry time. Both travel in the raft log so every replica expires
+// the key at the same point in the log.
+func withTTL(cmd command, ttl time.Duration) command {
+	now := time.Now()
+	cmd.Now = now.UnixMilli()
+	if ttl > 0 {
+		cmd.ExpiresAt = now.Add(ttl).UnixMilli()
+	}
+	return cmd
+}
+
+type expiredKey struct {
+	key      string
+	revision uint64
+}
+
+// runExpiry periodically proposes EXPIRE commands for keys whose TTL ran out
+// until stopCh is closed. It only runs on the leader. Expired keys are hidden
+// from reads right away, this loop reclaims them on every replica.
+func (s *DKVService) runExpiry(stopCh <-chan struct{}) {
+	interval := s.ServiceConfig.ExpiryInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			s.expireKeys()
+		}
+	}
+}
+
+func (s *DKVService) expireKeys() {
+	now := time.Now().UnixMilli()
+
+	var expired []expiredKey
+	s.tree().Root().Walk(func(k []byte, v interface{}) bool {
+		entry := v.(Entry)
+		if entry.expiredAt(now) {
+			expired = append(expired, expiredKey{key: string(k), revision: entry.Revision})
+		}
+		return len(expired) == maxExpiryBatch
+	})
+
+	for _, e := range expired {
+		_, err := s.propose(command{Op: opExpire, Key: e.key, CheckRevision: true, Revision: e.revision, Now: now})
+		if errors.Is(err, NotLeader) || errors.Is(err, LeaderNotReady) {
+			return
+		}
+		if err != nil {
+			s.logger.Error().Msgf("Unable to expire key %q. Error: %s", e.key, err)
+		}
+	}
+	if len(expired) > 0 {
+		s.logger.Info().Msgf("Expired %d keys", len(expired))
+	}
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestApplyUsesProposerClockForExpiry(t *testing.T) {
+	kv_service := New(zerolog.New(io.Discard), Config{RaftNodeID: "1", Debug: true})
+
+	kv_service.applyCommand(command{Op: opSet, Key: "a", Val: "b", Now: 1000, ExpiresAt: 2000}, 1)
+
+	// Still alive at the time of the next write: create-only must fail.
+	resp := kv_service.applyCommand(command{Op: opSet, Key: "a", Val: "c", Mode: WriteCreateOnly, Now: 1500}, 2)
+	if resp != KeyAlreadyExists {
+		t.Fatalf("create-only before expiry. Expected: %v, got: %v", KeyAlreadyExists, resp)
+	}
+
+	// An EXPIRE proposed for an older revision must not remove the key.
+	kv_service.applyCommand(command{Op: opExpire, Key: "a", CheckRevision: true, Revision: 0, Now: 2500}, 3)
+	if kv_service.KeyCount() != 1 {
+		t.Fatalf("EXPIRE with stale revision removed the key")
+	}
+
+	// Expired according to the proposer's clock: counts as absent.
+	resp = kv_service.applyCommand(command{Op: opSet, Key: "a", Val: "d", Mode: WriteCreateOnly, Now: 2500}, 4)
+	if result, ok := resp.(writeResult); !ok || !result.Created {
+		t.Fatalf("create-only after expiry. Expected a created write, got: %v", resp)
+	}
+}
+
+func TestRaftKeyExpiry(t *testing.T) {
+	serviceConfig := Config{
+		KeyMaxLen:      100,
+		ValMaxLen:      200,
+		MaxMapSize:     1000,
+		RaftNodeID:     "1",
+		RaftAddr:       "localhost:23301",
+		RaftStoreDir:   t.TempDir(),
+		RaftTimeout:    5 * time.Second,
+		RaftLeader:     true,
+		ExpiryInterval: 100 * time.Millisecond,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+	kv_service := New(zlogger, serviceConfig)
+
+	if _, _, err := kv_service.Put("session", "s1", WriteUpsert, 300*time.Millisecond); err != nil {
+		t.Fatalf("PUT with ttl failed: %s", err)
+	}
+	if _, err := kv_service.Get("session"); err != nil {
+		t.Fatalf("GET before expiry failed: %s", err)
+	}
+
+	deadline := time.Now().Add(serviceConfig.RaftTimeout)
+	for kv_service.KeyCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expired key was never reaped by the leader")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err := kv_service.Get("session"); err != KeyNotFound {
+		t.Fatalf("GET after expiry. Expected: %v, got: %v", KeyNotFound, err)
+	}
+}
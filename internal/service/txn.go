@@ -0,0 +1,375 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+// Compare targets and operators accepted in a transaction guard.
+const (
+	CompareValue    = "value"
+	CompareRevision = "revision"
+	CompareExists   = "exists"
+
+	CompareEqual    = "="
+	CompareNotEqual = "!="
+	CompareGreater  = ">"
+	CompareLess     = "<"
+)
+
+// Transaction op names.
+const (
+	TxnOpSet    = "set"
+	TxnOpDelete = "delete"
+	TxnOpGet    = "get"
+)
+
+var (
+	InvalidTxn error = errors.New("invalid transaction")
+)
+
+// Compare is a guard evaluated against the replicated state when the
+// transaction is applied. A missing key has revision 0 and no value, so only
+// "!=" holds for a value comparison against it.
+type Compare struct {
+	Key      string `json:"key"`
+	Target   string `json:"target"`
+	Op       string `json:"op"`
+	Val      string `json:"value,omitempty"`
+	Revision uint64 `json:"revision,omitempty"`
+	Exists   bool   `json:"exists,omitempty"`
+}
+
+// TxnOp is one operation of a transaction branch.
+type TxnOp struct {
+	Op  string `json:"op"`
+	Key string `json:"key"`
+	Val string `json:"value,omitempty"`
+	// TTL is the number of seconds after which a set key expires. 0 keeps it forever.
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// TxnRequest runs the Success ops if every Compare holds, the Failure ops
+// otherwise. The whole transaction is a single raft log entry.
+type TxnRequest struct {
+	Compare []Compare `json:"compare"`
+	Success []TxnOp   `json:"success"`
+	Failure []TxnOp   `json:"failure"`
+}
+
+// TxnOpResult reports the outcome of one op of the branch that ran. Found is
+// whether the key existed before a get or delete.
+type TxnOpResult struct {
+	Op       string `json:"op"`
+	Key      string `json:"key"`
+	Val      string `json:"value,omitempty"`
+	Revision uint64 `json:"revision,omitempty"`
+	Found    bool   `json:"found"`
+}
+
+// TxnResponse tells which branch ran. Revision is the raft index of the
+// transaction, which is also the revision of every key it wrote.
+type TxnResponse struct {
+	Succeeded bool          `json:"succeeded"`
+	Revision  uint64        `json:"revision"`
+	Results   []TxnOpResult `json:"results"`
+}
+
+// txn is the replicated form of a TxnRequest. Branch ops are commands so
+// they share the log codec, with opGet standing in for reads.
+type txn struct {
+	Compares []Compare
+	Success  []command
+	Failure  []command
+}
+
+// Validate checks the shape of the request before it is proposed.
+func (req TxnRequest) Validate(config Config) error {
+	if len(req.Compare)+len(req.Success)+len(req.Failure) == 0 {
+		return fmt.Errorf("%w: empty transaction", InvalidTxn)
+	}
+	if config.TxnMaxOps > 0 && len(req.Success)+len(req.Failure) > config.TxnMaxOps {
+		return fmt.Errorf("%w: more than %d ops", InvalidTxn, config.TxnMaxOps)
+	}
+
+	for _, c := range req.Compare {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		if len(c.Key) > config.KeyMaxLen {
+			return fmt.Errorf("%w: key size exceeded", InvalidTxn)
+		}
+	}
+	for _, op := range append(append([]TxnOp{}, req.Success...), req.Failure...) {
+		switch op.Op {
+		case TxnOpSet, TxnOpDelete, TxnOpGet:
+		default:
+			return fmt.Errorf("%w: unknown op %q", InvalidTxn, op.Op)
+		}
+		if op.Key == "" || len(op.Key) > config.KeyMaxLen {
+			return fmt.Errorf("%w: empty key or key size exceeded", InvalidTxn)
+		}
+		if len(op.Val) > config.ValMaxLen {
+			return fmt.Errorf("%w: value size exceeded", InvalidTxn)
+		}
+		if op.TTL < 0 {
+			return fmt.Errorf("%w: %s", InvalidTxn, InvalidTTL)
+		}
+	}
+	return nil
+}
+
+// keys returns the keys the transaction reads, compares included, and the
+// keys it writes, across both branches.
+func (req TxnRequest) keys() (reads, writes []string) {
+	for _, c := range req.Compare {
+		reads = append(reads, c.Key)
+	}
+	for _, op := range append(append([]TxnOp{}, req.Success...), req.Failure...) {
+		if op.Op == TxnOpGet {
+			reads = append(reads, op.Key)
+		} else {
+			writes = append(writes, op.Key)
+		}
+	}
+	return reads, writes
+}
+
+func (c Compare) validate() error {
+	if c.Key == "" {
+		return fmt.Errorf("%w: compare without key", InvalidTxn)
+	}
+	switch c.Target {
+	case CompareValue, CompareRevision:
+		switch c.Op {
+		case CompareEqual, CompareNotEqual, CompareGreater, CompareLess:
+			return nil
+		}
+	case CompareExists:
+		switch c.Op {
+		case CompareEqual, CompareNotEqual:
+			return nil
+		}
+	default:
+		return fmt.Errorf("%w: unknown compare target %q", InvalidTxn, c.Target)
+	}
+	return fmt.Errorf("%w: operator %q not supported for target %q", InvalidTxn, c.Op, c.Target)
+}
+
+// Txn replicates req as one raft log entry and returns the results of the
+// branch the FSM picked.
+func (s *DKVService) Txn(req TxnRequest) (TxnResponse, error) {
+	if err := req.Validate(s.ServiceConfig); err != nil {
+		return TxnResponse{}, err
+	}
+
+	now := time.Now()
+	toCommands := func(ops []TxnOp) []command {
+		cmds := make([]command, 0, len(ops))
+		for _, op := range ops {
+			cmd := command{Key: op.Key}
+			switch op.Op {
+			case TxnOpSet:
+				cmd.Op = opSet
+				cmd.Val = op.Val
+				if op.TTL > 0 {
+					cmd.ExpiresAt = now.Add(time.Duration(op.TTL) * time.Second).UnixMilli()
+				}
+			case TxnOpDelete:
+				cmd.Op = opDel
+			case TxnOpGet:
+				cmd.Op = opGet
+			}
+			cmds = append(cmds, cmd)
+		}
+		return cmds
+	}
+
+	resp, err := s.propose(command{
+		Op:  opTxn,
+		Now: now.UnixMilli(),
+		Txn: &txn{
+			Compares: req.Compare,
+			Success:  toCommands(req.Success),
+			Failure:  toCommands(req.Failure),
+		},
+	})
+	if err != nil {
+		return TxnResponse{}, err
+	}
+	result, _ := resp.(TxnResponse)
+	return result, nil
+}
+
+// applyTxn evaluates the guards and runs one branch. It is called from
+// applyCommand with s.mu held, so the transaction is atomic on every node.
+func (s *DKVService) applyTxn(t *txn, now int64, index uint64) TxnResponse {
+	succeeded := true
+	for _, c := range t.Compares {
+		if !s.compareLocked(c, now) {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := t.Success
+	if !succeeded {
+		ops = t.Failure
+	}
+
+	resp := TxnResponse{Succeeded: succeeded, Revision: index, Results: make([]TxnOpResult, 0, len(ops))}
+	// the events are published together, so watchers get the whole
+	// transaction at once.
+	var events []WatchEvent
+	for _, op := range ops {
+		current, exists := s.getLocked(op.Key)
+		exists = exists && !current.expiredAt(now)
+
+		result := TxnOpResult{Key: op.Key, Found: exists}
+		switch op.Op {
+		case opSet:
+			result.Op = TxnOpSet
+			result.Revision = index
+			s.putLocked(op.Key, Entry{Val: op.Val, Revision: index, ExpiresAt: op.ExpiresAt})
+			events = append(events, WatchEvent{Type: WatchEventSet, Key: op.Key, Val: op.Val, Index: index})
+		case opDel:
+			result.Op = TxnOpDelete
+			s.deleteLocked(op.Key)
+			if exists {
+				events = append(events, WatchEvent{Type: WatchEventDelete, Key: op.Key, Index: index})
+			}
+		case opGet:
+			result.Op = TxnOpGet
+			if exists {
+				result.Val = current.Val
+				result.Revision = current.Revision
+			}
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	s.watch.publish(events...)
+	return resp
+}
+
+func (s *DKVService) compareLocked(c Compare, now int64) bool {
+	current, exists := s.getLocked(c.Key)
+	exists = exists && !current.expiredAt(now)
+
+	switch c.Target {
+	case CompareExists:
+		return (exists == c.Exists) == (c.Op == CompareEqual)
+	case CompareRevision:
+		var revision uint64
+		if exists {
+			revision = current.Revision
+		}
+		switch c.Op {
+		case CompareEqual:
+			return revision == c.Revision
+		case CompareNotEqual:
+			return revision != c.Revision
+		case CompareGreater:
+			return revision > c.Revision
+		case CompareLess:
+			return revision < c.Revision
+		}
+	case CompareValue:
+		if !exists {
+			return c.Op == CompareNotEqual
+		}
+		switch c.Op {
+		case CompareEqual:
+			return current.Val == c.Val
+		case CompareNotEqual:
+			return current.Val != c.Val
+		case CompareGreater:
+			return current.Val > c.Val
+		case CompareLess:
+			return current.Val < c.Val
+		}
+	}
+	return false
+}
+
+// TxnHandler applies a guarded multi-key transaction:
+//
+//	{
+//	  "compare": [{"key": "a", "target": "revision", "op": "=", "revision": 7}],
+//	  "success": [{"op": "set", "key": "a", "value": "2"}, {"op": "delete", "key": "b"}],
+//	  "failure": [{"op": "get", "key": "a"}]
+//	}
+//
+// The response tells which branch ran along with a result per op.
+func TxnHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	var reqBody TxnRequest
+	defer r.Body.Close()
+
+	// The raw body is kept around in case the write has to be forwarded to the leader.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return
+	}
+
+	err = json.Unmarshal(body, &reqBody)
+	if err != nil {
+		err := errors.New("Unable to decode body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	if err := reqBody.Validate(dkvService.ServiceConfig); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reads, writes := reqBody.keys()
+	if err := dkvService.Authorize(r, AccessRead, reads...); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := dkvService.Authorize(r, AccessWrite, writes...); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if dkvService.KeyCount() > dkvService.ServiceConfig.MaxMapSize {
+		err := errors.New("max keys exceeded")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := dkvService.Txn(reqBody)
+	if err != nil {
+		switch {
+		case errors.Is(err, NotLeader):
+			forwardToLeader(dkvService, w, r, body)
+		case errors.Is(err, LeaderNotReady):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/router"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+func TestTxnCommandRoundTrip(t *testing.T) {
+	want := command{
+		Op:  opTxn,
+		Now: 1700000000000,
+		Txn: &txn{
+			Compares: []Compare{
+				{Key: "a", Target: CompareValue, Op: CompareEqual, Val: "x,y:z"},
+				{Key: "b", Target: CompareRevision, Op: CompareLess, Revision: 9},
+				{Key: "c", Target: CompareExists, Op: CompareEqual, Exists: true},
+			},
+			Success: []command{
+				{Op: opSet, Key: "a", Val: "1", ExpiresAt: 1700000060000},
+				{Op: opDel, Key: "b"},
+			},
+			Failure: []command{
+				{Op: opGet, Key: "a"},
+			},
+		},
+	}
+
+	got, err := decodeCommand(encodeCommand(want))
+	if err != nil {
+		t.Fatalf("decode of txn failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("txn round trip mismatch. Expected: %+v, got: %+v", want.Txn, got.Txn)
+	}
+}
+
+func TestTxnHandler(t *testing.T) {
+	config := router.Config{
+		RequestTimeout: 60 * time.Second,
+	}
+	sConfig := server.Config{
+		Address:         "localhost:9999",
+		ShutdownTimeout: time.Second * 5,
+	}
+	serviceConfig := Config{
+		KeyMaxLen:  100,
+		ValMaxLen:  200,
+		MaxMapSize: 1000,
+		TxnMaxOps:  64,
+		RaftNodeID: "1",
+		Debug:      true,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+	router := router.New(config, zlogger)
+	kv_service := New(zlogger, serviceConfig)
+	httpServer := server.New(zlogger, router.GetRouter(), sConfig, kv_service)
+
+	httpServer.AddHandler(server.POST, "/txn", TxnHandler)
+
+	txn := func(req TxnRequest) TxnResponse {
+		b, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal("failed to marshal Txn Request")
+		}
+		httpReq, err := http.NewRequest("POST", "/txn", bytes.NewBuffer(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		httpServer.GetRouter().ServeHTTP(rr, httpReq)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("POST /txn failed. Expected: %d, got: %d body: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		var resp TxnResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unable to decode txn response: %s", err)
+		}
+		return resp
+	}
+
+	// Create two keys together only if neither exists.
+	createBoth := TxnRequest{
+		Compare: []Compare{
+			{Key: "a", Target: CompareExists, Op: CompareEqual, Exists: false},
+			{Key: "b", Target: CompareExists, Op: CompareEqual, Exists: false},
+		},
+		Success: []TxnOp{{Op: TxnOpSet, Key: "a", Val: "1"}, {Op: TxnOpSet, Key: "b", Val: "2"}},
+		Failure: []TxnOp{{Op: TxnOpGet, Key: "a"}},
+	}
+	resp := txn(createBoth)
+	if !resp.Succeeded || len(resp.Results) != 2 {
+		t.Fatalf("first txn should take the success branch. got: %+v", resp)
+	}
+
+	resp = txn(createBoth)
+	if resp.Succeeded || len(resp.Results) != 1 || resp.Results[0].Val != "1" || !resp.Results[0].Found {
+		t.Fatalf("second txn should take the failure branch and read a. got: %+v", resp)
+	}
+
+	// Swap a and delete b guarded on a's revision.
+	resp = txn(TxnRequest{
+		Compare: []Compare{{Key: "a", Target: CompareRevision, Op: CompareEqual, Revision: resp.Results[0].Revision}},
+		Success: []TxnOp{{Op: TxnOpSet, Key: "a", Val: "3"}, {Op: TxnOpDelete, Key: "b"}},
+	})
+	if !resp.Succeeded {
+		t.Fatalf("revision guarded txn failed. got: %+v", resp)
+	}
+	if val, err := kv_service.Get("a"); err != nil || val != "3" {
+		t.Fatalf("GET a after txn. Expected: 3, got: %q err: %v", val, err)
+	}
+	if _, err := kv_service.Get("b"); err != KeyNotFound {
+		t.Fatalf("GET b after txn. Expected: %v, got: %v", KeyNotFound, err)
+	}
+}
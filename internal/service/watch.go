@@ -0,0 +1,448 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+const (
+	defaultWatchHistory = 1024
+	// watchBufferSize is how many undelivered events a watcher may lag
+	// behind before it is dropped.
+	watchBufferSize = 256
+
+	defaultWatchWait = 30 * time.Second
+	watchHeartbeat   = 15 * time.Second
+	// watchDeadlineMargin ends streams and polls ahead of the request timeout
+	// so the router never answers a watch request itself.
+	watchDeadlineMargin = time.Second
+)
+
+// WatchEventType tells what happened to a key.
+type WatchEventType string
+
+const (
+	WatchEventSet    WatchEventType = "set"
+	WatchEventDelete WatchEventType = "delete"
+)
+
+var (
+	InvalidWatch     error = errors.New("invalid watch. Use either key or prefix")
+	HistoryCompacted error = errors.New("requested index is no longer in the watch history. re-read the keys and watch from the returned index")
+)
+
+// WatchEvent is a committed change to a key. Index is the raft index of the
+// write, so all events of one transaction share it. Expired keys show up as
+// deletes.
+type WatchEvent struct {
+	Type  WatchEventType `json:"type"`
+	Key   string         `json:"key"`
+	Val   string         `json:"value,omitempty"`
+	Index uint64         `json:"index"`
+}
+
+// WatchFilter selects the keys a watcher is interested in. An empty filter
+// matches every key.
+type WatchFilter struct {
+	Key    string
+	Prefix string
+}
+
+func (f WatchFilter) validate() error {
+	if f.Key != "" && f.Prefix != "" {
+		return InvalidWatch
+	}
+	return nil
+}
+
+func (f WatchFilter) matches(key string) bool {
+	if f.Key != "" {
+		return key == f.Key
+	}
+	return strings.HasPrefix(key, f.Prefix)
+}
+
+// Watcher receives the events published after it was registered. Events is
+// closed when the watcher falls too far behind or the FSM is restored from a
+// snapshot. The caller can then resume from the last index it saw.
+type Watcher struct {
+	Events <-chan WatchEvent
+	// Index is the index the watcher is caught up to when registered. A
+	// client with nothing newer to resume from continues from here.
+	Index uint64
+
+	events chan WatchEvent
+	filter WatchFilter
+	hub    *watchHub
+}
+
+// Close unregisters the watcher.
+func (w *Watcher) Close() {
+	w.hub.unsubscribe(w)
+}
+
+// next appends to events the events already in Events. Once an event was
+// received, it waits for the publish under way to hand over the rest of its
+// log entry first, so entries are never cut in two. ok is false when Events
+// was closed.
+func (w *Watcher) next(events []WatchEvent) ([]WatchEvent, bool) {
+	w.hub.mu.Lock()
+	w.hub.mu.Unlock()
+	for {
+		select {
+		case event, ok := <-w.events:
+			if !ok {
+				return events, false
+			}
+			events = append(events, event)
+		default:
+			return events, true
+		}
+	}
+}
+
+// watchHub fans committed changes out to watchers and keeps the latest ones
+// in a ring buffer so clients can resume after a disconnect.
+type watchHub struct {
+	mu       sync.Mutex
+	history  []WatchEvent
+	head     int
+	size     int
+	watchers map[*Watcher]struct{}
+	// compactedIndex is the highest index whose events may be incomplete in
+	// history. Only clients resuming from it or later can be served.
+	compactedIndex uint64
+	// lastIndex is the index of the most recent event or reset.
+	lastIndex uint64
+}
+
+func newWatchHub(size int) *watchHub {
+	if size <= 0 {
+		size = defaultWatchHistory
+	}
+	return &watchHub{
+		history:  make([]WatchEvent, size),
+		watchers: make(map[*Watcher]struct{}),
+	}
+}
+
+// publish records events and hands them to matching watchers. It is called
+// from applyCommand with all the events of one log entry, so events are
+// published in log order and a watcher gets either all of an entry's events
+// or none. A watcher that cannot keep up is dropped rather than blocking the
+// FSM.
+func (h *watchHub) publish(events ...WatchEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, event := range events {
+		if h.size == len(h.history) {
+			h.compactedIndex = h.history[h.head].Index
+			h.head = (h.head + 1) % len(h.history)
+			h.size--
+		}
+		h.history[(h.head+h.size)%len(h.history)] = event
+		h.size++
+		h.lastIndex = event.Index
+	}
+
+	for w := range h.watchers {
+		var matching []WatchEvent
+		for _, event := range events {
+			if w.filter.matches(event.Key) {
+				matching = append(matching, event)
+			}
+		}
+		if cap(w.events)-len(w.events) < len(matching) {
+			delete(h.watchers, w)
+			close(w.events)
+			continue
+		}
+		// only publish sends, under the lock, so there is room for all.
+		for _, event := range matching {
+			w.events <- event
+		}
+	}
+}
+
+// subscribe registers a watcher and returns the retained events after
+// afterIndex. afterIndex 0 only asks for changes from now on.
+func (h *watchHub) subscribe(filter WatchFilter, afterIndex uint64) ([]WatchEvent, *Watcher, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var backlog []WatchEvent
+	if afterIndex > 0 {
+		if afterIndex < h.compactedIndex {
+			return nil, nil, fmt.Errorf("%w. Requested: %d, oldest: %d", HistoryCompacted, afterIndex, h.compactedIndex)
+		}
+		for i := 0; i < h.size; i++ {
+			event := h.history[(h.head+i)%len(h.history)]
+			if event.Index > afterIndex && filter.matches(event.Key) {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+
+	events := make(chan WatchEvent, watchBufferSize)
+	w := &Watcher{
+		Events: events,
+		Index:  max(afterIndex, h.lastIndex),
+		events: events,
+		filter: filter,
+		hub:    h,
+	}
+	h.watchers[w] = struct{}{}
+	return backlog, w, nil
+}
+
+func (h *watchHub) unsubscribe(w *Watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		close(w.events)
+	}
+}
+
+// reset drops the history and every watcher after the FSM state was replaced
+// wholesale, which happens when a snapshot is restored.
+func (h *watchHub) reset(index uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.head, h.size = 0, 0
+	h.compactedIndex, h.lastIndex = index, index
+	for w := range h.watchers {
+		delete(h.watchers, w)
+		close(w.events)
+	}
+}
+
+// Watch registers a watcher for the keys matching filter. The events after
+// afterIndex still held in the history are returned right away. It fails with
+// HistoryCompacted when afterIndex is older than the history.
+func (s *DKVService) Watch(filter WatchFilter, afterIndex uint64) ([]WatchEvent, *Watcher, error) {
+	if err := filter.validate(); err != nil {
+		return nil, nil, err
+	}
+	return s.watch.subscribe(filter, afterIndex)
+}
+
+// parseEventID parses a watch cursor: a raft index, optionally followed by
+// how many events of that index were already seen, like 42.1.
+func parseEventID(id string) (uint64, int, error) {
+	index, seq, hasSeq := strings.Cut(id, ".")
+	afterIndex, err := strconv.ParseUint(index, 10, 64)
+	if err != nil || !hasSeq {
+		return afterIndex, 0, err
+	}
+	seen, err := strconv.Atoi(seq)
+	if err != nil || seen <= 0 || afterIndex == 0 {
+		return 0, 0, fmt.Errorf("invalid event id %q", id)
+	}
+	return afterIndex, seen, nil
+}
+
+// WatchPollResponse is the long-poll answer. Index is what the client passes
+// as index= on its next poll.
+type WatchPollResponse struct {
+	Events []WatchEvent `json:"events"`
+	Index  uint64       `json:"index"`
+}
+
+// WatchHandler streams changes to the keys selected by key= or prefix=:
+//
+//	GET /watch?prefix=config/&index=42
+//
+// With "Accept: text/event-stream" the events are sent as Server-Sent Events
+// whose id is the raft index, so a reconnecting client resumes through
+// Last-Event-ID. Events of a transaction but the last carry their position
+// too, like 42.1, so a stream cut inside one resumes with the rest of it. Otherwise the request long-polls: it returns as soon as there
+// are events after index, or with none once wait= (default 30s) runs out.
+// Watches are served from the local FSM of the node that got the request.
+func WatchHandler(s *server.Server, w http.ResponseWriter, r *http.Request) {
+	store := s.GetStore()
+	dkvService, ok := store.(*DKVService)
+	if !ok {
+		http.Error(w, "Unable to access store", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := WatchFilter{Key: query.Get("key"), Prefix: query.Get("prefix")}
+	target := filter.Prefix
+	if filter.Key != "" {
+		target = filter.Key
+	}
+	if err := dkvService.Authorize(r, AccessRead, target); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	index := query.Get("index")
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		index = lastEventID
+	}
+	var afterIndex uint64
+	var seen int
+	if index != "" {
+		var err error
+		afterIndex, seen, err = parseEventID(index)
+		if err != nil {
+			http.Error(w, "index must be a raft index", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// long-polls give up after wait=, streams run until the request deadline.
+	streaming := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	var deadline time.Time
+	if !streaming {
+		wait := defaultWatchWait
+		if v := query.Get("wait"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "wait must be a positive duration like 10s", http.StatusBadRequest)
+				return
+			}
+			wait = d
+		}
+		deadline = time.Now().Add(wait)
+	}
+	if ctxDeadline, ok := r.Context().Deadline(); ok {
+		ctxDeadline = ctxDeadline.Add(-watchDeadlineMargin)
+		if deadline.IsZero() || ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+	}
+
+	// a stream cut in the middle of an entry resumes with the rest of it.
+	subscribeIndex := afterIndex
+	if seen > 0 {
+		subscribeIndex--
+	}
+	backlog, watcher, err := dkvService.Watch(filter, subscribeIndex)
+	if err != nil {
+		switch {
+		case errors.Is(err, HistoryCompacted):
+			http.Error(w, err.Error(), http.StatusGone)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	defer watcher.Close()
+	for skip := seen; skip > 0 && len(backlog) > 0 && backlog[0].Index == afterIndex; skip-- {
+		backlog = backlog[1:]
+	}
+	if len(backlog) == 0 || backlog[0].Index != afterIndex {
+		seen = 0
+	}
+
+	var done <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		done = timer.C
+	}
+
+	if streaming {
+		streamWatch(w, r, watcher, backlog, seen, done)
+		return
+	}
+
+	// the events of an entry come together, so the index of the last one is
+	// a cursor that skips none of them.
+	resp := WatchPollResponse{Events: backlog, Index: watcher.Index}
+	if len(resp.Events) == 0 {
+		select {
+		case event, ok := <-watcher.Events:
+			if ok {
+				resp.Events, _ = watcher.next(append(resp.Events, event))
+			}
+		case <-done:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if resp.Events == nil {
+		resp.Events = []WatchEvent{}
+	}
+	if n := len(resp.Events); n > 0 {
+		resp.Index = resp.Events[n-1].Index
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// streamWatch writes events as Server-Sent Events until the watcher is
+// dropped, the client goes away or done fires. seen is how many events of the
+// entry backlog starts in the middle of were sent before.
+func streamWatch(w http.ResponseWriter, r *http.Request, watcher *Watcher, backlog []WatchEvent, seen int, done <-chan time.Time) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// events are written an entry at a time. The id of the last event of an
+	// entry is its index, the ids of the others add how many events of the
+	// entry were sent so far, so a client resumes exactly where it was cut.
+	seq := seen
+	write := func(events []WatchEvent) {
+		for i, event := range events {
+			seq++
+			id := strconv.FormatUint(event.Index, 10)
+			if i+1 < len(events) && events[i+1].Index == event.Index {
+				id = fmt.Sprintf("%d.%d", event.Index, seq)
+			} else {
+				seq = 0
+			}
+			b, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, event.Type, b)
+		}
+	}
+	write(backlog)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			events, _ := watcher.next([]WatchEvent{event})
+			write(events)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,254 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/router"
+	"github.com/tomkaith13/dist-kv-store/internal/server"
+)
+
+func TestWatchHistory(t *testing.T) {
+	serviceConfig := Config{
+		KeyMaxLen:    100,
+		ValMaxLen:    200,
+		MaxMapSize:   1000,
+		RaftNodeID:   "1",
+		Debug:        true,
+		WatchHistory: 4,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+	kv_service := New(zlogger, serviceConfig)
+
+	// indexes 1..3
+	for _, key := range []string{"app/a", "other", "app/b"} {
+		if _, err := kv_service.Set(key, "v1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backlog, watcher, err := kv_service.Watch(WatchFilter{Prefix: "app/"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	if len(backlog) != 1 || backlog[0].Key != "app/b" || backlog[0].Index != 3 {
+		t.Fatalf("unexpected backlog: %+v", backlog)
+	}
+
+	// index 4, one transaction touching two watched keys and one other key.
+	_, err = kv_service.Txn(TxnRequest{Success: []TxnOp{
+		{Op: TxnOpSet, Key: "app/a", Val: "v2"},
+		{Op: TxnOpDelete, Key: "app/b"},
+		{Op: TxnOpSet, Key: "other", Val: "v2"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []WatchEvent{
+		{Type: WatchEventSet, Key: "app/a", Val: "v2", Index: 4},
+		{Type: WatchEventDelete, Key: "app/b", Index: 4},
+	}
+	for _, w := range want {
+		select {
+		case got := <-watcher.Events:
+			if got != w {
+				t.Fatalf("unexpected event. Expected: %+v, got: %+v", w, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %+v", w)
+		}
+	}
+
+	// the history holds 4 events, so the events of index 3 and below are gone.
+	if _, _, err := kv_service.Watch(WatchFilter{}, 1); !errors.Is(err, HistoryCompacted) {
+		t.Fatalf("expected HistoryCompacted, got: %v", err)
+	}
+	if _, _, err := kv_service.Watch(WatchFilter{Key: "a", Prefix: "a"}, 0); !errors.Is(err, InvalidWatch) {
+		t.Fatalf("expected InvalidWatch, got: %v", err)
+	}
+}
+
+func TestWatchHandler(t *testing.T) {
+	config := router.Config{
+		RequestTimeout: 60 * time.Second,
+	}
+	sConfig := server.Config{
+		Address:         "localhost:9999",
+		ShutdownTimeout: time.Second * 5,
+	}
+	serviceConfig := Config{
+		KeyMaxLen:  100,
+		ValMaxLen:  200,
+		MaxMapSize: 1000,
+		RaftNodeID: "1",
+		Debug:      true,
+	}
+	zlogger := zerolog.New(os.Stderr).
+		Level(zerolog.DebugLevel).
+		With().
+		Timestamp().
+		Logger()
+	router := router.New(config, zlogger)
+	kv_service := New(zlogger, serviceConfig)
+	httpServer := server.New(zlogger, router.GetRouter(), sConfig, kv_service)
+
+	httpServer.AddHandler(server.GET, "/watch", WatchHandler)
+
+	// long-poll blocks until the next write to the key.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		kv_service.Set("other", "x")
+		kv_service.Set("a", "1")
+	}()
+	req, err := http.NewRequest("GET", "/watch?key=a&wait=5s", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	httpServer.GetRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("long-poll failed. Expected: %d, got: %d", http.StatusOK, rr.Code)
+	}
+	var poll WatchPollResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &poll); err != nil {
+		t.Fatal(err)
+	}
+	if len(poll.Events) != 1 || poll.Events[0].Key != "a" || poll.Index != 2 {
+		t.Fatalf("unexpected long-poll response: %+v", poll)
+	}
+
+	// a poll with nothing new returns empty once wait runs out.
+	req, _ = http.NewRequest("GET", "/watch?key=a&wait=10ms&index=2", nil)
+	rr = httptest.NewRecorder()
+	httpServer.GetRouter().ServeHTTP(rr, req)
+	if err := json.Unmarshal(rr.Body.Bytes(), &poll); err != nil {
+		t.Fatal(err)
+	}
+	if len(poll.Events) != 0 || poll.Index != 2 {
+		t.Fatalf("unexpected empty long-poll response: %+v", poll)
+	}
+
+	// SSE resumes after Last-Event-ID from the history.
+	kv_service.Set("b", "2")
+	ts := httptest.NewServer(httpServer.GetRouter())
+	defer ts.Close()
+	req, _ = http.NewRequest("GET", ts.URL+"/watch", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", "2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && scanner.Text() != "" {
+		lines = append(lines, scanner.Text())
+	}
+	want := []string{"id: 3", "event: set", `data: {"type":"set","key":"b","value":"2","index":3}`}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected SSE event. Expected: %q, got: %q", want, lines)
+	}
+}
+
+func TestWatchTransactions(t *testing.T) {
+	zlogger := zerolog.New(os.Stderr)
+	kv_service := New(zlogger, Config{
+		KeyMaxLen:  100,
+		ValMaxLen:  200,
+		MaxMapSize: 1000,
+		RaftNodeID: "1",
+		Debug:      true,
+	})
+	router := router.New(router.Config{RequestTimeout: 60 * time.Second}, zlogger)
+	httpServer := server.New(zlogger, router.GetRouter(), server.Config{Address: "localhost:9999"}, kv_service)
+	httpServer.AddHandler(server.GET, "/watch", WatchHandler)
+	ts := httptest.NewServer(httpServer.GetRouter())
+	defer ts.Close()
+
+	// index 1
+	if _, err := kv_service.Set("app/x", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a poll woken by a transaction returns all of it, so resuming from its
+	// index skips none of its events.
+	polled := make(chan WatchPollResponse)
+	go func() {
+		var poll WatchPollResponse
+		resp, err := http.Get(ts.URL + "/watch?prefix=app/&index=1&wait=5s")
+		if err == nil {
+			json.NewDecoder(resp.Body).Decode(&poll)
+			resp.Body.Close()
+		}
+		polled <- poll
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// index 2
+	_, err := kv_service.Txn(TxnRequest{Success: []TxnOp{
+		{Op: TxnOpSet, Key: "app/a", Val: "1"},
+		{Op: TxnOpSet, Key: "other", Val: "1"},
+		{Op: TxnOpSet, Key: "app/b", Val: "1"},
+		{Op: TxnOpDelete, Key: "app/x"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll := <-polled
+	if len(poll.Events) != 3 || poll.Index != 2 {
+		t.Fatalf("poll woken by a transaction. Expected its 3 events at index 2, got: %+v", poll)
+	}
+
+	// SSE ids tell how far into a transaction the stream got.
+	stream := func(lastEventID string) []string {
+		req, _ := http.NewRequest("GET", ts.URL+"/watch?prefix=app/", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Last-Event-ID", lastEventID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("stream from %s. Expected: %d, got: %d", lastEventID, http.StatusOK, resp.StatusCode)
+		}
+		var ids []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if id, ok := strings.CutPrefix(line, "id: "); ok {
+				ids = append(ids, id)
+			}
+			if strings.HasPrefix(line, "data: ") && strings.Contains(line, `"key":"app/x"`) {
+				return ids
+			}
+		}
+		t.Fatalf("stream from %s ended early: %v", lastEventID, ids)
+		return nil
+	}
+	if ids := stream("1"); strings.Join(ids, ",") != "2.1,2.2,2" {
+		t.Fatalf("stream of a transaction. Expected ids: 2.1,2.2,2, got: %v", ids)
+	}
+	// a stream cut after the first event resumes with the other two.
+	if ids := stream("2.1"); strings.Join(ids, ",") != "2.2,2" {
+		t.Fatalf("stream resumed inside a transaction. Expected ids: 2.2,2, got: %v", ids)
+	}
+}
@@ -0,0 +1,253 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var (
+	MissingKeyPair error = errors.New("TLS needs both a certificate and a key file")
+	InvalidCAFile  error = errors.New("CA file holds no PEM certificate")
+)
+
+// Config points at the PEM files a node serves and verifies TLS with. TLS is
+// off unless a certificate or key file is set.
+type Config struct {
+	CertFile string `envconfig:"CERT_FILE"`
+	KeyFile  string `envconfig:"KEY_FILE"`
+	// ClientCAFile verifies the certificates clients present. With
+	// RequireClientCert unset, clients without a certificate are still let in.
+	ClientCAFile      string `envconfig:"CLIENT_CA_FILE"`
+	RequireClientCert bool   `envconfig:"REQUIRE_CLIENT_CERT"`
+	// CAFile verifies the certificates of the other nodes this node calls.
+	// It defaults to ClientCAFile, then to the system roots.
+	CAFile string `envconfig:"CA_FILE"`
+	// ReloadInterval is how often the files are checked for changes.
+	ReloadInterval time.Duration `envconfig:"RELOAD_INTERVAL" default:"10s"`
+}
+
+// Enabled reports whether TLS is configured.
+func (c Config) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// Reloader holds the certificates and CA pools loaded from a Config and
+// swaps them whenever one of the files changes, so certificates can be
+// rotated without a restart. The tls.Configs it hands out always use the
+// latest files.
+type Reloader struct {
+	logger zerolog.Logger
+	config Config
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	rootCAs   *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// New loads the files of config. It fails if they cannot be loaded, a broken
+// setup is never served.
+func New(logger zerolog.Logger, config Config) (*Reloader, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, MissingKeyPair
+	}
+	if config.CAFile == "" {
+		config.CAFile = config.ClientCAFile
+	}
+	r := &Reloader{logger: logger, config: config}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	for _, f := range []string{r.config.ClientCAFile, r.config.CAFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (r *Reloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return err
+	}
+	clientCAs, err := loadPool(r.config.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	rootCAs, err := loadPool(r.config.CAFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.clientCAs, r.rootCAs, r.modTimes = &cert, clientCAs, rootCAs, modTimes
+	return nil
+}
+
+// loadPool reads a PEM bundle. An empty path yields a nil pool.
+func loadPool(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%w: %s", InvalidCAFile, path)
+	}
+	return pool, nil
+}
+
+// Reload loads the files again if any of them changed since the last load.
+// On error the previous certificates stay in use.
+func (r *Reloader) Reload() (bool, error) {
+	r.mu.RLock()
+	changed := false
+	for f, modTime := range r.modTimes {
+		if info, err := os.Stat(f); err != nil || !info.ModTime().Equal(modTime) {
+			changed = true
+			break
+		}
+	}
+	r.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	if err := r.load(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Watch reloads the files every ReloadInterval until ctx is done.
+func (r *Reloader) Watch(ctx context.Context) {
+	if r.config.ReloadInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.config.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.Reload()
+			if err != nil {
+				r.logger.Error().Msgf("Unable to reload TLS files, keeping the current ones. Error: %s", err)
+			} else if reloaded {
+				r.logger.Info().Msg("Reloaded TLS certificates")
+			}
+		}
+	}
+}
+
+func (r *Reloader) certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// ServerConfig is the TLS config of the HTTP API. Clients are asked for a
+// certificate whenever a client CA is configured.
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientCAs:    r.clientCAs,
+			}
+			switch {
+			case r.config.RequireClientCert:
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			case r.clientCAs != nil:
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return config, nil
+		},
+	}
+}
+
+// ClientConfig is the TLS config this node calls host with, a DNS name or an
+// IP address. It presents the node certificate and verifies the server
+// against CAFile and host. An empty host only verifies the chain, for callers
+// that identify the server otherwise.
+//
+// HTTP clients calling several nodes use DialTLSContext instead: a config
+// shared by their connections cannot tell which host each one is for.
+func (r *Reloader) ClientConfig(host string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: host,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.certificate(), nil
+		},
+		// The roots can change on reload, which RootCAs cannot follow. The
+		// standard verification is skipped and redone by VerifyConnection
+		// against the current pool. The host is the one given here, as the
+		// connection state leaves out the IP addresses dialled.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			r.mu.RLock()
+			roots := r.rootCAs
+			r.mu.RUnlock()
+
+			opts := x509.VerifyOptions{
+				Roots:         roots,
+				DNSName:       host,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
+
+// DialTLSContext dials addr and verifies the server against its host, with
+// the ClientConfig of that host. It fits http.Transport.DialTLSContext.
+func (r *Reloader) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &tls.Dialer{Config: r.ClientConfig(host)}
+	return dialer.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,144 @@
+package tlsconfig_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tomkaith13/dist-kv-store/internal/tlsconfig"
+	"github.com/tomkaith13/dist-kv-store/internal/tlsconfig/tlstest"
+)
+
+func get(client *http.Client, url string) (*http.Response, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	zlogger := zerolog.New(os.Stderr)
+	ca := tlstest.NewCA(t)
+
+	serverConfig := ca.WriteNode(t, t.TempDir(), 2, "node")
+	serverConfig.RequireClientCert = true
+	serverTLS, err := tlsconfig.New(zlogger, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = serverTLS.ServerConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	clientTLS, err := tlsconfig.New(zlogger, ca.WriteNode(t, t.TempDir(), 3, "node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{DialTLSContext: clientTLS.DialTLSContext}}
+	if _, err := get(client, ts.URL); err != nil {
+		t.Fatalf("client with a node certificate was refused: %s", err)
+	}
+
+	// the server is checked against the IP address dialled, which the
+	// handshake does not report back.
+	if conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), clientTLS.ClientConfig("10.0.0.1")); err == nil {
+		conn.Close()
+		t.Fatal("server certificate accepted for an IP address it does not name")
+	}
+
+	// trusting the CA is not enough without a client certificate.
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if _, err := get(anonymous, ts.URL); err == nil {
+		t.Fatal("client without a certificate was let in")
+	}
+
+	// a node of another CA neither trusts the server nor is trusted by it.
+	strangerTLS, err := tlsconfig.New(zlogger, tlstest.NewCA(t).WriteNode(t, t.TempDir(), 4, "node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger := &http.Client{Transport: &http.Transport{DialTLSContext: strangerTLS.DialTLSContext}}
+	if _, err := get(stranger, ts.URL); err == nil {
+		t.Fatal("node of another CA was let in")
+	}
+
+	if _, err := tlsconfig.New(zlogger, tlsconfig.Config{CertFile: serverConfig.CertFile}); err != tlsconfig.MissingKeyPair {
+		t.Fatalf("expected MissingKeyPair, got: %v", err)
+	}
+}
+
+func TestReloadRotatedCertificate(t *testing.T) {
+	zlogger := zerolog.New(os.Stderr)
+	ca := tlstest.NewCA(t)
+	dir := t.TempDir()
+
+	serverConfig := ca.WriteNode(t, dir, 10, "node")
+	serverTLS, err := tlsconfig.New(zlogger, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = serverTLS.ServerConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	clientTLS, err := tlsconfig.New(zlogger, ca.WriteNode(t, t.TempDir(), 11, "node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	servedSerial := func() int64 {
+		// a fresh transport per call, so every check does a new handshake.
+		client := &http.Client{Transport: &http.Transport{DialTLSContext: clientTLS.DialTLSContext}}
+		resp, err := get(client, ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+	if serial := servedSerial(); serial != 10 {
+		t.Fatalf("unexpected certificate served. Expected serial: 10, got: %d", serial)
+	}
+
+	if reloaded, err := serverTLS.Reload(); reloaded || err != nil {
+		t.Fatalf("reload without changes. reloaded: %t err: %v", reloaded, err)
+	}
+
+	cert, key := ca.Issue(t, 12, "node")
+	tlstest.WriteFile(t, serverConfig.CertFile, cert)
+	tlstest.WriteFile(t, serverConfig.KeyFile, key)
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{serverConfig.CertFile, serverConfig.KeyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reloaded, err := serverTLS.Reload(); !reloaded || err != nil {
+		t.Fatalf("reload of rotated files. reloaded: %t err: %v", reloaded, err)
+	}
+	if serial := servedSerial(); serial != 12 {
+		t.Fatalf("rotated certificate not served. Expected serial: 12, got: %d", serial)
+	}
+
+	// a broken rotation keeps the last good certificate.
+	tlstest.WriteFile(t, serverConfig.KeyFile, []byte("not a key"))
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(serverConfig.KeyFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serverTLS.Reload(); err == nil {
+		t.Fatal("reload of a broken key succeeded")
+	}
+	if serial := servedSerial(); serial != 12 {
+		t.Fatalf("broken rotation replaced the certificate. Expected serial: 12, got: %d", serial)
+	}
+}
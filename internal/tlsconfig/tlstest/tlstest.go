@@ -0,0 +1,114 @@
+// Package tlstest issues throwaway certificates for tests of the TLS setups
+// built with tlsconfig.
+package tlstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tomkaith13/dist-kv-store/internal/tlsconfig"
+)
+
+// CA is a certificate authority valid for an hour around its creation.
+type CA struct {
+	Cert *x509.Certificate
+	// PEM is Cert PEM encoded.
+	PEM []byte
+	key *ecdsa.PrivateKey
+}
+
+func NewCA(t testing.TB) *CA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dkv test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CA{Cert: cert, PEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), key: key}
+}
+
+// Issue returns the PEM certificate and key of a node certificate named
+// commonName and valid for localhost, usable by both servers and clients. A
+// zero serial picks a random one.
+func (ca *CA) Issue(t testing.TB, serial int64, commonName string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialNumber := big.NewInt(serial)
+	if serial == 0 {
+		if serialNumber, err = rand.Int(rand.Reader, big.NewInt(1<<62)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// WriteNode writes a node certificate named commonName, its key and the CA to
+// dir, and returns the config using them.
+func (ca *CA) WriteNode(t testing.TB, dir string, serial int64, commonName string) tlsconfig.Config {
+	t.Helper()
+	cert, key := ca.Issue(t, serial, commonName)
+	config := tlsconfig.Config{
+		CertFile:     filepath.Join(dir, commonName+".crt"),
+		KeyFile:      filepath.Join(dir, commonName+".key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	WriteFile(t, config.CertFile, cert)
+	WriteFile(t, config.KeyFile, key)
+	WriteFile(t, config.ClientCAFile, ca.PEM)
+	return config
+}
+
+func WriteFile(t testing.TB, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,190 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// backupChecksumTrailer carries the hex sha256 of a backup archive, minus the
+// checksum it ends with.
+const backupChecksumTrailer = "X-DKV-Backup-SHA256"
+
+// Status is the answer of GET /status of one node.
+type Status struct {
+	ID           string `json:"id"`
+	Role         string `json:"role"`
+	State        string `json:"state"`
+	LeaderID     string `json:"leader_id"`
+	AppliedIndex uint64 `json:"applied_index"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	// LeaderHTTPAddr is the host:port of the leader's HTTP API, empty while
+	// the node knows no leader.
+	LeaderHTTPAddr  string `json:"leader_http_addr,omitempty"`
+	Term            uint64 `json:"term"`
+	CommitIndex     uint64 `json:"commit_index"`
+	FSMAppliedIndex uint64 `json:"fsm_applied_index"`
+	Keys            int    `json:"keys"`
+	// Config is the node's configuration, with secrets left out.
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// Status returns the status of the node at endpoint, which need not be one of
+// the Config. An empty endpoint asks the node calls currently go to.
+func (c *Client) Status(ctx context.Context, endpoint string) (Status, error) {
+	req := request{method: http.MethodGet, path: "/status"}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return Status{}, fmt.Errorf("%w: %q", InvalidEndpoint, endpoint)
+		}
+		req.at = u
+	}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return Status{}, err
+	}
+	var st Status
+	if err := json.Unmarshal(resp.body, &st); err != nil {
+		return Status{}, fmt.Errorf("unexpected GET /status body: %w", err)
+	}
+	return st, nil
+}
+
+// Member is a node of the raft configuration, as the leader sees it.
+type Member struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raft_addr"`
+	HTTPAddr string `json:"http_addr,omitempty"`
+	// Suffrage is Voter, Nonvoter or Staging.
+	Suffrage string `json:"suffrage"`
+	// Role is voter or learner.
+	Role    string `json:"role"`
+	Leader  bool   `json:"leader"`
+	Healthy bool   `json:"healthy"`
+	// LastContact is when the leader last heard from an unhealthy member.
+	LastContact *time.Time `json:"last_contact,omitempty"`
+}
+
+// Members lists the raft configuration, sorted by ID.
+func (c *Client) Members(ctx context.Context) ([]Member, error) {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/cluster/members", toLeader: true})
+	if err != nil {
+		return nil, err
+	}
+	var members []Member
+	if err := json.Unmarshal(resp.body, &members); err != nil {
+		return nil, fmt.Errorf("unexpected GET /cluster/members body: %w", err)
+	}
+	return members, nil
+}
+
+// RemoveMember removes the node nodeID from the cluster. It fails with
+// KeyNotFound if there is no such member.
+func (c *Client) RemoveMember(ctx context.Context, nodeID string) error {
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: "/cluster/members/" + url.PathEscape(nodeID), toLeader: true})
+	return err
+}
+
+// TransferLeadership hands leadership to the voter targetID, or to the most
+// up to date voter when targetID is empty, and returns the ID of the new
+// leader when it is already known.
+func (c *Client) TransferLeadership(ctx context.Context, targetID string) (string, error) {
+	body, err := json.Marshal(struct {
+		TargetID string `json:"target_id,omitempty"`
+	}{TargetID: targetID})
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(ctx, request{method: http.MethodPost, path: "/cluster/leader/transfer", body: body, toLeader: true})
+	if err != nil {
+		return "", err
+	}
+	c.setLeader(nil)
+
+	var leaderID string
+	if _, err := fmt.Sscanf(string(resp.body), "leadership transferred to %q", &leaderID); err != nil {
+		return "", nil
+	}
+	return leaderID, nil
+}
+
+// Snapshot describes a raft snapshot of a node.
+type Snapshot struct {
+	ID    string `json:"id"`
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Size  int64  `json:"size"`
+}
+
+// Snapshot makes the node calls currently go to snapshot its store, which
+// also compacts its raft log.
+func (c *Client) Snapshot(ctx context.Context) (Snapshot, error) {
+	resp, err := c.do(ctx, request{method: http.MethodPost, path: "/admin/snapshot"})
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(resp.body, &snapshot); err != nil {
+		return Snapshot{}, fmt.Errorf("unexpected POST /admin/snapshot body: %w", err)
+	}
+	return snapshot, nil
+}
+
+// BackupMeta describes the snapshot held by a backup archive.
+type BackupMeta struct {
+	FormatVersion   int       `json:"format_version"`
+	SnapshotVersion int       `json:"snapshot_version"`
+	NodeID          string    `json:"node_id"`
+	Index           uint64    `json:"index"`
+	Term            uint64    `json:"term"`
+	Size            int64     `json:"size"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Backup writes a backup archive of the node calls currently go to into w and
+// returns its size. The archive is checked against the checksum the node
+// sends after it, so a cut short download is an error.
+func (c *Client) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/admin/backup"})
+	if err != nil {
+		return 0, err
+	}
+	archive := resp.body
+	if len(archive) < sha256.Size {
+		return 0, fmt.Errorf("backup is truncated: %d bytes", len(archive))
+	}
+	sum := sha256.Sum256(archive[:len(archive)-sha256.Size])
+	if !bytes.Equal(sum[:], archive[len(archive)-sha256.Size:]) ||
+		resp.trailer.Get(backupChecksumTrailer) != hex.EncodeToString(sum[:]) {
+		return 0, fmt.Errorf("backup checksum mismatch, the download was likely cut short")
+	}
+	n, err := w.Write(archive)
+	return int64(n), err
+}
+
+// Restore installs the backup archive read from r on every node of the
+// cluster, replacing their data.
+func (c *Client) Restore(ctx context.Context, r io.Reader) (BackupMeta, error) {
+	archive, err := io.ReadAll(r)
+	if err != nil {
+		return BackupMeta{}, err
+	}
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err := c.do(ctx, request{method: http.MethodPost, path: "/admin/restore", header: header, body: archive, toLeader: true})
+	if err != nil {
+		return BackupMeta{}, err
+	}
+	var meta BackupMeta
+	if err := json.Unmarshal(resp.body, &meta); err != nil {
+		return BackupMeta{}, fmt.Errorf("unexpected POST /admin/restore body: %w", err)
+	}
+	return meta, nil
+}
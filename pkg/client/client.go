@@ -0,0 +1,339 @@
+// Package client is a Go client for the dkv HTTP API.
+//
+// A Client is given the addresses of some nodes of a cluster. It finds the
+// leader through GET /status and sends writes and non-stale reads there,
+// follows the leader when a node redirects to it, and retries with backoff
+// while the cluster has no leader or a node is unreachable. Writes are only
+// retried while they cannot have been applied.
+//
+//	c, err := client.New(client.Config{Endpoints: []string{"http://localhost:8888"}})
+//	revision, err := c.Set(ctx, "a", "b")
+//	entry, err := c.Get(ctx, "a")
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+const (
+	defaultRetryTimeout = 15 * time.Second
+	// discoveryInterval keeps a cluster without a leader from being asked for
+	// one on every call.
+	discoveryInterval = time.Second
+)
+
+// Config configures a Client.
+type Config struct {
+	// Endpoints are the base URLs of some nodes of the cluster, like
+	// http://localhost:8888. Any node will do, the leader is found from them.
+	Endpoints []string
+	// Token is sent as a bearer token, for clusters with auth enabled.
+	Token string
+	// HTTPClient makes the calls, e.g. with a TLS transport. Redirects are
+	// always handled by the Client itself. Defaults to a plain http.Client.
+	HTTPClient *http.Client
+	// RetryTimeout bounds how long one call is retried while the cluster has
+	// no leader or nodes are unreachable. 0 uses 15s.
+	RetryTimeout time.Duration
+}
+
+// Client calls a dkv cluster. It is safe for concurrent use.
+type Client struct {
+	endpoints    []*url.URL
+	token        string
+	httpClient   *http.Client
+	retryTimeout time.Duration
+
+	mu sync.Mutex
+	// leader is the base URL of the leader, nil while unknown.
+	leader *url.URL
+	// missedAt is when leader discovery last came back empty.
+	missedAt time.Time
+	// next is the endpoint calls go to while the leader is unknown.
+	next int
+}
+
+// New validates config and returns a Client. No call is made until the
+// first request.
+func New(config Config) (*Client, error) {
+	if len(config.Endpoints) == 0 {
+		return nil, NoEndpoints
+	}
+	c := &Client{
+		token:        config.Token,
+		retryTimeout: config.RetryTimeout,
+	}
+	for _, endpoint := range config.Endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%w: %q", InvalidEndpoint, endpoint)
+		}
+		c.endpoints = append(c.endpoints, u)
+	}
+	if c.retryTimeout <= 0 {
+		c.retryTimeout = defaultRetryTimeout
+	}
+
+	httpClient := http.Client{}
+	if config.HTTPClient != nil {
+		httpClient = *config.HTTPClient
+	}
+	// a redirect names the leader, which is remembered for the next calls.
+	httpClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	c.httpClient = &httpClient
+	return c, nil
+}
+
+// request is one API call.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   []byte
+	// toLeader sends the call to the leader if it is known or can be found.
+	toLeader bool
+	// at sends the call to this node only, when set.
+	at *url.URL
+}
+
+// response is the answer of a node. Only 2xx and non-retryable errors make
+// it out of do.
+type response struct {
+	status  int
+	header  http.Header
+	trailer http.Header
+	body    []byte
+}
+
+// do runs req, retrying with exponential backoff for up to RetryTimeout
+// while nodes are unreachable or answer 502, 503 or 504. A non-2xx answer is
+// returned as an *APIError.
+//
+// Writes are only retried while they provably were not applied: the node
+// could not be dialled, redirected to the leader or answered 503. A 500, a
+// 502, a 504 or a connection lost after sending can come after the leader
+// committed the write, so they fail with OutcomeUnknown instead.
+func (c *Client) do(ctx context.Context, req request) (*response, error) {
+	policy := backoff.NewExponentialBackOff()
+	policy.InitialInterval = 50 * time.Millisecond
+	policy.MaxElapsedTime = c.retryTimeout
+
+	var resp *response
+	err := backoff.Retry(func() error {
+		r, err := c.attempt(ctx, req)
+		if ctx.Err() != nil {
+			return backoff.Permanent(ctx.Err())
+		}
+		if err != nil && !req.idempotent() && !notApplied(err) {
+			return backoff.Permanent(fmt.Errorf("%w. %s", OutcomeUnknown, err))
+		}
+		var apiErr *APIError
+		if err != nil && !errors.As(err, &apiErr) {
+			// a node that cannot be reached leaves the cluster unavailable
+			// once retries run out. Permanent errors come out unwrapped.
+			return fmt.Errorf("%w: %w", Unavailable, err)
+		}
+		if err != nil {
+			return err
+		}
+		if r.status == http.StatusInternalServerError && !req.idempotent() {
+			return backoff.Permanent(fmt.Errorf("%w. %w", OutcomeUnknown, newAPIError(req, r)))
+		}
+		if r.status < 200 || r.status > 299 {
+			return backoff.Permanent(newAPIError(req, r))
+		}
+		resp = r
+		return nil
+	}, backoff.WithContext(policy, ctx))
+	return resp, err
+}
+
+// attempt sends req once. Errors are worth retrying, answers are not.
+func (c *Client) attempt(ctx context.Context, req request) (*response, error) {
+	base := req.at
+	if base == nil {
+		base = c.target(ctx, req.toLeader)
+	}
+	u := *base
+	u.Path = strings.TrimSuffix(base.Path, "/") + req.path
+	u.RawQuery = req.query.Encode()
+
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u.String(), body)
+	if err != nil {
+		return nil, backoff.Permanent(err)
+	}
+	for name, values := range req.header {
+		httpReq.Header[name] = values
+	}
+	if req.body != nil && httpReq.Header.Get("Content-Type") == "" {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		c.forget(base)
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		c.forget(base)
+		return nil, err
+	}
+	resp := &response{status: httpResp.StatusCode, header: httpResp.Header, trailer: httpResp.Trailer, body: respBody}
+
+	switch resp.status {
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		location, err := httpResp.Location()
+		if err != nil {
+			return nil, backoff.Permanent(err)
+		}
+		c.setLeader(&url.URL{Scheme: location.Scheme, Host: location.Host})
+		return nil, fmt.Errorf("%w at %s", errRedirected, location.Host)
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		c.forget(base)
+		return nil, newAPIError(req, resp)
+	}
+	return resp, nil
+}
+
+// errRedirected is returned by attempt when a node pointed to the leader
+// instead of handling the request.
+var errRedirected = errors.New("redirected to the leader")
+
+// idempotent tells whether req can be repeated whatever came of the previous
+// attempts.
+func (req request) idempotent() bool {
+	return req.method == http.MethodGet || req.method == http.MethodHead
+}
+
+// notApplied tells whether err, returned by attempt, proves that the request
+// was not applied: it was never sent, or the node answered that it could not
+// take it. Followers only answer 503 before proposing anything.
+func notApplied(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusServiceUnavailable
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op == "dial"
+	}
+	return errors.Is(err, errRedirected)
+}
+
+// target is the base URL req goes to: the leader when asked for and known,
+// the current endpoint otherwise.
+func (c *Client) target(ctx context.Context, toLeader bool) *url.URL {
+	c.mu.Lock()
+	leader := c.leader
+	discover := toLeader && leader == nil && time.Since(c.missedAt) > discoveryInterval
+	c.mu.Unlock()
+
+	if discover {
+		if leader = c.discoverLeader(ctx); leader == nil {
+			c.mu.Lock()
+			c.missedAt = time.Now()
+			c.mu.Unlock()
+		}
+	}
+	if toLeader && leader != nil {
+		return leader
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endpoints[c.next]
+}
+
+// discoverLeader asks the endpoints, one after the other, where the leader is.
+func (c *Client) discoverLeader(ctx context.Context) *url.URL {
+	for _, endpoint := range c.endpoints {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.JoinPath("/status").String(), nil)
+		if err != nil {
+			continue
+		}
+		if c.token != "" {
+			httpReq.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		httpResp, err := c.httpClient.Do(httpReq)
+		if err != nil {
+			continue
+		}
+		var st Status
+		err = json.NewDecoder(httpResp.Body).Decode(&st)
+		httpResp.Body.Close()
+		if err != nil || httpResp.StatusCode != http.StatusOK {
+			continue
+		}
+
+		var leader *url.URL
+		switch {
+		case st.State == "Leader":
+			leader = endpoint
+		case st.LeaderHTTPAddr != "":
+			leader = &url.URL{Scheme: endpoint.Scheme, Host: st.LeaderHTTPAddr}
+		default:
+			continue
+		}
+		c.setLeader(leader)
+		return leader
+	}
+	return nil
+}
+
+func (c *Client) setLeader(leader *url.URL) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leader = leader
+}
+
+// forget drops base as the leader and moves on to the next endpoint after a
+// failed call.
+func (c *Client) forget(base *url.URL) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leader != nil && *c.leader == *base {
+		c.leader = nil
+	}
+	if *c.endpoints[c.next] == *base {
+		c.next = (c.next + 1) % len(c.endpoints)
+	}
+}
+
+// Leader returns the base URL of the leader, finding it if it is not known
+// yet. It is empty when no node knows a leader.
+func (c *Client) Leader(ctx context.Context) string {
+	c.mu.Lock()
+	leader := c.leader
+	c.mu.Unlock()
+	if leader == nil {
+		leader = c.discoverLeader(ctx)
+	}
+	if leader == nil {
+		return ""
+	}
+	return leader.String()
+}
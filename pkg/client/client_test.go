@@ -0,0 +1,371 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tomkaith13/dist-kv-store/internal/clustertest"
+	"github.com/tomkaith13/dist-kv-store/internal/service"
+)
+
+func TestClient(t *testing.T) {
+	ts := clustertest.NewServer(t, service.Config{
+		KeyMaxLen:          100,
+		ValMaxLen:          200,
+		MaxMapSize:         1000,
+		WatchHistory:       16,
+		RaftNodeID:         "1",
+		Debug:              true,
+		AuthEnabled:        true,
+		AuthBootstrapToken: "secret",
+	})
+	c, err := New(Config{Endpoints: []string{ts.URL}, Token: "secret", RetryTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// the watch resumes after a first write, so it misses none of the next.
+	start, err := c.Set(ctx, "other", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	watcher := c.Watch(watchCtx, WatchOptions{Prefix: "user-", AfterIndex: start})
+
+	revision, err := c.Set(ctx, "user-1", `quoted "value" with : and }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := c.Get(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != (Entry{Key: "user-1", Value: `quoted "value" with : and }`, Revision: revision}) {
+		t.Fatalf("unexpected entry: %+v, revision: %d", entry, revision)
+	}
+
+	if _, err := c.Put(ctx, "user-1", "x", PutOptions{CreateOnly: true}); !errors.Is(err, PreconditionFailed) {
+		t.Fatalf("create of an existing key. Expected PreconditionFailed, got: %v", err)
+	}
+	if _, err := c.Put(ctx, "user-1", "x", PutOptions{Revision: revision + 10}); !errors.Is(err, PreconditionFailed) {
+		t.Fatalf("write at a stale revision. Expected PreconditionFailed, got: %v", err)
+	}
+	newRevision, err := c.Put(ctx, "user-1", "v2", PutOptions{Revision: revision, TTL: time.Hour})
+	if err != nil || newRevision <= revision {
+		t.Fatalf("compare and swap. revision: %d err: %v", newRevision, err)
+	}
+	if _, err := c.Set(ctx, "user 2", "spaces"); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := c.List(ctx, ListOptions{Prefix: "user", Values: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Keys) != 2 || list.Keys[0].Key != "user 2" || list.Keys[1].Value != "v2" {
+		t.Fatalf("unexpected list: %+v", list)
+	}
+
+	if err := c.CompareAndDelete(ctx, "user-1", revision); !errors.Is(err, PreconditionFailed) {
+		t.Fatalf("delete at a stale revision. Expected PreconditionFailed, got: %v", err)
+	}
+	if err := c.Delete(ctx, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "user-1"); !errors.Is(err, KeyNotFound) {
+		t.Fatalf("read of a deleted key. Expected KeyNotFound, got: %v", err)
+	}
+	var apiErr *APIError
+	if err := c.Delete(ctx, "user-1"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("delete of a deleted key. Expected a 404 APIError, got: %v", err)
+	}
+	if _, err := c.Get(ctx, "a/b"); !errors.Is(err, InvalidKey) {
+		t.Fatalf("key with a slash. Expected InvalidKey, got: %v", err)
+	}
+
+	deleted, err := c.List(ctx, ListOptions{Prefix: "user-"})
+	if err != nil || len(deleted.Keys) != 0 {
+		t.Fatalf("list after delete: %+v err: %v", deleted, err)
+	}
+	for _, want := range []WatchEvent{
+		{Type: "set", Key: "user-1", Value: `quoted "value" with : and }`, Index: revision},
+		{Type: "set", Key: "user-1", Value: "v2", Index: newRevision},
+		{Type: "delete", Key: "user-1"},
+	} {
+		select {
+		case got := <-watcher.Events:
+			if want.Type == "delete" && got.Index > newRevision {
+				// failed writes take an index too, so the delete's is not known.
+				want.Index = got.Index
+			}
+			if got != want {
+				t.Fatalf("unexpected event. Expected: %+v, got: %+v", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event for %+v", want)
+		}
+	}
+
+	stopWatch()
+	for range watcher.Events {
+	}
+	if err := watcher.Err(); !errors.Is(err, context.Canceled) || watcher.Index() <= newRevision {
+		t.Fatalf("stopped watch. err: %v index: %d", watcher.Err(), watcher.Index())
+	}
+
+	anonymous, err := New(Config{Endpoints: []string{ts.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := anonymous.Get(ctx, "user 2"); !errors.Is(err, Unauthenticated) {
+		t.Fatalf("read without a token. Expected Unauthenticated, got: %v", err)
+	}
+
+	if _, err := New(Config{}); err != NoEndpoints {
+		t.Fatalf("expected NoEndpoints, got: %v", err)
+	}
+	if _, err := New(Config{Endpoints: []string{"localhost:8888"}}); !errors.Is(err, InvalidEndpoint) {
+		t.Fatalf("endpoint without a scheme. Expected InvalidEndpoint, got: %v", err)
+	}
+}
+
+func TestClientFindsLeaderAndRetries(t *testing.T) {
+	// the leader is not ready for the first write it gets.
+	var leaderWrites atomic.Int32
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/status":
+			w.Write([]byte(`{"state":"Leader"}`))
+		case r.Method == http.MethodPut && leaderWrites.Add(1) == 1:
+			http.Error(w, "Leader not ready yet!! please try later", http.StatusServiceUnavailable)
+		case r.Method == http.MethodPut:
+			w.Header().Set("ETag", `"7"`)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer leader.Close()
+	leaderURL, _ := url.Parse(leader.URL)
+
+	// a follower points at the leader in its status.
+	var followerWrites atomic.Int32
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/status" {
+			w.Write([]byte(`{"state":"Follower","leader_http_addr":"` + leaderURL.Host + `"}`))
+			return
+		}
+		followerWrites.Add(1)
+		http.Error(w, "unexpected", http.StatusInternalServerError)
+	}))
+	defer follower.Close()
+
+	ctx := context.Background()
+	c, err := New(Config{Endpoints: []string{follower.URL}, RetryTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision, err := c.Set(ctx, "a", "b")
+	if err != nil || revision != 7 {
+		t.Fatalf("write through the discovered leader. revision: %d err: %v", revision, err)
+	}
+	if leaderWrites.Load() != 2 || followerWrites.Load() != 0 {
+		t.Fatalf("expected 2 writes on the leader and none on the follower, got %d and %d",
+			leaderWrites.Load(), followerWrites.Load())
+	}
+
+	// a node in redirect mode hands out the leader with a 307.
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/status" {
+			w.Write([]byte(`{"state":"Follower"}`))
+			return
+		}
+		http.Redirect(w, r, leader.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer redirecting.Close()
+	c, err = New(Config{Endpoints: []string{redirecting.URL}, RetryTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision, err := c.Set(ctx, "a", "b"); err != nil || revision != 7 {
+		t.Fatalf("write through a redirect. revision: %d err: %v", revision, err)
+	}
+	if c.Leader(ctx) != leader.URL {
+		t.Fatalf("leader not remembered. Expected: %s, got: %s", leader.URL, c.Leader(ctx))
+	}
+
+	// retries give up after RetryTimeout.
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Leader not ready yet!! please try later", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	c, err = New(Config{Endpoints: []string{down.URL}, RetryTimeout: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := c.Set(ctx, "a", "b"); !errors.Is(err, Unavailable) {
+		t.Fatalf("write without a leader. Expected Unavailable, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("retries outlived RetryTimeout: %s", elapsed)
+	}
+
+	// so do nodes that cannot be reached at all.
+	closed := httptest.NewServer(nil)
+	closed.Close()
+	c, err = New(Config{Endpoints: []string{closed.URL}, RetryTimeout: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Set(ctx, "a", "b"); !errors.Is(err, Unavailable) {
+		t.Fatalf("write to an unreachable node. Expected Unavailable, got: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.Set(cancelled, "a", "b"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("write with a cancelled context. Expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestClientAdmin(t *testing.T) {
+	ts := clustertest.NewServer(t, service.Config{
+		KeyMaxLen:    100,
+		ValMaxLen:    200,
+		MaxMapSize:   1000,
+		RaftNodeID:   "1",
+		RaftAddr:     "localhost:24201",
+		RaftStoreDir: t.TempDir(),
+		RaftTimeout:  5 * time.Second,
+		RaftLeader:   true,
+	})
+
+	ctx := context.Background()
+	c, err := New(Config{Endpoints: []string{ts.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision, err := c.Set(ctx, "a", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := c.Status(ctx, ts.URL)
+	if err != nil || st.ID != "1" || st.State != "Leader" || st.Keys != 1 {
+		t.Fatalf("status. %+v err: %v", st, err)
+	}
+	members, err := c.Members(ctx)
+	if err != nil || len(members) != 1 || members[0].ID != "1" || !members[0].Leader {
+		t.Fatalf("members. %+v err: %v", members, err)
+	}
+	if err := c.RemoveMember(ctx, "9"); !errors.Is(err, KeyNotFound) {
+		t.Fatalf("remove of an unknown member. Expected KeyNotFound, got: %v", err)
+	}
+	snapshot, err := c.Snapshot(ctx)
+	if err != nil || snapshot.ID == "" || snapshot.Index < revision {
+		t.Fatalf("snapshot. %+v err: %v", snapshot, err)
+	}
+
+	var archive bytes.Buffer
+	n, err := c.Backup(ctx, &archive)
+	if err != nil || n != int64(archive.Len()) {
+		t.Fatalf("backup. %d bytes err: %v", n, err)
+	}
+	if _, err := c.Set(ctx, "a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := c.Restore(ctx, &archive)
+	if err != nil || meta.NodeID != "1" || meta.Index < revision {
+		t.Fatalf("restore. %+v err: %v", meta, err)
+	}
+	if entry, err := c.Get(ctx, "a"); err != nil || entry.Value != "1" {
+		t.Fatalf("read after restore. Expected the backed up value, got: %+v err: %v", entry, err)
+	}
+	if _, err := c.Restore(ctx, strings.NewReader("not a backup")); !errors.Is(err, InvalidRequest) {
+		t.Fatalf("restore of garbage. Expected InvalidRequest, got: %v", err)
+	}
+}
+
+func TestClientDoesNotRepeatWritesOfUnknownOutcome(t *testing.T) {
+	// the leader commits every write, but times out answering it. Reads time
+	// out once before they are answered.
+	var writes, reads atomic.Int32
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/status":
+			w.Write([]byte(`{"state":"Leader"}`))
+		case r.Method == http.MethodGet && reads.Add(1) == 1:
+			http.Error(w, "context deadline exceeded", http.StatusGatewayTimeout)
+		case r.Method == http.MethodGet:
+			w.Header().Set("ETag", `"7"`)
+			w.Write([]byte(`{ "a" : "b" }`))
+		default:
+			writes.Add(1)
+			http.Error(w, "context deadline exceeded", http.StatusGatewayTimeout)
+		}
+	}))
+	defer leader.Close()
+
+	ctx := context.Background()
+	c, err := New(Config{Endpoints: []string{leader.URL}, RetryTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Put(ctx, "a", "b", PutOptions{CreateOnly: true}); !errors.Is(err, OutcomeUnknown) || errors.Is(err, Unavailable) {
+		t.Fatalf("create answered 504. Expected OutcomeUnknown, got: %v", err)
+	}
+	if err := c.Delete(ctx, "a"); !errors.Is(err, OutcomeUnknown) {
+		t.Fatalf("delete answered 504. Expected OutcomeUnknown, got: %v", err)
+	}
+	if writes.Load() != 2 {
+		t.Fatalf("writes of unknown outcome were repeated. Expected 2 writes, got: %d", writes.Load())
+	}
+
+	if _, err := c.Get(ctx, "a"); err != nil || reads.Load() != 2 {
+		t.Fatalf("read answered 504 once. Expected it retried, got %d reads err: %v", reads.Load(), err)
+	}
+}
+
+func TestClientWriteFailuresAreNotRejections(t *testing.T) {
+	// the leader fails every write with a 500, which says nothing about
+	// whether the key existed.
+	var writes atomic.Int32
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/status" {
+			w.Write([]byte(`{"state":"Leader"}`))
+			return
+		}
+		writes.Add(1)
+		http.Error(w, "failed to apply", http.StatusInternalServerError)
+	}))
+	defer leader.Close()
+
+	ctx := context.Background()
+	c, err := New(Config{Endpoints: []string{leader.URL}, RetryTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Put(ctx, "a", "b", PutOptions{CreateOnly: true}); !errors.Is(err, OutcomeUnknown) || errors.Is(err, KeyAlreadyExists) {
+		t.Fatalf("create answered 500. Expected OutcomeUnknown, got: %v", err)
+	}
+	if err := c.Delete(ctx, "a"); !errors.Is(err, OutcomeUnknown) || errors.Is(err, KeyNotFound) {
+		t.Fatalf("delete answered 500. Expected OutcomeUnknown, got: %v", err)
+	}
+	var apiErr *APIError
+	if _, err := c.Set(ctx, "a", "b"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("set answered 500. Expected the answer kept, got: %v", err)
+	}
+	if writes.Load() != 3 {
+		t.Fatalf("failed writes were repeated. Expected 3 writes, got: %d", writes.Load())
+	}
+}
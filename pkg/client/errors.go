@@ -0,0 +1,78 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	NoEndpoints     error = errors.New("client needs at least one endpoint")
+	InvalidEndpoint error = errors.New("endpoint must be an http or https URL")
+	// InvalidKey is returned for keys GET, PUT and DELETE /key/{id} cannot
+	// address: empty keys and keys containing a slash.
+	InvalidKey error = errors.New("key must not be empty or contain /")
+
+	// the errors an *APIError unwraps to, by status code.
+	KeyNotFound        error = errors.New("key not found")
+	KeyAlreadyExists   error = errors.New("key already exists")
+	PreconditionFailed error = errors.New("precondition failed")
+	InvalidRequest     error = errors.New("invalid request")
+	Unauthenticated    error = errors.New("missing or unknown API token")
+	PermissionDenied   error = errors.New("token is not allowed to do this")
+	HistoryCompacted   error = errors.New("watch index is no longer in the history")
+	// Unavailable is returned once retries ran out while the cluster had no
+	// leader or could not be reached.
+	Unavailable error = errors.New("cluster unavailable")
+	// OutcomeUnknown is returned for a write that failed in a way that does
+	// not tell whether it was applied, e.g. a leader that timed out answering
+	// after it committed. It is not retried, as repeating a delete or a
+	// conditional write could then fail although the first attempt succeeded.
+	OutcomeUnknown error = errors.New("write may or may not have been applied")
+)
+
+// APIError is a non-2xx answer of a node. It unwraps to one of the errors
+// above, so callers can check errors.Is(err, client.KeyNotFound).
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	// Message is the body of the answer.
+	Message string
+}
+
+func newAPIError(req request, resp *response) *APIError {
+	return &APIError{
+		Method:     req.method,
+		Path:       req.path,
+		StatusCode: resp.status,
+		Message:    strings.TrimSpace(string(resp.body)),
+	}
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s %s answered %d: %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return KeyNotFound
+	case http.StatusConflict:
+		return KeyAlreadyExists
+	case http.StatusPreconditionFailed:
+		return PreconditionFailed
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return InvalidRequest
+	case http.StatusUnauthorized:
+		return Unauthenticated
+	case http.StatusForbidden:
+		return PermissionDenied
+	case http.StatusGone:
+		return HistoryCompacted
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return Unavailable
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Consistency is the guarantee a read asks for. See the read consistency
+// section of the Readme.
+type Consistency string
+
+const (
+	// ConsistencyDefault leaves the choice to the node's READ_CONSISTENCY.
+	ConsistencyDefault      Consistency = ""
+	ConsistencyStale        Consistency = "stale"
+	ConsistencyLeaderLease  Consistency = "leader-lease"
+	ConsistencyLinearizable Consistency = "linearizable"
+)
+
+// onLeader tells whether reads of consistency c are best sent to the leader.
+func (c Consistency) onLeader() bool {
+	return c == ConsistencyLeaderLease || c == ConsistencyLinearizable
+}
+
+// Entry is a key with its value and revision, the raft index of the last
+// write to it.
+type Entry struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Revision uint64 `json:"revision"`
+}
+
+func keyPath(key string) (string, error) {
+	if key == "" || strings.Contains(key, "/") {
+		return "", fmt.Errorf("%w: %q", InvalidKey, key)
+	}
+	return "/key/" + key, nil
+}
+
+// Get reads key with the node's default consistency.
+func (c *Client) Get(ctx context.Context, key string) (Entry, error) {
+	return c.GetWithConsistency(ctx, key, ConsistencyDefault)
+}
+
+// GetWithConsistency reads key with the given consistency. Leader-lease and
+// linearizable reads go to the leader.
+func (c *Client) GetWithConsistency(ctx context.Context, key string, consistency Consistency) (Entry, error) {
+	path, err := keyPath(key)
+	if err != nil {
+		return Entry{}, err
+	}
+	req := request{method: http.MethodGet, path: path, toLeader: consistency.onLeader()}
+	if consistency != ConsistencyDefault {
+		req.query = url.Values{"consistency": {string(consistency)}}
+	}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	gotKey, val, err := parseKeyValue(string(resp.body))
+	if err != nil {
+		return Entry{}, err
+	}
+	revision, err := parseETag(resp.header.Get("ETag"))
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{Key: gotKey, Value: val, Revision: revision}, nil
+}
+
+// parseKeyValue reads the { "key" : "value" } body of GET /key/{id}, where
+// both strings are quoted the way Go quotes them.
+func parseKeyValue(body string) (string, string, error) {
+	invalid := fmt.Errorf("unexpected GET /key body %q", body)
+
+	rest, ok := strings.CutPrefix(body, "{ ")
+	if !ok {
+		return "", "", invalid
+	}
+	quotedKey, err := strconv.QuotedPrefix(rest)
+	if err != nil {
+		return "", "", invalid
+	}
+	rest, ok = strings.CutPrefix(rest[len(quotedKey):], " : ")
+	if !ok {
+		return "", "", invalid
+	}
+	quotedVal, err := strconv.QuotedPrefix(rest)
+	if err != nil || rest[len(quotedVal):] != " }" {
+		return "", "", invalid
+	}
+
+	key, err := strconv.Unquote(quotedKey)
+	if err != nil {
+		return "", "", invalid
+	}
+	val, err := strconv.Unquote(quotedVal)
+	if err != nil {
+		return "", "", invalid
+	}
+	return key, val, nil
+}
+
+func parseETag(etag string) (uint64, error) {
+	revision, err := strconv.ParseUint(strings.Trim(etag, `"`), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected ETag %q", etag)
+	}
+	return revision, nil
+}
+
+// PutOptions make a Put conditional or expiring. The zero value upserts a
+// key that never expires.
+type PutOptions struct {
+	// TTL expires the key after this long, rounded up to whole seconds.
+	TTL time.Duration
+	// CreateOnly fails with PreconditionFailed if the key exists.
+	CreateOnly bool
+	// UpdateOnly fails with PreconditionFailed unless the key exists.
+	UpdateOnly bool
+	// Revision, when not 0, only updates the key if it is still at this
+	// revision, and fails with PreconditionFailed otherwise.
+	Revision uint64
+}
+
+// Set upserts key and returns its new revision.
+func (c *Client) Set(ctx context.Context, key, val string) (uint64, error) {
+	return c.Put(ctx, key, val, PutOptions{})
+}
+
+// Put writes key as opts asks and returns its new revision.
+func (c *Client) Put(ctx context.Context, key, val string, opts PutOptions) (uint64, error) {
+	path, err := keyPath(key)
+	if err != nil {
+		return 0, err
+	}
+	body, err := json.Marshal(struct {
+		Val string `json:"value"`
+		TTL int64  `json:"ttl,omitempty"`
+	}{Val: val, TTL: int64((opts.TTL + time.Second - 1) / time.Second)})
+	if err != nil {
+		return 0, err
+	}
+
+	header := http.Header{}
+	switch {
+	case opts.Revision != 0:
+		header.Set("If-Match", strconv.Quote(strconv.FormatUint(opts.Revision, 10)))
+	case opts.UpdateOnly:
+		header.Set("If-Match", "*")
+	case opts.CreateOnly:
+		header.Set("If-None-Match", "*")
+	}
+	resp, err := c.do(ctx, request{method: http.MethodPut, path: path, header: header, body: body, toLeader: true})
+	if err != nil {
+		return 0, err
+	}
+	return parseETag(resp.header.Get("ETag"))
+}
+
+// Delete removes key. It fails with KeyNotFound if the key does not exist.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.delete(ctx, key, nil)
+}
+
+// CompareAndDelete removes key only if it is still at revision.
+func (c *Client) CompareAndDelete(ctx context.Context, key string, revision uint64) error {
+	return c.delete(ctx, key, http.Header{"If-Match": {strconv.Quote(strconv.FormatUint(revision, 10))}})
+}
+
+func (c *Client) delete(ctx context.Context, key string, header http.Header) error {
+	path, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, request{method: http.MethodDelete, path: path, header: header, toLeader: true})
+	return err
+}
+
+// ListOptions selects a sorted range of keys, like GET /keys.
+type ListOptions struct {
+	Prefix string
+	Start  string
+	End    string
+	// Limit caps the number of keys of a page. 0 uses the node's default.
+	Limit int
+	// Values includes the values, not just keys and revisions.
+	Values bool
+	// Continue is the Next of the previous page.
+	Continue    string
+	Consistency Consistency
+}
+
+// ListedKey is one key of a list result.
+type ListedKey struct {
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Revision uint64 `json:"revision"`
+}
+
+// ListResult is a page of keys in ascending order. Next is empty on the last
+// page.
+type ListResult struct {
+	Keys []ListedKey `json:"keys"`
+	Next string      `json:"next,omitempty"`
+}
+
+// List returns a page of the keys selected by opts.
+func (c *Client) List(ctx context.Context, opts ListOptions) (ListResult, error) {
+	query := url.Values{}
+	for name, val := range map[string]string{
+		"prefix":      opts.Prefix,
+		"start":       opts.Start,
+		"end":         opts.End,
+		"continue":    opts.Continue,
+		"consistency": string(opts.Consistency),
+	} {
+		if val != "" {
+			query.Set(name, val)
+		}
+	}
+	if opts.Limit != 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Values {
+		query.Set("values", "true")
+	}
+
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/keys", query: query, toLeader: opts.Consistency.onLeader()})
+	if err != nil {
+		return ListResult{}, err
+	}
+	var result ListResult
+	if err := json.Unmarshal(resp.body, &result); err != nil {
+		return ListResult{}, fmt.Errorf("unexpected GET /keys body: %w", err)
+	}
+	return result, nil
+}
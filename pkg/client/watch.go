@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// WatchEvent is a committed change to a key. Index is the raft index of the
+// write. Expired keys show up as deletes.
+type WatchEvent struct {
+	// Type is "set" or "delete".
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Index uint64 `json:"index"`
+}
+
+// WatchOptions selects the changes to watch. Key and Prefix are exclusive,
+// with neither set every key is watched.
+type WatchOptions struct {
+	Key    string
+	Prefix string
+	// AfterIndex resumes after an index seen earlier. 0 starts with the
+	// changes made after the watch started.
+	AfterIndex uint64
+}
+
+// Watcher delivers the events of a watch. Events is closed when the watch
+// ends: its context was cancelled, the cluster stayed unreachable for longer
+// than RetryTimeout, or the node no longer has the history to resume from.
+type Watcher struct {
+	Events <-chan WatchEvent
+
+	// index is where the next poll resumes from.
+	index uint64
+	err   error
+	done  chan struct{}
+}
+
+// Err blocks until Events is closed and tells why the watch ended. It is
+// the context error after a cancellation, and wraps HistoryCompacted when
+// the keys have to be read again before watching from a fresh index.
+func (w *Watcher) Err() error {
+	<-w.done
+	return w.err
+}
+
+// Index returns the index of the last event delivered, or AfterIndex if
+// there was none. It is only final once Events is closed.
+func (w *Watcher) Index() uint64 {
+	<-w.done
+	return w.index
+}
+
+// watchPoll is the answer of a GET /watch long-poll.
+type watchPoll struct {
+	Events []WatchEvent `json:"events"`
+	Index  uint64       `json:"index"`
+}
+
+// Watch long-polls GET /watch and delivers the changes matching opts in
+// commit order until ctx is done.
+func (c *Client) Watch(ctx context.Context, opts WatchOptions) *Watcher {
+	events := make(chan WatchEvent)
+	w := &Watcher{Events: events, index: opts.AfterIndex, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		defer close(events)
+		w.err = c.watch(ctx, opts, w, events)
+	}()
+	return w
+}
+
+func (c *Client) watch(ctx context.Context, opts WatchOptions, w *Watcher, events chan<- WatchEvent) error {
+	query := url.Values{}
+	if opts.Key != "" {
+		query.Set("key", opts.Key)
+	}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	resume := opts.AfterIndex != 0
+
+	for {
+		if resume {
+			query.Set("index", strconv.FormatUint(w.index, 10))
+		}
+		resp, err := c.do(ctx, request{method: http.MethodGet, path: "/watch", query: query})
+		if err != nil {
+			return err
+		}
+		var poll watchPoll
+		if err := json.Unmarshal(resp.body, &poll); err != nil {
+			return fmt.Errorf("unexpected GET /watch body: %w", err)
+		}
+
+		for _, event := range poll.Events {
+			select {
+			case events <- event:
+				w.index = event.Index
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		w.index = poll.Index
+		resume = true
+	}
+}